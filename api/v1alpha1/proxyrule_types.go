@@ -0,0 +1,157 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ConditionReady reports if the ProxyRule compiled and is used to rewrite images.
+	ConditionReady = "Ready"
+
+	// ReasonCompiled is the Ready condition reason for a ProxyRule which compiled successfully.
+	ReasonCompiled = "Compiled"
+	// ReasonInvalid is the Ready condition reason for a ProxyRule which failed to compile.
+	ReasonInvalid = "Invalid"
+)
+
+// ProxyRuleSpec mirrors the rules of the webhook configuration file. Image references that match and are not
+// excluded have their registry rewritten with the replacement string.
+type ProxyRuleSpec struct {
+	// Matches is a list of regular expressions that match a registry in an image, e.g '^docker.io'.
+	// +kubebuilder:validation:MinItems=1
+	Matches []string `json:"matches"`
+	// Excludes is a list of regular expressions whose images that match should be excluded from this rule.
+	// +optional
+	Excludes []string `json:"excludes,omitempty"`
+	// Replace is the string used to rewrite the registry in matching rules. If it contains a $, it's instead a
+	// template for the whole rewritten image reference.
+	// +kubebuilder:validation:MinLength=1
+	Replace string `json:"replace"`
+	// SkipUnhealthy doesn't rewrite images to a registry while it's unhealthy, according to the registry probes or
+	// failed upstream checks, even if it's the last replacement of the rule.
+	// +optional
+	SkipUnhealthy bool `json:"skipUnhealthy,omitempty"`
+	// Fallbacks are replacements tried in order when the registry of Replace, or of the previous fallback, is
+	// unhealthy or fails the upstream check. Each is a registry or a template like Replace, or "origin" to keep the
+	// original image without evaluating any further rules.
+	// +optional
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	// RewritePath rewrites the repository path of matching images, in addition to replacing the registry.
+	// +optional
+	RewritePath *PathRewrite `json:"rewritePath,omitempty"`
+	// Mode is either "enforce" to rewrite matching images, or "audit" to only record the rewrites the rule would
+	// make. Defaults to the global mode of the webhook.
+	// +kubebuilder:validation:Enum=enforce;audit
+	// +optional
+	Mode string `json:"mode,omitempty"`
+	// CheckUpstream enables an additional check to ensure the image manifest exists before rewriting.
+	// +optional
+	CheckUpstream bool `json:"checkUpstream,omitempty"`
+	// Platforms is the list of the required platforms to check for if CheckUpstream is set. Defaults to "linux/amd64".
+	// +optional
+	Platforms []string `json:"platforms,omitempty"`
+	// PinDigest pins rewritten images to the digest of their manifest in the registry, e.g. image:tag@sha256:...
+	// +optional
+	PinDigest bool `json:"pinDigest,omitempty"`
+	// Namespaces limits the rule to pods in the listed namespaces.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceSelector limits the rule to pods in namespaces whose labels match the selector. If both Namespaces
+	// and NamespaceSelector are set, a namespace matching either is in scope.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// AuthSecretRef references an image pull secret (must be .dockerconfigjson type) which will be used to
+	// authenticate if CheckUpstream is set.
+	// +optional
+	AuthSecretRef *SecretReference `json:"authSecretRef,omitempty"`
+	// Auth selects how upstream checks authenticate to the registry. Defaults to the AuthSecretRef secret if set,
+	// otherwise anonymous.
+	// +optional
+	Auth *UpstreamAuth `json:"auth,omitempty"`
+	// ImagePullSecretRef references an image pull secret (must be .dockerconfigjson type) which is copied into the
+	// namespace of pods with a container rewritten by this rule, and added to their imagePullSecrets.
+	// +optional
+	ImagePullSecretRef *SecretReference `json:"imagePullSecretRef,omitempty"`
+}
+
+// UpstreamAuth selects the authentication provider of a rule's upstream checks.
+type UpstreamAuth struct {
+	// Provider is one of anonymous, secret or exec. The ecr, gcr and acr providers authenticate with the cloud
+	// credentials of the webhook, so they can only be used by the rules of the webhook configuration.
+	// +kubebuilder:validation:Enum=anonymous;secret;exec
+	Provider string `json:"provider"`
+	// CredentialProvider is the name of a credential provider plugin of the webhook configuration, run by the exec
+	// provider.
+	// +optional
+	CredentialProvider string `json:"credentialProvider,omitempty"`
+	// AnonymousFallback checks the registry anonymously if the provider fails to get credentials.
+	// +optional
+	AnonymousFallback bool `json:"anonymousFallback,omitempty"`
+}
+
+// PathRewrite rewrites the repository path of an image. The prefix is stripped first, then the regex substituted,
+// and finally the prefix added.
+type PathRewrite struct {
+	// StripPrefix is removed from the start of the path, e.g. "library/".
+	// +optional
+	StripPrefix string `json:"stripPrefix,omitempty"`
+	// Regex is a regular expression whose matches in the path are substituted with Replacement.
+	// +optional
+	Regex string `json:"regex,omitempty"`
+	// Replacement for the matches of Regex, which may reference capture groups as $1 or ${name}.
+	// +optional
+	Replacement string `json:"replacement,omitempty"`
+	// AddPrefix is added to the start of the path.
+	// +optional
+	AddPrefix string `json:"addPrefix,omitempty"`
+}
+
+// SecretReference references a secret by name and namespace.
+type SecretReference struct {
+	// Name of the secret.
+	Name string `json:"name"`
+	// Namespace of the secret, which must be the namespace the webhook is running in, and defaults to it.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// ProxyRuleStatus reports if the ProxyRule is in use.
+type ProxyRuleStatus struct {
+	// ObservedGeneration is the generation of the ProxyRule last reconciled.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions describe the state of the ProxyRule, the Ready condition reports any compile errors.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Replace",type=string,JSONPath=`.spec.replace`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ProxyRule is a cluster-wide rule for rewriting container images to a harbor proxy cache.
+type ProxyRule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ProxyRuleSpec   `json:"spec,omitempty"`
+	Status ProxyRuleStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ProxyRuleList contains a list of ProxyRule
+type ProxyRuleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ProxyRule `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ProxyRule{}, &ProxyRuleList{})
+}
@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// DecisionRewritten is the decision of a container whose image was rewritten.
+	DecisionRewritten = "rewritten"
+	// DecisionAudit is the decision of a container whose image would have been rewritten by a rule in audit mode.
+	DecisionAudit = "audit"
+	// DecisionUnchanged is the decision of a container whose image no rule rewrote.
+	DecisionUnchanged = "unchanged"
+	// DecisionPreviouslyRewritten is the decision of a container whose image was already rewritten by a previous
+	// admission of the same pod.
+	DecisionPreviouslyRewritten = "previously-rewritten"
+	// DecisionDisabled is the decision of a container opted out of rewriting by an annotation.
+	DecisionDisabled = "disabled"
+	// DecisionError is the decision of a container whose image failed to be rewritten, failing the admission.
+	DecisionError = "error"
+)
+
+const (
+	// UpstreamFound is the result of an upstream check which found the image.
+	UpstreamFound = "found"
+	// UpstreamNotFound is the result of an upstream check where the registry reported the image not found.
+	UpstreamNotFound = "not-found"
+	// UpstreamError is the result of an upstream check which failed to fetch the image manifest.
+	UpstreamError = "error"
+	// UpstreamSkipped is the result of an upstream check skipped by an annotation of the pod.
+	UpstreamSkipped = "skipped"
+)
+
+var logger = ctrl.Log.WithName("audit")
+
+// Record is the rewrite decision of a single container of an admission request.
+type Record struct {
+	Time time.Time `json:"time"`
+	// RequestUID is the uid of the admission request.
+	RequestUID string `json:"requestUID"`
+	// Kind of the admitted object, e.g. Pod or Deployment.
+	Kind         string `json:"kind"`
+	Namespace    string `json:"namespace"`
+	Name         string `json:"name,omitempty"`
+	GenerateName string `json:"generateName,omitempty"`
+	// Owner is the controller of the admitted object as kind/name, e.g. ReplicaSet/app-5d8f.
+	Owner  string `json:"owner,omitempty"`
+	DryRun bool   `json:"dryRun,omitempty"`
+
+	Container string `json:"container"`
+	// ContainerType is init, normal or ephemeral.
+	ContainerType string `json:"containerType"`
+	// OriginalImage is the image of the container before this or a previous admission rewrote it.
+	OriginalImage string `json:"originalImage"`
+	// FinalImage is the image of the container after the admission.
+	FinalImage string `json:"finalImage"`
+	// WouldRewrite is the image a rule in audit mode would have rewritten the image to.
+	WouldRewrite string `json:"wouldRewrite,omitempty"`
+	// Rule is the name of the rule which rewrote the image.
+	Rule string `json:"rule,omitempty"`
+	// Decision is one of the Decision constants.
+	Decision string `json:"decision"`
+	// UpstreamChecks are the upstream checks of the rewritten images made for the decision, in order.
+	UpstreamChecks []UpstreamCheck `json:"upstreamChecks,omitempty"`
+	// LatencyMilliseconds is the time taken to evaluate the rules for the container.
+	LatencyMilliseconds float64 `json:"latencyMs"`
+	// Error is the error which failed the admission, with the DecisionError decision.
+	Error string `json:"error,omitempty"`
+}
+
+// UpstreamCheck is the result of checking a rewritten image in the upstream registry.
+type UpstreamCheck struct {
+	Image string `json:"image"`
+	// Result is one of the Upstream constants.
+	Result string `json:"result"`
+	// Error is the error of the UpstreamError result.
+	Error string `json:"error,omitempty"`
+}
+
+// Logger writes audit records as JSON lines, to stdout or a file rotated by size. A nil Logger discards every record.
+type Logger struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+}
+
+// NewLogger creates an audit logger from the configuration, or returns nil if the audit log isn't enabled.
+func NewLogger(conf config.AuditLogConfig) (*Logger, error) {
+	if !conf.Enabled {
+		return nil, nil
+	}
+	if conf.Path == "" {
+		return &Logger{out: nopCloser{os.Stdout}}, nil
+	}
+	file, err := newRotatingFile(conf.Path, int64(conf.MaxSize)*1024*1024, conf.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	return &Logger{out: file}, nil
+}
+
+// Log writes the record on a single line. Records which fail to be written are logged, the admission isn't failed.
+func (l *Logger) Log(record Record) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		logger.Info(fmt.Sprintf("failed to encode the audit record of container %q: %s", record.Container, err.Error()))
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		logger.Info(fmt.Sprintf("failed to write the audit record of container %q: %s", record.Container, err.Error()))
+	}
+}
+
+// Close flushes and closes the audit log file, once the webhook stopped admitting requests.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.Close()
+}
+
+// nopCloser doesn't close stdout when the logger is closed.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readRecords returns the records of an audit log file.
+func readRecords(t *testing.T, path string) []Record {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	records := []Record{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := Record{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestLogger_Log(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := NewLogger(config.AuditLogConfig{Enabled: true, Path: path, MaxSize: 1, MaxBackups: 1})
+	require.NoError(t, err)
+	logger.Log(Record{
+		RequestUID:    "1234",
+		Kind:          "Pod",
+		Namespace:     "default",
+		Container:     "app",
+		OriginalImage: "nginx:1.27",
+		FinalImage:    "harbor.example.com/dockerhub-proxy/library/nginx:1.27",
+		Rule:          "docker.io rewrite rule",
+		Decision:      DecisionRewritten,
+		UpstreamChecks: []UpstreamCheck{
+			{Image: "harbor.example.com/dockerhub-proxy/library/nginx:1.27", Result: UpstreamFound},
+		},
+	})
+	require.NoError(t, logger.Close())
+
+	records := readRecords(t, path)
+	require.Len(t, records, 1)
+	require.Equal(t, "harbor.example.com/dockerhub-proxy/library/nginx:1.27", records[0].FinalImage)
+	require.Equal(t, UpstreamFound, records[0].UpstreamChecks[0].Result)
+
+	disabled, err := NewLogger(config.AuditLogConfig{Path: path})
+	require.NoError(t, err)
+	require.Nil(t, disabled)
+	disabled.Log(Record{Container: "discarded"})
+	require.NoError(t, disabled.Close())
+}
+
+func TestRotatingFile_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	require.NoError(t, os.WriteFile(path, []byte("existing\n"), 0o644))
+	file, err := newRotatingFile(path, 30, 2)
+	require.NoError(t, err)
+	write := func(lines ...string) {
+		for _, line := range lines {
+			n, err := file.Write([]byte(line))
+			require.NoError(t, err)
+			require.Equal(t, len(line), n)
+		}
+	}
+	read := func(path string) string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	write("first\n", "second\n", "third\n", "fourth-record\n")
+	require.Equal(t, "existing\nfirst\nsecond\nthird\n", read(path+".1"), "appends to the existing file, and records aren't split over files")
+	require.Equal(t, "fourth-record\n", read(path))
+
+	write("fifth-record\n", "sixth-record\n", "seventh-record\n", "eighth-record\n")
+	require.NoError(t, file.Close())
+	require.Equal(t, "eighth-record\n", read(path))
+	require.Equal(t, "sixth-record\nseventh-record\n", read(path+".1"))
+	require.Equal(t, "fourth-record\nfifth-record\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err), "only the max backups are kept")
+}
@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// rotatingFile appends to a file, and rotates it once it would grow over the max size: <path>.1 is renamed to
+// <path>.2 and so on up to the max backups, the oldest is removed, and the file is renamed to <path>.1.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// Write writes the record to the file, rotating it first if the record would grow it over the max size. Records
+// are never split over files.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to reopen %s: %w", r.path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file to the first backup and reopens it. If the files can't be renamed, the file is reopened and
+// keeps growing, so that records are still written.
+func (r *rotatingFile) rotate() error {
+	_ = r.file.Close()
+	if err := r.shiftBackups(); err != nil {
+		logger.Info(fmt.Sprintf("failed to rotate %s: %s", r.path, err.Error()))
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) shiftBackups() error {
+	if r.maxBackups == 0 {
+		return os.Remove(r.path)
+	}
+	if err := os.Remove(r.backup(r.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := r.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(r.backup(i), r.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(r.path, r.backup(1))
+}
+
+func (r *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
+
+// Close syncs the file to disk before closing it, so that the last records are persisted when the webhook exits.
+func (r *rotatingFile) Close() error {
+	return errors.Join(r.file.Sync(), r.file.Close())
+}
@@ -3,30 +3,118 @@ package config
 import (
 	"os"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// LoadConfiguration reads, validates and applies the defaults of the configuration file.
 func LoadConfiguration(path string) (*Configuration, error) {
-	conf := &Configuration{}
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	if err := yaml.Unmarshal(data, conf); err != nil {
+	return ParseConfiguration(data)
+}
+
+// ParseConfiguration decodes, validates and applies the defaults of a configuration. Unknown fields are rejected,
+// and semantic errors are returned as ValidationErrors.
+func ParseConfiguration(data []byte) (*Configuration, error) {
+	conf := &Configuration{}
+	if err := yaml.UnmarshalStrict(data, conf); err != nil {
+		return nil, err
+	}
+	conf.lines = newFieldLines(data)
+	if err := conf.validate(); err != nil {
 		return nil, err
 	}
 
-	ns := detectNamespace()
+	if conf.UpstreamCache.TTL == 0 {
+		conf.UpstreamCache.TTL = 5 * time.Minute
+	}
+	if conf.UpstreamCache.NegativeTTL == 0 {
+		conf.UpstreamCache.NegativeTTL = 30 * time.Second
+	}
+	if conf.UpstreamCache.MaxEntries == 0 {
+		conf.UpstreamCache.MaxEntries = 10000
+	}
+
+	if conf.RegistryHealth.Cooldown == 0 {
+		conf.RegistryHealth.Cooldown = 30 * time.Second
+	}
+	if conf.RegistryHealth.Probe.Interval == 0 {
+		conf.RegistryHealth.Probe.Interval = 30 * time.Second
+	}
+	if conf.RegistryHealth.Probe.Timeout == 0 {
+		conf.RegistryHealth.Probe.Timeout = 5 * time.Second
+	}
+	if conf.RegistryHealth.Probe.FailureThreshold == 0 {
+		conf.RegistryHealth.Probe.FailureThreshold = 3
+	}
+	if conf.RegistryHealth.Probe.SuccessThreshold == 0 {
+		conf.RegistryHealth.Probe.SuccessThreshold = 2
+	}
+
+	if conf.HarborDiscovery.Interval == 0 {
+		conf.HarborDiscovery.Interval = 5 * time.Minute
+	}
+	if conf.HarborDiscovery.Timeout == 0 {
+		conf.HarborDiscovery.Timeout = 30 * time.Second
+	}
+
+	if conf.ProjectVerification.Interval == 0 {
+		conf.ProjectVerification.Interval = 10 * time.Minute
+	}
+	if conf.ProjectVerification.Timeout == 0 {
+		conf.ProjectVerification.Timeout = 30 * time.Second
+	}
+
+	if conf.Events.Window == 0 {
+		conf.Events.Window = 10 * time.Minute
+	}
+	if conf.Events.QPS == 0 {
+		conf.Events.QPS = 1
+	}
+	if conf.Events.Burst == 0 {
+		conf.Events.Burst = 25
+	}
+
+	if conf.AuditLog.MaxSize == 0 {
+		conf.AuditLog.MaxSize = 100
+	}
+	if conf.AuditLog.MaxBackups == 0 {
+		conf.AuditLog.MaxBackups = 5
+	}
+
+	if conf.Mode == "" {
+		conf.Mode = ModeEnforce
+	}
+	if conf.AdmissionWarnings == "" {
+		conf.AdmissionWarnings = WarningsDegraded
+	}
+
+	conf.Namespace = detectNamespace()
 	for i := range conf.Rules {
-		conf.Rules[i].Namespace = ns
-		if len(conf.Rules[i].Platforms) == 0 {
-			conf.Rules[i].Platforms = []string{"linux/amd64"}
-		}
+		conf.defaultRule(&conf.Rules[i])
 	}
+	conf.defaultRule(&conf.HarborDiscovery.Rule)
 	return conf, nil
 }
 
+// defaultRule applies the defaults of the configuration to the rule.
+func (c *Configuration) defaultRule(rule *ProxyRule) {
+	rule.Namespace = c.Namespace
+	if rule.ImagePullSecretNamespace == "" {
+		rule.ImagePullSecretNamespace = c.Namespace
+	}
+	if rule.Mode == "" {
+		rule.Mode = c.Mode
+	}
+	if len(rule.Platforms) == 0 {
+		rule.Platforms = []string{DefaultPlatform}
+	}
+}
+
 func detectNamespace() string {
 	// This way assumes you've set the POD_NAMESPACE environment variable using the downward API.
 	// This check has to be done first for backwards compatibility with the way InClusterConfig was originally set up
@@ -44,6 +132,36 @@ func detectNamespace() string {
 	return "default"
 }
 
+const (
+	// ModeEnforce rewrites the images matching a rule.
+	ModeEnforce = "enforce"
+	// ModeAudit only records the rewrites a rule would make in a pod annotation and metric, without changing images.
+	ModeAudit = "audit"
+)
+
+const (
+	// WarningsNone returns no admission warnings.
+	WarningsNone = "none"
+	// WarningsDegraded warns about rewrites skipped or degraded by a failure, such as an upstream check which failed,
+	// an unhealthy registry, or a fallback.
+	WarningsDegraded = "degraded"
+	// WarningsAll also warns about images which aren't rewritten by design, because they're excluded by a rule,
+	// disabled by an opt-out annotation, or only rewritten by a rule in audit mode.
+	WarningsAll = "all"
+)
+
+// DefaultPlatform is the platform required by upstream checks when a rule doesn't list any platforms.
+const DefaultPlatform = "linux/amd64"
+
+// WorkloadGroups maps the workload controller resources which can be mutated to their API group.
+var WorkloadGroups = map[string]string{
+	"deployments":  "apps",
+	"statefulsets": "apps",
+	"daemonsets":   "apps",
+	"jobs":         "batch",
+	"cronjobs":     "batch",
+}
+
 // Configuration loads and keeps the related configuration items for the webhook.
 type Configuration struct {
 	// Port that the webhook listens on for admission review submissions
@@ -57,10 +175,177 @@ type Configuration struct {
 	MetricsAddr string `yaml:"metricsAddr"`
 	// HealthAddr is the address the readiness and health probes are mounted to.
 	HealthAddr string `yaml:"healthAddr"`
+	// Workloads is the list of workload controller resources (deployments, statefulsets, daemonsets, jobs and
+	// cronjobs) whose pod templates are also rewritten at admission time. Pods are always rewritten.
+	Workloads []string `yaml:"workloads"`
+	// Mode is the default mode of rules, either "enforce" (the default) or "audit".
+	Mode string `yaml:"mode"`
 	// Rules is the list of directives to use to evaluate pod container images.
 	Rules []ProxyRule `yaml:"rules"`
 	// Verbose enables trace logging.
 	Verbose bool `yaml:"verbose"`
+	// AdmissionWarnings is the verbosity of the warnings returned to clients such as kubectl about the rewrites of
+	// their pods, either "none", "degraded" (the default) or "all".
+	AdmissionWarnings string `yaml:"admissionWarnings"`
+	// EnableProxyRules enables the controller for cluster-scoped ProxyRule resources, whose rules are evaluated
+	// after the rules in this file. Requires the ProxyRule CustomResourceDefinition to be installed.
+	EnableProxyRules bool `yaml:"enableProxyRules"`
+	// Namespace that the webhook is running in.
+	Namespace string `yaml:"-"`
+	// UpstreamCache configures the cache of manifest lookups made for rules with checkUpstream set.
+	UpstreamCache UpstreamCacheConfig `yaml:"upstreamCache"`
+	// RegistryHealth configures the health tracking of replacement registries, from upstream checks and probes.
+	RegistryHealth RegistryHealthConfig `yaml:"registryHealth"`
+	// CredentialProviders are kubelet credential provider plugins which rules can authenticate upstream checks
+	// with. They're only configurable here, so that ProxyRule resources can't run arbitrary commands.
+	CredentialProviders []CredentialProvider `yaml:"credentialProviders"`
+	// HarborDiscovery generates rules from the proxy cache projects of a Harbor instance, which are evaluated after
+	// the rules in this file.
+	HarborDiscovery HarborDiscoveryConfig `yaml:"harborDiscovery"`
+	// ProjectVerification verifies that the replacements of the rules are Harbor proxy cache projects, and disables
+	// the rules whose replacements aren't.
+	ProjectVerification ProjectVerificationConfig `yaml:"projectVerification"`
+	// Events configures the Kubernetes events recorded about the rewrites of pods and their failures.
+	Events EventsConfig `yaml:"events"`
+	// AuditLog writes a JSON record of the rewrite decision of every container of every admission.
+	AuditLog AuditLogConfig `yaml:"auditLog"`
+
+	// lines are the lines of the fields in the configuration file, for validation errors.
+	lines fieldLines
+}
+
+// CredentialProvider is a kubelet credential provider exec plugin, see
+// https://kubernetes.io/docs/tasks/administer-cluster/kubelet-credential-provider/
+type CredentialProvider struct {
+	// Name of the provider, referenced by the auth of rules.
+	Name string `yaml:"name"`
+	// Command is the path of the plugin binary, or its name in the PATH.
+	Command string `yaml:"command"`
+	// Args are passed to the plugin.
+	Args []string `yaml:"args"`
+	// Env are additional environment variables set for the plugin.
+	Env []EnvVar `yaml:"env"`
+	// APIVersion of the CredentialProviderRequest sent to the plugin. Defaults to credentialprovider.kubelet.k8s.io/v1.
+	APIVersion string `yaml:"apiVersion"`
+}
+
+// EnvVar is an environment variable of a credential provider plugin.
+type EnvVar struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// HarborDiscoveryConfig configures the discovery of the proxy cache projects of a Harbor instance through its v2.0
+// API. A rule is generated for each project, matching the images of its upstream registry and replacing the registry
+// with the project.
+type HarborDiscoveryConfig struct {
+	// URL of the Harbor instance, e.g. https://harbor.example.com. Discovery is disabled if unset.
+	URL string `yaml:"url"`
+	// Registry is the registry images are rewritten to, defaults to the host of the URL.
+	Registry string `yaml:"registry"`
+	// CredentialsSecret is the name of a secret in the namespace of the webhook with the username and password of a
+	// Harbor user or robot account allowed to list the projects and registries, e.g. of type
+	// kubernetes.io/basic-auth. The API is queried anonymously if unset, and the URL must be https if set.
+	CredentialsSecret string `yaml:"credentialsSecret"`
+	// Interval between the discoveries. Defaults to 5m.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout of each request to the Harbor API. Defaults to 30s.
+	Timeout time.Duration `yaml:"timeout"`
+	// Projects limits the discovery to the projects whose name matches one of the regular expressions.
+	Projects []string `yaml:"projects"`
+	// Rule is the template of the generated rules, e.g. to set checkUpstream, mode or namespaces. The name, matches
+	// and replace of the rules are generated, and must not be set.
+	Rule ProxyRule `yaml:"rule"`
+}
+
+// ProjectVerificationConfig configures the verification of the replacements of the rules through the Harbor v2.0 API
+// of their registries. A rule is disabled if the project of its replace, or of a fallback, doesn't exist, isn't a
+// proxy cache, or proxies a registry which none of its matches mention.
+type ProjectVerificationConfig struct {
+	// Enabled turns on the verification, at startup and every interval.
+	Enabled bool `yaml:"enabled"`
+	// Interval between the verifications. Defaults to 10m.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout of each request to the Harbor API. Defaults to 30s.
+	Timeout time.Duration `yaml:"timeout"`
+	// CredentialsSecret is the name of a secret in the namespace of the webhook with the username and password of a
+	// Harbor user or robot account allowed to read the projects and registries of every replacement registry, e.g. of
+	// type kubernetes.io/basic-auth. The API is queried anonymously if unset.
+	CredentialsSecret string `yaml:"credentialsSecret"`
+	// Registries are the hosts of the Harbor instances the credentials are sent to, over https, e.g.
+	// harbor.example.com. The replacements of other registries are verified anonymously. Required with
+	// CredentialsSecret.
+	Registries []string `yaml:"registries"`
+	// FailReadiness fails the readiness check of the webhook while any rule is disabled, or before the first
+	// verification completed, instead of only reporting the disabled rules with the hcw_rules_disabled metric.
+	FailReadiness bool `yaml:"failReadiness"`
+}
+
+// FallbackOrigin is the fallback of a rule which keeps the original image.
+const FallbackOrigin = "origin"
+
+// RegistryHealthConfig configures the tracking of unhealthy replacement registries.
+type RegistryHealthConfig struct {
+	// Cooldown is how long a registry which failed an upstream check is considered unhealthy, so that rules try
+	// their fallbacks first. Defaults to 30s.
+	Cooldown time.Duration `yaml:"cooldown"`
+	// Probe configures the background probing of the /v2/ endpoint of every replacement registry.
+	Probe RegistryProbeConfig `yaml:"probe"`
+}
+
+// RegistryProbeConfig configures the background probing of replacement registries. A registry becomes unhealthy
+// after FailureThreshold consecutive failed probes, and healthy again after SuccessThreshold consecutive successes.
+type RegistryProbeConfig struct {
+	// Disabled turns off probing, so registries are only unhealthy when upstream checks fail.
+	Disabled bool `yaml:"disabled"`
+	// Interval between probes of each registry. Defaults to 30s.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout of a single probe. Defaults to 5s.
+	Timeout time.Duration `yaml:"timeout"`
+	// FailureThreshold is the number of consecutive failed probes after which a registry is unhealthy. Defaults to 3.
+	FailureThreshold int `yaml:"failureThreshold"`
+	// SuccessThreshold is the number of consecutive successful probes after which an unhealthy registry is healthy
+	// again. Defaults to 2.
+	SuccessThreshold int `yaml:"successThreshold"`
+}
+
+// UpstreamCacheConfig configures the in-memory cache of upstream manifest checks.
+type UpstreamCacheConfig struct {
+	// Disabled turns off caching, so every admission checks the registry.
+	Disabled bool `yaml:"disabled"`
+	// TTL is how long an image which exists upstream is cached. Defaults to 5m.
+	TTL time.Duration `yaml:"ttl"`
+	// NegativeTTL is how long an image which the registry reported as not found is cached. Defaults to 30s.
+	// Registry errors are never cached.
+	NegativeTTL time.Duration `yaml:"negativeTTL"`
+	// MaxEntries bounds the number of cached results, evicting the least recently used. Defaults to 10000.
+	MaxEntries int `yaml:"maxEntries"`
+}
+
+// EventsConfig configures the Kubernetes events recorded about rewrites, which are deduplicated and rate limited so a
+// large rollout doesn't flood the API server.
+type EventsConfig struct {
+	// Disabled turns off recording events.
+	Disabled bool `yaml:"disabled"`
+	// Window is how long an identical event about the same object isn't recorded again. Defaults to 10m.
+	Window time.Duration `yaml:"window"`
+	// QPS is the rate events are recorded at over every object, once the burst is used up. Defaults to 1.
+	QPS float32 `yaml:"qps"`
+	// Burst is the number of events recorded before the QPS applies. Defaults to 25.
+	Burst int `yaml:"burst"`
+}
+
+// AuditLogConfig configures the audit log, which records the rewrite decision of every container as a JSON line,
+// separately from the logs of the webhook.
+type AuditLogConfig struct {
+	// Enabled turns on the audit log.
+	Enabled bool `yaml:"enabled"`
+	// Path of the audit log file, or empty to write the records to stdout.
+	Path string `yaml:"path"`
+	// MaxSize is the size in megabytes the file is rotated at. Defaults to 100.
+	MaxSize int `yaml:"maxSize"`
+	// MaxBackups is the number of rotated files kept, named <path>.1 to <path>.<maxBackups>. Defaults to 5.
+	MaxBackups int `yaml:"maxBackups"`
 }
 
 // ProxyRule contains a list of regex rules used to match against images. Image references that match and are not
@@ -72,8 +357,24 @@ type ProxyRule struct {
 	Matches []string `yaml:"matches"`
 	// Excludes is a list of regular expressions whose images that match should be excluded from this rule.
 	Excludes []string `yaml:"excludes"`
-	// Replace is the string used to rewrite the registry in matching rules.
+	// Replace is the string used to rewrite the registry in matching rules. If it contains a $, it's instead a
+	// template for the whole rewritten image reference, which may reference the capture groups of the matching
+	// regex ($1, ${name}) and the ${registry}, ${repository}, ${tag} and ${digest} of the image.
 	Replace string `yaml:"replace"`
+	// SkipUnhealthy doesn't rewrite images to a registry while it's unhealthy, according to the registry probes or
+	// failed upstream checks, even if it's the last replacement of the rule.
+	SkipUnhealthy bool `yaml:"skipUnhealthy"`
+	// Fallbacks are replacements tried in order when the registry of Replace, or of the previous fallback, is
+	// unhealthy or fails the upstream check, e.g. a regional Harbor, then a central Harbor. Each is a registry or a
+	// template like Replace, or "origin" to keep the original image without evaluating any further rules.
+	Fallbacks []string `yaml:"fallbacks"`
+	// RewritePath rewrites the repository path of matching images, in addition to replacing the registry.
+	// Can't be combined with a Replace template.
+	RewritePath *PathRewrite `yaml:"rewritePath"`
+
+	// Mode is either "enforce" to rewrite matching images, or "audit" to only record the rewrites the rule would make
+	// in the harbor-container-webhook/would-rewrite pod annotation and a metric. Defaults to the global mode.
+	Mode string `yaml:"mode"`
 
 	// CheckUpstream enables an additional check to ensure the image manifest exists before rewriting.
 	// If the webhook lacks permissions to fetch the image manifest or the registry is down, the image
@@ -81,9 +382,85 @@ type ProxyRule struct {
 	CheckUpstream bool `yaml:"checkUpstream"`
 	// List of the required platforms to check for if CheckUpstream is set. Defaults to "linux/amd64" if unset.
 	Platforms []string `yaml:"platforms"`
+	// PinDigest pins rewritten images to the digest of their manifest in the registry, e.g. image:tag@sha256:...,
+	// so every replica runs the same image even if the tag moves. If the manifest can't be fetched, the image
+	// will not be rewritten by this rule.
+	PinDigest bool `yaml:"pinDigest"`
 	// AuthSecretName is a reference to an image pull secret (must be .dockerconfigjson type) which
 	// will be used to authenticate if `checkUpstream` is set. Unused if not specified or `checkUpstream` is false.
 	AuthSecretName string `yaml:"authSecretName"`
+	// Auth selects how upstream checks authenticate to the registry. Defaults to the AuthSecretName secret if set,
+	// otherwise anonymous.
+	Auth *UpstreamAuth `yaml:"auth"`
+	// ImagePullSecret is the name of an image pull secret (must be .dockerconfigjson type) which is copied into the
+	// namespace of pods with a container rewritten by this rule, and added to their imagePullSecrets.
+	ImagePullSecret string `yaml:"imagePullSecret"`
+	// ImagePullSecretNamespace is the namespace of the ImagePullSecret, defaults to the namespace the webhook is
+	// running in.
+	ImagePullSecretNamespace string `yaml:"imagePullSecretNamespace"`
+	// Namespaces limits the rule to pods in the listed namespaces. If neither Namespaces nor NamespaceSelector is
+	// set, the rule applies to every namespace.
+	Namespaces []string `yaml:"namespaces"`
+	// NamespaceSelector limits the rule to pods in namespaces whose labels match the selector. If both
+	// Namespaces and NamespaceSelector are set, a namespace matching either is in scope.
+	NamespaceSelector *LabelSelector `yaml:"namespaceSelector"`
 	// Namespace that the webhook is running in, used for accessing secrets for authenticated proxy rules
 	Namespace string
 }
+
+// Authentication providers of upstream checks.
+const (
+	// AuthProviderAnonymous doesn't authenticate.
+	AuthProviderAnonymous = "anonymous"
+	// AuthProviderSecret uses the credentials of the AuthSecretName image pull secret.
+	AuthProviderSecret = "secret"
+	// AuthProviderExec runs a kubelet credential provider plugin from the CredentialProviders.
+	AuthProviderExec = "exec"
+	// AuthProviderECR exchanges the AWS credentials of the webhook for an ECR authorization token.
+	AuthProviderECR = "ecr"
+	// AuthProviderGCR uses the access token of the GCP service account of the webhook, for GCR and Artifact Registry.
+	AuthProviderGCR = "gcr"
+	// AuthProviderACR exchanges the Azure managed or workload identity of the webhook for an ACR refresh token.
+	AuthProviderACR = "acr"
+)
+
+// UpstreamAuth selects the authentication provider of a rule's upstream checks.
+type UpstreamAuth struct {
+	// Provider is one of anonymous, secret, exec, ecr, gcr or acr.
+	Provider string `yaml:"provider"`
+	// CredentialProvider is the name of the CredentialProvider plugin run by the exec provider.
+	CredentialProvider string `yaml:"credentialProvider"`
+	// Region of the ECR API, defaults to the region of the registry host.
+	Region string `yaml:"region"`
+	// AnonymousFallback checks the registry anonymously if the provider fails to get credentials.
+	AnonymousFallback bool `yaml:"anonymousFallback"`
+}
+
+// PathRewrite rewrites the repository path of an image, e.g. "library/nginx". The prefix is stripped first, then
+// the regex substituted, and finally the prefix added.
+type PathRewrite struct {
+	// StripPrefix is removed from the start of the path, e.g. "library/".
+	StripPrefix string `yaml:"stripPrefix"`
+	// Regex is a regular expression whose matches in the path are substituted with Replacement.
+	Regex string `yaml:"regex"`
+	// Replacement for the matches of Regex, which may reference capture groups as $1 or ${name}.
+	Replacement string `yaml:"replacement"`
+	// AddPrefix is added to the start of the path.
+	AddPrefix string `yaml:"addPrefix"`
+}
+
+// LabelSelector is a label query over namespaces, with the same semantics as a kubernetes label selector.
+type LabelSelector struct {
+	// MatchLabels is a map of label keys and values which must all match.
+	MatchLabels map[string]string `yaml:"matchLabels"`
+	// MatchExpressions is a list of label selector requirements which must all match.
+	MatchExpressions []LabelSelectorRequirement `yaml:"matchExpressions"`
+}
+
+// LabelSelectorRequirement is a selector that contains values, a key, and an operator (In, NotIn, Exists or
+// DoesNotExist) that relates the key and values.
+type LabelSelectorRequirement struct {
+	Key      string   `yaml:"key"`
+	Operator string   `yaml:"operator"`
+	Values   []string `yaml:"values"`
+}
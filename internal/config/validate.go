@@ -0,0 +1,236 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// ValidationError is a semantic error in the configuration, at the line of the offending field if it's known.
+type ValidationError struct {
+	// Line of the field in the configuration file, or 0 if unknown.
+	Line int
+	// Field is the path of the field, e.g. rules[0].replace.
+	Field string
+	// Message describes the error.
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Field, e.Message)
+}
+
+// ValidationErrors are all the semantic errors in the configuration.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// fieldLines maps the paths of the fields of a YAML document, e.g. rules[0].replace, to their line.
+type fieldLines map[string]int
+
+func newFieldLines(data []byte) fieldLines {
+	lines := fieldLines{}
+	document := yamlv3.Node{}
+	if err := yamlv3.Unmarshal(data, &document); err != nil || len(document.Content) == 0 {
+		return lines
+	}
+	lines.walk("", document.Content[0])
+	return lines
+}
+
+func (l fieldLines) walk(path string, node *yamlv3.Node) {
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			l[key] = node.Content[i].Line
+			l.walk(key, node.Content[i+1])
+		}
+	case yamlv3.SequenceNode:
+		for i, item := range node.Content {
+			key := fmt.Sprintf("%s[%d]", path, i)
+			l[key] = item.Line
+			l.walk(key, item)
+		}
+	}
+}
+
+// line returns the line of the field, or of its closest parent in the document.
+func (l fieldLines) line(field string) int {
+	for field != "" {
+		if line, ok := l[field]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			break
+		}
+		field = field[:i]
+	}
+	return 0
+}
+
+// FieldError returns a validation error of the field, at its line in the configuration file.
+func (c *Configuration) FieldError(field, format string, args ...interface{}) ValidationError {
+	return ValidationError{Line: c.lines.line(field), Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+var platformPattern = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// validate checks the configuration for semantic errors, before the defaults are applied.
+func (c *Configuration) validate() error {
+	var errs ValidationErrors
+	for i, workload := range c.Workloads {
+		if _, ok := WorkloadGroups[workload]; !ok {
+			errs = append(errs, c.FieldError(fmt.Sprintf("workloads[%d]", i), "unsupported workload %q, must be one of deployments, statefulsets, daemonsets, jobs or cronjobs", workload))
+		}
+	}
+	if c.Mode != "" && c.Mode != ModeEnforce && c.Mode != ModeAudit {
+		errs = append(errs, c.FieldError("mode", "invalid mode %q, must be %q or %q", c.Mode, ModeEnforce, ModeAudit))
+	}
+	switch c.AdmissionWarnings {
+	case "", WarningsNone, WarningsDegraded, WarningsAll:
+	default:
+		errs = append(errs, c.FieldError("admissionWarnings", "invalid admission warnings %q, must be %q, %q or %q", c.AdmissionWarnings, WarningsNone, WarningsDegraded, WarningsAll))
+	}
+	if c.UpstreamCache.TTL < 0 || c.UpstreamCache.NegativeTTL < 0 || c.UpstreamCache.MaxEntries < 0 {
+		errs = append(errs, c.FieldError("upstreamCache", "durations and sizes must not be negative"))
+	}
+	probe := c.RegistryHealth.Probe
+	if c.RegistryHealth.Cooldown < 0 || probe.Interval < 0 || probe.Timeout < 0 || probe.FailureThreshold < 0 || probe.SuccessThreshold < 0 {
+		errs = append(errs, c.FieldError("registryHealth", "durations and thresholds must not be negative"))
+	}
+	if c.ProjectVerification.Interval < 0 || c.ProjectVerification.Timeout < 0 {
+		errs = append(errs, c.FieldError("projectVerification", "durations must not be negative"))
+	}
+	if c.ProjectVerification.CredentialsSecret != "" && len(c.ProjectVerification.Registries) == 0 {
+		errs = append(errs, c.FieldError("projectVerification.registries", "the registries the credentials are sent to must be set with a credentialsSecret"))
+	}
+	if c.Events.Window < 0 || c.Events.QPS < 0 || c.Events.Burst < 0 {
+		errs = append(errs, c.FieldError("events", "the window and rate limits must not be negative"))
+	}
+	if c.AuditLog.MaxSize < 0 || c.AuditLog.MaxBackups < 0 {
+		errs = append(errs, c.FieldError("auditLog", "the size and backups must not be negative"))
+	}
+
+	providers := make(map[string]bool, len(c.CredentialProviders))
+	for i, provider := range c.CredentialProviders {
+		field := fmt.Sprintf("credentialProviders[%d]", i)
+		if provider.Name == "" || provider.Command == "" {
+			errs = append(errs, c.FieldError(field, "credential providers must have a name and command"))
+		} else if providers[provider.Name] {
+			errs = append(errs, c.FieldError(field+".name", "duplicate credential provider name %q", provider.Name))
+		}
+		providers[provider.Name] = true
+	}
+
+	if len(c.Rules) == 0 && !c.EnableProxyRules && c.HarborDiscovery.URL == "" {
+		errs = append(errs, c.FieldError("rules", "no proxy rules configured, and neither enableProxyRules nor harborDiscovery is set"))
+	}
+	names := make(map[string]bool, len(c.Rules))
+	for i, rule := range c.Rules {
+		errs = append(errs, c.validateRule(fmt.Sprintf("rules[%d]", i), rule, names, providers)...)
+	}
+	errs = append(errs, c.validateHarborDiscovery(providers)...)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Configuration) validateHarborDiscovery(providers map[string]bool) ValidationErrors {
+	discovery := c.HarborDiscovery
+	if discovery.URL == "" {
+		return nil
+	}
+	var errs ValidationErrors
+	if u, err := url.Parse(discovery.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, c.FieldError("harborDiscovery.url", "invalid url %q, must be http(s)://host", discovery.URL))
+	} else if u.Scheme != "https" && discovery.CredentialsSecret != "" {
+		errs = append(errs, c.FieldError("harborDiscovery.url", "the url must be https with a credentialsSecret, credentials aren't sent over http"))
+	}
+	if discovery.Interval < 0 || discovery.Timeout < 0 {
+		errs = append(errs, c.FieldError("harborDiscovery", "durations must not be negative"))
+	}
+	for i, project := range discovery.Projects {
+		if _, err := regexp.Compile(project); err != nil {
+			errs = append(errs, c.FieldError(fmt.Sprintf("harborDiscovery.projects[%d]", i), "invalid regex: %s", err.Error()))
+		}
+	}
+	rule := discovery.Rule
+	if rule.Name != "" || len(rule.Matches) > 0 || rule.Replace != "" {
+		errs = append(errs, c.FieldError("harborDiscovery.rule", "the name, matches and replace of discovered rules are generated and must not be set"))
+	}
+	// validate the rest of the template as a rule of a discovered project
+	rule.Name = "discovered"
+	rule.Matches = []string{"^docker.io/"}
+	rule.Replace = "harbor.example.com/project"
+	return append(errs, c.validateRule("harborDiscovery.rule", rule, map[string]bool{}, providers)...)
+}
+
+func (c *Configuration) validateRule(field string, rule ProxyRule, names, providers map[string]bool) ValidationErrors {
+	var errs ValidationErrors
+	if rule.Name == "" {
+		errs = append(errs, c.FieldError(field+".name", "rules must have a name"))
+	} else if names[rule.Name] {
+		errs = append(errs, c.FieldError(field+".name", "duplicate rule name %q", rule.Name))
+	}
+	names[rule.Name] = true
+	if len(rule.Matches) == 0 {
+		errs = append(errs, c.FieldError(field+".matches", "rules must have at least one match"))
+	}
+	for i, match := range rule.Matches {
+		if _, err := regexp.Compile(match); err != nil {
+			errs = append(errs, c.FieldError(fmt.Sprintf("%s.matches[%d]", field, i), "invalid regex: %s", err.Error()))
+		}
+	}
+	for i, exclude := range rule.Excludes {
+		if _, err := regexp.Compile(exclude); err != nil {
+			errs = append(errs, c.FieldError(fmt.Sprintf("%s.excludes[%d]", field, i), "invalid regex: %s", err.Error()))
+		}
+	}
+	if strings.TrimSpace(rule.Replace) == "" {
+		errs = append(errs, c.FieldError(field+".replace", "rules must have a replace"))
+	}
+	for i, fallback := range rule.Fallbacks {
+		if fallback == FallbackOrigin && i != len(rule.Fallbacks)-1 {
+			errs = append(errs, c.FieldError(fmt.Sprintf("%s.fallbacks[%d]", field, i), "the %s fallback must be the last fallback", FallbackOrigin))
+		} else if strings.TrimSpace(fallback) == "" {
+			errs = append(errs, c.FieldError(fmt.Sprintf("%s.fallbacks[%d]", field, i), "fallbacks must not be empty"))
+		}
+	}
+	if rule.Mode != "" && rule.Mode != ModeEnforce && rule.Mode != ModeAudit {
+		errs = append(errs, c.FieldError(field+".mode", "invalid mode %q, must be %q or %q", rule.Mode, ModeEnforce, ModeAudit))
+	}
+	for i, platform := range rule.Platforms {
+		if !platformPattern.MatchString(platform) {
+			errs = append(errs, c.FieldError(fmt.Sprintf("%s.platforms[%d]", field, i), "invalid platform %q, must be os/arch or os/arch/variant, e.g. linux/amd64", platform))
+		}
+	}
+	if rule.Auth != nil {
+		switch rule.Auth.Provider {
+		case AuthProviderAnonymous, AuthProviderSecret, AuthProviderExec, AuthProviderECR, AuthProviderGCR, AuthProviderACR:
+		default:
+			errs = append(errs, c.FieldError(field+".auth.provider", "unknown auth provider %q", rule.Auth.Provider))
+		}
+		if rule.Auth.Provider == AuthProviderExec && !providers[rule.Auth.CredentialProvider] {
+			errs = append(errs, c.FieldError(field+".auth.credentialProvider", "rule %q references the unknown credential provider %q", rule.Name, rule.Auth.CredentialProvider))
+		}
+	}
+	return errs
+}
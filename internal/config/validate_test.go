@@ -0,0 +1,197 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfiguration(t *testing.T) {
+	conf, err := ParseConfiguration([]byte(`port: 9443
+upstreamCache:
+  ttl: 1m
+rules:
+  - name: 'docker.io rewrite rule'
+    matches:
+      - '^docker.io'
+    replace: 'harbor.example.com/dockerhub-proxy'
+    platforms:
+      - linux/arm64/v8
+`))
+	require.NoError(t, err)
+	require.Equal(t, 9443, conf.Port)
+	require.Equal(t, ModeEnforce, conf.Mode)
+	require.Equal(t, WarningsDegraded, conf.AdmissionWarnings)
+	require.Equal(t, 10*time.Minute, conf.Events.Window)
+	require.Equal(t, 100, conf.AuditLog.MaxSize)
+	require.Equal(t, time.Minute, conf.UpstreamCache.TTL)
+	require.Equal(t, 30*time.Second, conf.UpstreamCache.NegativeTTL)
+	require.Equal(t, ModeEnforce, conf.Rules[0].Mode)
+	require.Equal(t, []string{"linux/arm64/v8"}, conf.Rules[0].Platforms)
+}
+
+func TestParseConfiguration_HarborDiscovery(t *testing.T) {
+	conf, err := ParseConfiguration([]byte(`harborDiscovery:
+  url: https://harbor.example.com
+  rule:
+    checkUpstream: true
+`))
+	require.NoError(t, err, "discovered rules are enough")
+	require.Equal(t, 5*time.Minute, conf.HarborDiscovery.Interval)
+	require.Equal(t, 30*time.Second, conf.HarborDiscovery.Timeout)
+	require.True(t, conf.HarborDiscovery.Rule.CheckUpstream)
+	require.Equal(t, ModeEnforce, conf.HarborDiscovery.Rule.Mode)
+	require.Equal(t, []string{DefaultPlatform}, conf.HarborDiscovery.Rule.Platforms)
+}
+
+func TestParseConfiguration_Invalid(t *testing.T) {
+	type testcase struct {
+		name     string
+		config   string
+		expected []string
+	}
+	tests := []testcase{
+		{
+			name: "unknown field",
+			config: `rules:
+  - name: 'docker.io rewrite rule'
+    matchs:
+      - '^docker.io'
+`,
+			expected: []string{"line 3: field matchs not found"},
+		},
+		{
+			name: "duplicate key",
+			config: `mode: audit
+mode: enforce
+`,
+			expected: []string{"line 2: field mode already set"},
+		},
+		{
+			name:     "no rules",
+			config:   "port: 9443\n",
+			expected: []string{"rules: no proxy rules configured"},
+		},
+		{
+			name: "invalid admission warnings",
+			config: `enableProxyRules: true
+admissionWarnings: verbose
+`,
+			expected: []string{`line 2: admissionWarnings: invalid admission warnings "verbose", must be "none", "degraded" or "all"`},
+		},
+		{
+			name: "invalid rules",
+			config: `mode: dry-run
+rules:
+  - name: 'docker.io rewrite rule'
+    matches:
+      - '^docker.io('
+    replace: ''
+    platforms:
+      - linux
+  - name: 'docker.io rewrite rule'
+    matches: []
+    replace: 'harbor.example.com/dockerhub-proxy'
+    fallbacks:
+      - origin
+      - 'harbor.example.com/other-proxy'
+`,
+			expected: []string{
+				`line 1: mode: invalid mode "dry-run"`,
+				"line 5: rules[0].matches[0]: invalid regex",
+				"line 6: rules[0].replace: rules must have a replace",
+				`line 8: rules[0].platforms[0]: invalid platform "linux"`,
+				`line 9: rules[1].name: duplicate rule name "docker.io rewrite rule"`,
+				"line 10: rules[1].matches: rules must have at least one match",
+				"line 13: rules[1].fallbacks[0]: the origin fallback must be the last fallback",
+			},
+		},
+		{
+			name: "invalid platform variant",
+			config: `rules:
+  - name: 'docker.io rewrite rule'
+    matches:
+      - '^docker.io'
+    replace: 'harbor.example.com/dockerhub-proxy'
+    platforms:
+      - linux/arm/v7
+      - linux/arm/v7/v8
+`,
+			expected: []string{`line 8: rules[0].platforms[1]: invalid platform "linux/arm/v7/v8"`},
+		},
+		{
+			name: "unknown credential provider",
+			config: `credentialProviders:
+  - name: ecr
+    command: /usr/local/bin/ecr-credential-provider
+  - name: ecr
+    command: /usr/local/bin/ecr-credential-provider
+rules:
+  - name: 'ecr rewrite rule'
+    matches:
+      - '^public.ecr.aws'
+    replace: '123456789012.dkr.ecr.us-east-1.amazonaws.com/ecr-public'
+    auth:
+      provider: exec
+      credentialProvider: gcr
+`,
+			expected: []string{
+				`line 4: credentialProviders[1].name: duplicate credential provider name "ecr"`,
+				`line 13: rules[0].auth.credentialProvider: rule "ecr rewrite rule" references the unknown credential provider "gcr"`,
+			},
+		},
+		{
+			name: "harbor credentials",
+			config: `harborDiscovery:
+  url: http://harbor.example.com
+  credentialsSecret: harbor-discovery
+projectVerification:
+  enabled: true
+  credentialsSecret: harbor-verification
+`,
+			expected: []string{
+				"line 4: projectVerification.registries: the registries the credentials are sent to must be set with a credentialsSecret",
+				"line 2: harborDiscovery.url: the url must be https with a credentialsSecret, credentials aren't sent over http",
+			},
+		},
+		{
+			name: "unsupported workload",
+			config: `enableProxyRules: true
+workloads:
+  - deployments
+  - replicasets
+`,
+			expected: []string{`line 4: workloads[1]: unsupported workload "replicasets"`},
+		},
+		{
+			name: "invalid harbor discovery",
+			config: `harborDiscovery:
+  url: harbor.example.com
+  projects:
+    - '(proxy'
+  rule:
+    replace: harbor.example.com/dockerhub-proxy
+    mode: block
+`,
+			expected: []string{
+				`line 2: harborDiscovery.url: invalid url "harbor.example.com"`,
+				`line 4: harborDiscovery.projects[0]: invalid regex`,
+				`line 5: harborDiscovery.rule: the name, matches and replace of discovered rules are generated`,
+				`line 7: harborDiscovery.rule.mode: invalid mode "block"`,
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseConfiguration([]byte(tc.config))
+			require.Error(t, err)
+			for _, expected := range tc.expected {
+				require.ErrorContains(t, err, expected)
+			}
+			if errs, ok := err.(ValidationErrors); ok {
+				require.Len(t, errs, len(tc.expected))
+			}
+		})
+	}
+}
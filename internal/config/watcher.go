@@ -0,0 +1,152 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hcw",
+		Subsystem: "config",
+		Name:      "reloads",
+		Help:      "configuration reloads after the config file changed, by result",
+	}, []string{"result"})
+
+	watchLog = ctrl.Log.WithName("config-watcher")
+)
+
+func init() {
+	metrics.Registry.MustRegister(reloads)
+}
+
+// Watcher reloads the configuration whenever the config file changes. The parent directory is watched rather than
+// the file itself, as kubernetes updates mounted ConfigMaps by atomically swapping a symlink.
+type Watcher struct {
+	// Path to the config file.
+	Path string
+	// Loaded is the content of the config file the running configuration was parsed from. The file is reloaded
+	// once its content differs, including when it changed before the watcher started.
+	Loaded []byte
+	// OnChange is called with the reloaded configuration. If it returns an error, the reload is counted as failed
+	// and the caller is expected to keep using the previous configuration.
+	OnChange func(*Configuration) error
+	// Debounce is how long to wait for further file events before reloading. Defaults to one second.
+	Debounce time.Duration
+
+	last []byte
+}
+
+// Start watches the config file until the context is cancelled. It implements manager.Runnable.
+func (w *Watcher) Start(ctx context.Context) error {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config file watcher: %w", err)
+	}
+	defer fsWatcher.Close()
+	if err := fsWatcher.Add(filepath.Dir(w.Path)); err != nil {
+		return fmt.Errorf("failed to watch config file %q: %w", w.Path, err)
+	}
+	if w.last == nil {
+		w.last = w.Loaded
+	}
+	// apply the changes made since the configuration was loaded, which the watch didn't see
+	w.reload()
+	debounce := w.Debounce
+	if debounce == 0 {
+		debounce = time.Second
+	}
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-fsWatcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			timer.Reset(debounce)
+		case err, ok := <-fsWatcher.Errors:
+			if !ok {
+				return nil
+			}
+			watchLog.Error(err, "error watching config file", "path", w.Path)
+		case <-timer.C:
+			w.reload()
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica must reload its own configuration.
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
+
+func (w *Watcher) reload() {
+	data, err := os.ReadFile(w.Path)
+	if err != nil {
+		reloads.WithLabelValues("failure").Inc()
+		watchLog.Error(err, "failed to read config file, keeping the previous configuration", "path", w.Path)
+		return
+	}
+	if bytes.Equal(data, w.last) {
+		return
+	}
+
+	conf, err := LoadConfiguration(w.Path)
+	if err == nil {
+		err = w.OnChange(conf)
+	}
+	if err != nil {
+		reloads.WithLabelValues("failure").Inc()
+		watchLog.Error(err, "invalid configuration, keeping the previous configuration", "path", w.Path)
+		return
+	}
+	w.last = data
+	reloads.WithLabelValues("success").Inc()
+	watchLog.Info("reloaded configuration", "path", w.Path)
+}
+
+// reloadedSettings are the settings applied when the configuration is reloaded: the rules, and the mode which is the
+// default of the rules and ProxyRules. Every other setting is only applied at startup.
+var reloadedSettings = map[string]bool{
+	"rules": true,
+	"mode":  true,
+}
+
+// UnreloadedChanges returns the names of the settings which differ between the configurations, but aren't applied
+// when the configuration is reloaded.
+func UnreloadedChanges(previous, current *Configuration) []string {
+	var changed []string
+	previousValue, currentValue := reflect.ValueOf(*previous), reflect.ValueOf(*current)
+	for i := 0; i < previousValue.NumField(); i++ {
+		field := previousValue.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "" || name == "-" || reloadedSettings[name] {
+			continue
+		}
+		if !reflect.DeepEqual(previousValue.Field(i).Interface(), currentValue.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
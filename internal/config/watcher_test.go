@@ -0,0 +1,117 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const watcherTestConfig = `rules:
+  - name: 'docker.io rewrite rule'
+    matches:
+      - '^docker.io'
+    replace: '%s'
+`
+
+func TestWatcher_Reload(t *testing.T) {
+	dir := t.TempDir()
+	// mimic a mounted ConfigMap, whose files are symlinks into an atomically swapped ..data directory
+	writeConfigMap := func(version, replace string) {
+		versionDir := filepath.Join(dir, version)
+		require.NoError(t, os.Mkdir(versionDir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(versionDir, "config.yaml"), []byte(fmt.Sprintf(watcherTestConfig, replace)), 0o600))
+		tmpLink := filepath.Join(dir, "..data_tmp")
+		require.NoError(t, os.Symlink(version, tmpLink))
+		require.NoError(t, os.Rename(tmpLink, filepath.Join(dir, "..data")))
+	}
+	writeConfigMap("v1", "harbor.example.com/dockerhub-proxy")
+	require.NoError(t, os.Symlink(filepath.Join("..data", "config.yaml"), filepath.Join(dir, "config.yaml")))
+
+	reloaded := make(chan *Configuration, 10)
+	watcher := &Watcher{
+		Path:   filepath.Join(dir, "config.yaml"),
+		Loaded: []byte(fmt.Sprintf(watcherTestConfig, "harbor.example.com/dockerhub-proxy")),
+		OnChange: func(conf *Configuration) error {
+			if conf.Rules[0].Replace == "" {
+				return errors.New("empty replace")
+			}
+			reloaded <- conf
+			return nil
+		},
+		Debounce: 10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- watcher.Start(ctx)
+	}()
+
+	// give the watcher a moment to register before changing the file
+	time.Sleep(50 * time.Millisecond)
+	writeConfigMap("v2", "harbor.example.com/other-proxy")
+	select {
+	case conf := <-reloaded:
+		require.Equal(t, "harbor.example.com/other-proxy", conf.Rules[0].Replace)
+	case <-time.After(5 * time.Second):
+		t.Fatal("configuration was not reloaded")
+	}
+
+	writeConfigMap("v3", "")
+	select {
+	case <-reloaded:
+		t.Fatal("invalid configuration should not be applied")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestWatcher_ReloadChangedBeforeStart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(watcherTestConfig, "harbor.example.com/other-proxy")), 0o600))
+	reloaded := make(chan *Configuration, 10)
+	watcher := &Watcher{
+		Path:   path,
+		Loaded: []byte(fmt.Sprintf(watcherTestConfig, "harbor.example.com/dockerhub-proxy")),
+		OnChange: func(conf *Configuration) error {
+			reloaded <- conf
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- watcher.Start(ctx)
+	}()
+
+	select {
+	case conf := <-reloaded:
+		require.Equal(t, "harbor.example.com/other-proxy", conf.Rules[0].Replace, "the file changed since it was loaded")
+	case <-time.After(5 * time.Second):
+		t.Fatal("configuration was not reloaded")
+	}
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestUnreloadedChanges(t *testing.T) {
+	previous, err := ParseConfiguration([]byte(fmt.Sprintf(watcherTestConfig, "harbor.example.com/dockerhub-proxy")))
+	require.NoError(t, err)
+	current, err := ParseConfiguration([]byte(fmt.Sprintf(watcherTestConfig, "harbor.example.com/other-proxy") + `mode: audit
+verbose: true
+upstreamCache:
+  ttl: 1m
+`))
+	require.NoError(t, err)
+	// the mode is reloaded as the default of the rules and ProxyRules, but not of the discovered rules
+	require.Equal(t, []string{"verbose", "upstreamCache", "harborDiscovery"}, UnreloadedChanges(previous, current))
+	require.Empty(t, UnreloadedChanges(previous, previous))
+}
@@ -0,0 +1,263 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/api/v1alpha1"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/webhook"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// ProxyRuleReconciler compiles ProxyRule resources into the rules used by the webhook, and reports compile errors
+// in the Ready condition of each ProxyRule.
+type ProxyRuleReconciler struct {
+	Client client.Client
+	Rules  *webhook.RuleStore
+	// Namespace the webhook is running in, used for auth secrets which don't specify a namespace.
+	Namespace string
+	// DefaultMode is the mode of ProxyRules which don't specify one, changed by SetDefaultMode once started.
+	DefaultMode string
+
+	// requeue reconciles the ProxyRules sent to it, e.g. when the default mode changed.
+	requeue chan event.GenericEvent
+
+	mu sync.Mutex
+	// reconciled are the names of the ProxyRules reconciled since startup.
+	reconciled map[string]bool
+	// ready is set once every ProxyRule was reconciled, and stays set.
+	ready bool
+}
+
+// SetupWithManager registers the reconciler with the manager.
+func (r *ProxyRuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.requeue = make(chan event.GenericEvent)
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1alpha1.ProxyRule{}).
+		WatchesRawSource(source.Channel(r.requeue, &handler.EnqueueRequestForObject{})).
+		Complete(r)
+}
+
+// SetDefaultMode changes the mode of the ProxyRules which don't specify one, e.g. when the configuration is reloaded,
+// and requeues every ProxyRule so that their rules are updated.
+func (r *ProxyRuleReconciler) SetDefaultMode(ctx context.Context, mode string) error {
+	r.mu.Lock()
+	changed := r.DefaultMode != mode
+	r.DefaultMode = mode
+	r.mu.Unlock()
+	if !changed || r.requeue == nil {
+		return nil
+	}
+	proxyRules := &v1alpha1.ProxyRuleList{}
+	if err := r.Client.List(ctx, proxyRules); err != nil {
+		return fmt.Errorf("failed to list the ProxyRules: %w", err)
+	}
+	// the controller may still be starting, so the ProxyRules are requeued without blocking the caller
+	go func() {
+		for i := range proxyRules.Items {
+			r.requeue <- event.GenericEvent{Object: &proxyRules.Items[i]}
+		}
+	}()
+	return nil
+}
+
+func (r *ProxyRuleReconciler) defaultMode() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.DefaultMode
+}
+
+// Reconcile updates the webhook rules for the ProxyRule.
+func (r *ProxyRuleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	source := RuleSource(req.Name)
+
+	proxyRule := &v1alpha1.ProxyRule{}
+	if err := r.Client.Get(ctx, req.NamespacedName, proxyRule); err != nil {
+		if apierrors.IsNotFound(err) {
+			logger.Info("removing deleted proxy rule")
+			return ctrl.Result{}, r.Rules.Set(source, nil)
+		}
+		return ctrl.Result{}, err
+	}
+
+	rule := r.toConfig(proxyRule)
+	condition := metav1.Condition{
+		Type:               v1alpha1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             v1alpha1.ReasonCompiled,
+		Message:            "rule is used to rewrite images",
+		ObservedGeneration: proxyRule.Generation,
+	}
+	err := r.validate(proxyRule)
+	if err == nil {
+		err = webhook.ValidateRule(rule)
+	}
+	if err == nil {
+		// fails if another rule, e.g. of the config file, has the same name
+		err = r.Rules.Set(source, []config.ProxyRule{rule})
+	}
+	if err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = v1alpha1.ReasonInvalid
+		condition.Message = err.Error()
+		logger.Info("proxy rule is invalid", "error", err.Error())
+		if err := r.Rules.Set(source, nil); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update rules: %w", err)
+		}
+	}
+
+	r.markReconciled(req.Name)
+	return ctrl.Result{}, r.updateStatus(ctx, proxyRule, condition)
+}
+
+func (r *ProxyRuleReconciler) markReconciled(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reconciled == nil {
+		r.reconciled = make(map[string]bool)
+	}
+	r.reconciled[name] = true
+}
+
+// Check fails until the ProxyRule cache has synced and every ProxyRule in it was reconciled, so that pods aren't
+// admitted without the rules of the ProxyRules at startup. It implements healthz.Checker.
+func (r *ProxyRuleReconciler) Check(req *http.Request) error {
+	r.mu.Lock()
+	ready := r.ready
+	r.mu.Unlock()
+	if ready {
+		return nil
+	}
+
+	ctx := context.Background()
+	if req != nil {
+		ctx = req.Context()
+	}
+	proxyRules := &v1alpha1.ProxyRuleList{}
+	if err := r.Client.List(ctx, proxyRules); err != nil {
+		return fmt.Errorf("the ProxyRules haven't been loaded yet: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending := 0
+	for i := range proxyRules.Items {
+		if !r.reconciled[proxyRules.Items[i].Name] {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d ProxyRules haven't been reconciled yet", pending)
+	}
+	r.ready = true
+	return nil
+}
+
+func (r *ProxyRuleReconciler) updateStatus(ctx context.Context, proxyRule *v1alpha1.ProxyRule, condition metav1.Condition) error {
+	patch := client.MergeFrom(proxyRule.DeepCopy())
+	changed := apimeta.SetStatusCondition(&proxyRule.Status.Conditions, condition)
+	if !changed && proxyRule.Status.ObservedGeneration == proxyRule.Generation {
+		return nil
+	}
+	proxyRule.Status.ObservedGeneration = proxyRule.Generation
+	return r.Client.Status().Patch(ctx, proxyRule, patch)
+}
+
+// validate rejects the settings which only the rules of the webhook configuration may use, as they'd let any
+// ProxyRule author use the cloud credentials of the webhook, or the secrets of other namespaces.
+func (r *ProxyRuleReconciler) validate(proxyRule *v1alpha1.ProxyRule) error {
+	if auth := proxyRule.Spec.Auth; auth != nil {
+		switch auth.Provider {
+		case config.AuthProviderECR, config.AuthProviderGCR, config.AuthProviderACR:
+			return fmt.Errorf("auth provider %q can only be used by the rules of the webhook configuration", auth.Provider)
+		}
+	}
+	if ref := proxyRule.Spec.AuthSecretRef; ref != nil && ref.Namespace != "" && ref.Namespace != r.Namespace {
+		return fmt.Errorf("the authSecretRef must be in the namespace of the webhook %q", r.Namespace)
+	}
+	if ref := proxyRule.Spec.ImagePullSecretRef; ref != nil && ref.Namespace != "" && ref.Namespace != r.Namespace {
+		return fmt.Errorf("the imagePullSecretRef must be in the namespace of the webhook %q", r.Namespace)
+	}
+	return nil
+}
+
+func (r *ProxyRuleReconciler) toConfig(proxyRule *v1alpha1.ProxyRule) config.ProxyRule {
+	rule := config.ProxyRule{
+		Name:          proxyRule.Name,
+		Matches:       proxyRule.Spec.Matches,
+		Excludes:      proxyRule.Spec.Excludes,
+		Replace:       proxyRule.Spec.Replace,
+		Fallbacks:     proxyRule.Spec.Fallbacks,
+		SkipUnhealthy: proxyRule.Spec.SkipUnhealthy,
+		Mode:          proxyRule.Spec.Mode,
+		CheckUpstream: proxyRule.Spec.CheckUpstream,
+		Platforms:     proxyRule.Spec.Platforms,
+		PinDigest:     proxyRule.Spec.PinDigest,
+		Namespaces:    proxyRule.Spec.Namespaces,
+		Namespace:     r.Namespace,
+	}
+	if rewrite := proxyRule.Spec.RewritePath; rewrite != nil {
+		rule.RewritePath = &config.PathRewrite{
+			StripPrefix: rewrite.StripPrefix,
+			Regex:       rewrite.Regex,
+			Replacement: rewrite.Replacement,
+			AddPrefix:   rewrite.AddPrefix,
+		}
+	}
+	if selector := proxyRule.Spec.NamespaceSelector; selector != nil {
+		rule.NamespaceSelector = &config.LabelSelector{MatchLabels: selector.MatchLabels}
+		for _, expression := range selector.MatchExpressions {
+			rule.NamespaceSelector.MatchExpressions = append(rule.NamespaceSelector.MatchExpressions, config.LabelSelectorRequirement{
+				Key:      expression.Key,
+				Operator: string(expression.Operator),
+				Values:   expression.Values,
+			})
+		}
+	}
+	if rule.Mode == "" {
+		rule.Mode = r.defaultMode()
+	}
+	if len(rule.Platforms) == 0 {
+		rule.Platforms = []string{config.DefaultPlatform}
+	}
+	if auth := proxyRule.Spec.Auth; auth != nil {
+		rule.Auth = &config.UpstreamAuth{
+			Provider:           auth.Provider,
+			CredentialProvider: auth.CredentialProvider,
+			AnonymousFallback:  auth.AnonymousFallback,
+		}
+	}
+	if ref := proxyRule.Spec.AuthSecretRef; ref != nil {
+		rule.AuthSecretName = ref.Name
+		if ref.Namespace != "" {
+			rule.Namespace = ref.Namespace
+		}
+	}
+	if ref := proxyRule.Spec.ImagePullSecretRef; ref != nil {
+		rule.ImagePullSecret = ref.Name
+		rule.ImagePullSecretNamespace = ref.Namespace
+		if rule.ImagePullSecretNamespace == "" {
+			rule.ImagePullSecretNamespace = r.Namespace
+		}
+	}
+	return rule
+}
+
+// RuleSource is the RuleStore source name of a ProxyRule.
+func RuleSource(name string) string {
+	return "proxyrule/" + name
+}
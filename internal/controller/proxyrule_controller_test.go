@@ -0,0 +1,202 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/api/v1alpha1"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/webhook"
+
+	"github.com/stretchr/testify/require"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestProxyRuleReconciler_Reconcile(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+
+	valid := &v1alpha1.ProxyRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "dockerhub", Generation: 1},
+		Spec: v1alpha1.ProxyRuleSpec{
+			Matches:       []string{"^docker.io"},
+			Replace:       "harbor.example.com/dockerhub-proxy",
+			AuthSecretRef: &v1alpha1.SecretReference{Name: "harbor-pull-secret"},
+		},
+	}
+	invalid := &v1alpha1.ProxyRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "broken", Generation: 2},
+		Spec: v1alpha1.ProxyRuleSpec{
+			Matches: []string{"^quay.io/(unclosed"},
+			Replace: "harbor.example.com/quay-proxy",
+		},
+	}
+	kubeClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(valid, invalid).
+		WithStatusSubresource(&v1alpha1.ProxyRule{}).
+		Build()
+	store := &webhook.RuleStore{Proxier: &webhook.PodContainerProxier{}}
+	reconciler := &ProxyRuleReconciler{Client: kubeClient, Rules: store, Namespace: "hcw"}
+
+	reconcile := func(name string) {
+		_, err := reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: types.NamespacedName{Name: name}})
+		require.NoError(t, err)
+	}
+	readyCondition := func(name string) *metav1.Condition {
+		proxyRule := &v1alpha1.ProxyRule{}
+		require.NoError(t, kubeClient.Get(context.TODO(), types.NamespacedName{Name: name}, proxyRule))
+		return apimeta.FindStatusCondition(proxyRule.Status.Conditions, v1alpha1.ConditionReady)
+	}
+
+	require.ErrorContains(t, reconciler.Check(nil), "2 ProxyRules haven't been reconciled yet")
+	reconcile("dockerhub")
+	reconcile("broken")
+	require.NoError(t, reconciler.Check(nil), "ready once every ProxyRule was reconciled, including invalid ones")
+
+	condition := readyCondition("dockerhub")
+	require.NotNil(t, condition)
+	require.Equal(t, metav1.ConditionTrue, condition.Status)
+	require.Equal(t, int64(1), condition.ObservedGeneration)
+
+	condition = readyCondition("broken")
+	require.NotNil(t, condition)
+	require.Equal(t, metav1.ConditionFalse, condition.Status)
+	require.Equal(t, v1alpha1.ReasonInvalid, condition.Reason)
+	require.Contains(t, condition.Message, "failed to compile regex")
+
+	rules := store.Rules()
+	require.Len(t, rules, 1)
+	require.Equal(t, "dockerhub", rules[0].Name)
+	require.Equal(t, "hcw", rules[0].Namespace)
+	require.Equal(t, "harbor-pull-secret", rules[0].AuthSecretName)
+	require.Equal(t, []string{"linux/amd64"}, rules[0].Platforms)
+
+	require.NoError(t, kubeClient.Delete(context.TODO(), valid))
+	reconcile("dockerhub")
+	require.Empty(t, store.Rules())
+}
+
+func TestProxyRuleReconciler_ReconcileDuplicateName(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+
+	duplicate := &v1alpha1.ProxyRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "dockerhub", Generation: 1},
+		Spec: v1alpha1.ProxyRuleSpec{
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/other-proxy",
+		},
+	}
+	kubeClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(duplicate).
+		WithStatusSubresource(&v1alpha1.ProxyRule{}).
+		Build()
+	store := &webhook.RuleStore{Proxier: &webhook.PodContainerProxier{}}
+	require.NoError(t, store.Set(webhook.ConfigRuleSource, []config.ProxyRule{
+		{Name: "dockerhub", Matches: []string{"^docker.io"}, Replace: "harbor.example.com/dockerhub-proxy"},
+	}))
+	reconciler := &ProxyRuleReconciler{Client: kubeClient, Rules: store, Namespace: "hcw"}
+
+	_, err := reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "dockerhub"}})
+	require.NoError(t, err)
+
+	proxyRule := &v1alpha1.ProxyRule{}
+	require.NoError(t, kubeClient.Get(context.TODO(), types.NamespacedName{Name: "dockerhub"}, proxyRule))
+	condition := apimeta.FindStatusCondition(proxyRule.Status.Conditions, v1alpha1.ConditionReady)
+	require.NotNil(t, condition)
+	require.Equal(t, metav1.ConditionFalse, condition.Status)
+	require.Contains(t, condition.Message, `rule name "dockerhub" is already used by a rule of config`)
+
+	rules := store.Rules()
+	require.Len(t, rules, 1)
+	require.Equal(t, "harbor.example.com/dockerhub-proxy", rules[0].Replace, "the config rule is kept")
+}
+
+func TestProxyRuleReconciler_SetDefaultMode(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, v1alpha1.AddToScheme(scheme))
+
+	proxyRule := &v1alpha1.ProxyRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "dockerhub", Generation: 1},
+		Spec: v1alpha1.ProxyRuleSpec{
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/dockerhub-proxy",
+		},
+	}
+	kubeClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(proxyRule).
+		WithStatusSubresource(&v1alpha1.ProxyRule{}).
+		Build()
+	store := &webhook.RuleStore{Proxier: &webhook.PodContainerProxier{}}
+	reconciler := &ProxyRuleReconciler{Client: kubeClient, Rules: store, Namespace: "hcw", DefaultMode: config.ModeEnforce}
+	reconciler.requeue = make(chan event.GenericEvent)
+	reconcile := func() {
+		_, err := reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "dockerhub"}})
+		require.NoError(t, err)
+	}
+
+	reconcile()
+	require.Equal(t, config.ModeEnforce, store.Rules()[0].Mode)
+
+	require.NoError(t, reconciler.SetDefaultMode(context.TODO(), config.ModeAudit))
+	select {
+	case requeued := <-reconciler.requeue:
+		require.Equal(t, "dockerhub", requeued.Object.GetName())
+	case <-time.After(5 * time.Second):
+		t.Fatal("the ProxyRule was not requeued")
+	}
+	reconcile()
+	require.Equal(t, config.ModeAudit, store.Rules()[0].Mode, "ProxyRules without a mode use the reloaded default")
+}
+
+func TestProxyRuleReconciler_validate(t *testing.T) {
+	type testcase struct {
+		name        string
+		spec        v1alpha1.ProxyRuleSpec
+		expectedErr string
+	}
+	tests := []testcase{
+		{
+			name: "secrets in the webhook namespace",
+			spec: v1alpha1.ProxyRuleSpec{AuthSecretRef: &v1alpha1.SecretReference{Name: "harbor", Namespace: "hcw"}},
+		},
+		{
+			name:        "auth secrets in other namespaces",
+			spec:        v1alpha1.ProxyRuleSpec{AuthSecretRef: &v1alpha1.SecretReference{Name: "harbor", Namespace: "team-a"}},
+			expectedErr: `the authSecretRef must be in the namespace of the webhook "hcw"`,
+		},
+		{
+			name:        "image pull secrets in other namespaces",
+			spec:        v1alpha1.ProxyRuleSpec{ImagePullSecretRef: &v1alpha1.SecretReference{Name: "harbor", Namespace: "team-a"}},
+			expectedErr: `the imagePullSecretRef must be in the namespace of the webhook "hcw"`,
+		},
+		{
+			name:        "cloud auth providers",
+			spec:        v1alpha1.ProxyRuleSpec{Auth: &v1alpha1.UpstreamAuth{Provider: config.AuthProviderGCR}},
+			expectedErr: `auth provider "gcr" can only be used by the rules of the webhook configuration`,
+		},
+	}
+	reconciler := &ProxyRuleReconciler{Namespace: "hcw"}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := reconciler.validate(&v1alpha1.ProxyRule{Spec: tc.spec})
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
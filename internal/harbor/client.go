@@ -0,0 +1,179 @@
+package harbor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// pageSize is the number of items requested per page, the maximum of the Harbor API.
+const pageSize = 100
+
+// errNotFound is returned when Harbor reports the resource doesn't exist, as opposed to a 404 of another server.
+var errNotFound = errors.New("not found")
+
+// Project is a Harbor project, as returned by the /api/v2.0/projects endpoint.
+type Project struct {
+	ProjectID int64  `json:"project_id"`
+	Name      string `json:"name"`
+	// RegistryID is the id of the upstream registry of proxy cache projects, or 0 for regular projects.
+	RegistryID int64 `json:"registry_id"`
+}
+
+// Registry is a registry endpoint, as returned by the /api/v2.0/registries endpoint.
+type Registry struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// Type is the provider of the registry, e.g. docker-hub, docker-registry, harbor or quay.
+	Type string `json:"type"`
+	// URL of the registry, e.g. https://hub.docker.com or https://quay.io.
+	URL string `json:"url"`
+}
+
+// Client lists the projects and registries of a Harbor instance through its v2.0 API.
+type Client struct {
+	// URL of the Harbor instance, e.g. https://harbor.example.com.
+	URL  string
+	HTTP *http.Client
+	// Username and Password authenticate the requests with basic auth, if set, which requires an https URL.
+	Username string
+	Password string
+}
+
+// errorResponse is the body of the error responses of the Harbor API.
+type errorResponse struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// Projects returns every project visible to the user.
+func (c *Client) Projects(ctx context.Context) ([]Project, error) {
+	projects := []Project{}
+	err := c.list(ctx, "/api/v2.0/projects", func(decoder *json.Decoder) (int, error) {
+		page := []Project{}
+		if err := decoder.Decode(&page); err != nil {
+			return 0, err
+		}
+		projects = append(projects, page...)
+		return len(page), nil
+	})
+	return projects, err
+}
+
+// Registries returns every registry endpoint, which requires a user allowed to read the registries.
+func (c *Client) Registries(ctx context.Context) ([]Registry, error) {
+	registries := []Registry{}
+	err := c.list(ctx, "/api/v2.0/registries", func(decoder *json.Decoder) (int, error) {
+		page := []Registry{}
+		if err := decoder.Decode(&page); err != nil {
+			return 0, err
+		}
+		registries = append(registries, page...)
+		return len(page), nil
+	})
+	return registries, err
+}
+
+// Project returns the project by name, and false if Harbor reports it doesn't exist.
+func (c *Client) Project(ctx context.Context, name string) (Project, bool, error) {
+	project := Project{}
+	err := c.get(ctx, "/api/v2.0/projects/"+url.PathEscape(name), &project)
+	if errors.Is(err, errNotFound) {
+		return Project{}, false, nil
+	}
+	return project, err == nil, err
+}
+
+// Registry returns the registry endpoint by id, which requires a user allowed to read the registries.
+func (c *Client) Registry(ctx context.Context, id int64) (Registry, error) {
+	registry := Registry{}
+	err := c.get(ctx, "/api/v2.0/registries/"+strconv.FormatInt(id, 10), &registry)
+	return registry, err
+}
+
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	req, err := c.newRequest(ctx, path, nil)
+	if err != nil {
+		return err
+	}
+	// names are looked up as is, even if they're numeric
+	req.Header.Set("X-Is-Resource-Name", "true")
+	_, err = c.do(req, func(decoder *json.Decoder) (int, error) {
+		return 1, decoder.Decode(v)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Client) newRequest(ctx context.Context, path string, query url.Values) (*http.Request, error) {
+	endpoint := strings.TrimSuffix(c.URL, "/") + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Username != "" {
+		if req.URL.Scheme != "https" {
+			return nil, fmt.Errorf("refusing to send the credentials to %s over %s", req.URL.Host, req.URL.Scheme)
+		}
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	return req, nil
+}
+
+// list requests every page of the endpoint, until a page isn't full.
+func (c *Client) list(ctx context.Context, path string, decode func(*json.Decoder) (int, error)) error {
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("page", strconv.Itoa(page))
+		query.Set("page_size", strconv.Itoa(pageSize))
+		req, err := c.newRequest(ctx, path, query)
+		if err != nil {
+			return err
+		}
+		count, err := c.do(req, decode)
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", path, err)
+		}
+		if count < pageSize {
+			return nil
+		}
+	}
+}
+
+func (c *Client) do(req *http.Request, decode func(*json.Decoder) (int, error)) (int, error) {
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		errs := errorResponse{}
+		if json.Unmarshal(body, &errs) == nil && len(errs.Errors) > 0 {
+			if resp.StatusCode == http.StatusNotFound && errs.Errors[0].Code == "NOT_FOUND" {
+				return 0, errNotFound
+			}
+			return 0, fmt.Errorf("unexpected status %s: %s", resp.Status, errs.Errors[0].Message)
+		}
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return decode(json.NewDecoder(resp.Body))
+}
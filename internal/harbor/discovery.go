@@ -0,0 +1,229 @@
+package harbor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/webhook"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// RuleSource is the RuleStore source name of the discovered rules. They're evaluated after the rules of the
+// configuration file, and before the rules of ProxyRule resources.
+const RuleSource = "harbor"
+
+// dockerHubHosts are the hosts of docker hub registry endpoints, whose images are referenced as docker.io.
+var dockerHubHosts = map[string]bool{
+	"docker.io":            true,
+	"hub.docker.com":       true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+var (
+	logger = ctrl.Log.WithName("harbor")
+
+	discoveredRules = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "hcw",
+		Subsystem: "harbor_discovery",
+		Name:      "rules",
+		Help:      "rules generated from the proxy cache projects of the harbor instance",
+	})
+	discoveryErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "hcw",
+		Subsystem: "harbor_discovery",
+		Name:      "errors",
+		Help:      "discoveries of the proxy cache projects of the harbor instance which failed, keeping the previous rules",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(discoveredRules, discoveryErrors)
+}
+
+// Discovery periodically lists the proxy cache projects of a Harbor instance, and replaces the discovered rules of
+// the RuleStore with a rule for each project. If a discovery fails, the previous rules are kept.
+type Discovery struct {
+	// Client reads the credentials secret.
+	Client client.Client
+	Rules  *webhook.RuleStore
+	// Namespace of the credentials secret, the namespace the webhook is running in.
+	Namespace string
+
+	conf       config.HarborDiscoveryConfig
+	harbor     *Client
+	projects   []*regexp.Regexp
+	discovered []config.ProxyRule
+}
+
+// NewDiscovery creates a discovery from the configuration.
+func NewDiscovery(conf config.HarborDiscoveryConfig, namespace string, c client.Client, rules *webhook.RuleStore) (*Discovery, error) {
+	discovery := &Discovery{
+		Client:    c,
+		Rules:     rules,
+		Namespace: namespace,
+		conf:      conf,
+		harbor:    &Client{URL: conf.URL, HTTP: &http.Client{Timeout: conf.Timeout}},
+	}
+	for _, project := range conf.Projects {
+		matcher, err := regexp.Compile(project)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile project regex %q: %w", project, err)
+		}
+		discovery.projects = append(discovery.projects, matcher)
+	}
+	return discovery, nil
+}
+
+// Start discovers the projects every interval until the context is cancelled. It implements manager.Runnable.
+func (d *Discovery) Start(ctx context.Context) error {
+	ticker := time.NewTicker(d.conf.Interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Sync(ctx); err != nil {
+			logger.Info(fmt.Sprintf("failed to discover the proxy cache projects of %s, keeping the previous rules: %s", d.conf.URL, err.Error()))
+			discoveryErrors.Inc()
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica discovers the rules itself.
+func (d *Discovery) NeedLeaderElection() bool {
+	return false
+}
+
+// Sync discovers the proxy cache projects and replaces the discovered rules.
+func (d *Discovery) Sync(ctx context.Context) error {
+	if d.conf.CredentialsSecret != "" {
+		username, password, err := readCredentials(ctx, d.Client, types.NamespacedName{Namespace: d.Namespace, Name: d.conf.CredentialsSecret})
+		if err != nil {
+			return err
+		}
+		d.harbor.Username, d.harbor.Password = username, password
+	}
+	projects, err := d.harbor.Projects(ctx)
+	if err != nil {
+		return err
+	}
+	registries, err := d.harbor.Registries(ctx)
+	if err != nil {
+		return err
+	}
+	rules, err := d.generateRules(projects, registries)
+	if err != nil {
+		return err
+	}
+	if err := d.Rules.Set(RuleSource, rules); err != nil {
+		return fmt.Errorf("failed to update rules: %w", err)
+	}
+	discoveredRules.Set(float64(len(rules)))
+	if !reflect.DeepEqual(rules, d.discovered) {
+		logger.Info(fmt.Sprintf("discovered %d proxy cache projects in %s", len(rules), d.conf.URL))
+	}
+	d.discovered = rules
+	return nil
+}
+
+// readCredentials returns the username and password of the Harbor credentials secret. It's read before every request
+// of the API, so rotated credentials are used without a restart.
+func readCredentials(ctx context.Context, c client.Client, key types.NamespacedName) (string, string, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, key, secret); err != nil {
+		return "", "", fmt.Errorf("failed to get the harbor credentials secret %s: %w", key, err)
+	}
+	username, password := secret.Data[corev1.BasicAuthUsernameKey], secret.Data[corev1.BasicAuthPasswordKey]
+	if len(username) == 0 || len(password) == 0 {
+		return "", "", fmt.Errorf("the harbor credentials secret %s must have a %s and %s", key, corev1.BasicAuthUsernameKey, corev1.BasicAuthPasswordKey)
+	}
+	return string(username), string(password), nil
+}
+
+// generateRules returns a rule for each proxy cache project, ordered by project name, from the rule template.
+func (d *Discovery) generateRules(projects []Project, registries []Registry) ([]config.ProxyRule, error) {
+	registry := d.conf.Registry
+	if registry == "" {
+		u, err := url.Parse(d.conf.URL)
+		if err != nil {
+			return nil, err
+		}
+		registry = u.Host
+	}
+	byID := make(map[int64]Registry, len(registries))
+	for _, upstream := range registries {
+		byID[upstream.ID] = upstream
+	}
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].Name < projects[j].Name
+	})
+
+	rules := []config.ProxyRule{}
+	for _, project := range projects {
+		if project.RegistryID == 0 || !d.includes(project.Name) {
+			continue
+		}
+		upstream, ok := byID[project.RegistryID]
+		if !ok {
+			logger.Info(fmt.Sprintf("skipping proxy cache project %q, its registry %d doesn't exist", project.Name, project.RegistryID))
+			continue
+		}
+		host, err := upstreamHost(upstream)
+		if err != nil {
+			logger.Info(fmt.Sprintf("skipping proxy cache project %q: %s", project.Name, err.Error()))
+			continue
+		}
+		rule := d.conf.Rule
+		rule.Name = "harbor/" + project.Name
+		rule.Matches = []string{"^" + regexp.QuoteMeta(host) + "/"}
+		rule.Replace = registry + "/" + project.Name
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// includes returns if the project is included by the project regexes, or if there are none.
+func (d *Discovery) includes(project string) bool {
+	if len(d.projects) == 0 {
+		return true
+	}
+	for _, matcher := range d.projects {
+		if matcher.MatchString(project) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamHost returns the host that images of the registry are referenced by, e.g. docker.io for docker hub.
+func upstreamHost(registry Registry) (string, error) {
+	if registry.Type == "docker-hub" {
+		return "docker.io", nil
+	}
+	u, err := url.Parse(registry.URL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid url %q of registry %q", registry.URL, registry.Name)
+	}
+	if dockerHubHosts[u.Host] {
+		return "docker.io", nil
+	}
+	return u.Host, nil
+}
@@ -0,0 +1,242 @@
+package harbor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/webhook"
+
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeHarbor serves the projects and registries endpoints of the Harbor v2.0 API, paginated like Harbor.
+type fakeHarbor struct {
+	mu         sync.Mutex
+	projects   []Project
+	registries []Registry
+	// failing returns an internal server error for every request
+	failing bool
+	// anonymous serves unauthenticated requests, and rejects the requests with credentials
+	anonymous bool
+}
+
+func (f *fakeHarbor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if _, _, ok := r.BasicAuth(); ok && f.anonymous {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"errors":[{"code":"BAD_REQUEST","message":"unexpected credentials"}]}`))
+		return
+	}
+	if username, password, ok := r.BasicAuth(); !f.anonymous && (!ok || username != "robot$discovery" || password != "secret") {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"unauthorized"}]}`))
+		return
+	}
+	if f.failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if project, ok := strings.CutPrefix(r.URL.Path, "/api/v2.0/projects/"); ok {
+		for _, p := range f.projects {
+			if p.Name == project {
+				_ = json.NewEncoder(w).Encode(p)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[{"code":"NOT_FOUND","message":"project not found"}]}`))
+		return
+	}
+	if id, ok := strings.CutPrefix(r.URL.Path, "/api/v2.0/registries/"); ok {
+		for _, registry := range f.registries {
+			if strconv.FormatInt(registry.ID, 10) == id {
+				_ = json.NewEncoder(w).Encode(registry)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"errors":[{"code":"NOT_FOUND","message":"registry not found"}]}`))
+		return
+	}
+	var items []interface{}
+	switch r.URL.Path {
+	case "/api/v2.0/projects":
+		for _, project := range f.projects {
+			items = append(items, project)
+		}
+	case "/api/v2.0/registries":
+		for _, registry := range f.registries {
+			items = append(items, registry)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	size, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	start := min((page-1)*size, len(items))
+	end := min(start+size, len(items))
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(items)))
+	_ = json.NewEncoder(w).Encode(append([]interface{}{}, items[start:end]...))
+}
+
+func newDiscovery(t *testing.T, server *httptest.Server, conf config.HarborDiscoveryConfig) (*Discovery, *webhook.OfflineRewriter) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "harbor-api", Namespace: "webhook"},
+		Type:       corev1.SecretTypeBasicAuth,
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte("robot$discovery"),
+			corev1.BasicAuthPasswordKey: []byte("secret"),
+		},
+	}).Build()
+
+	proxier := &webhook.PodContainerProxier{}
+	rules := &webhook.RuleStore{Proxier: proxier}
+	require.NoError(t, rules.Set(webhook.ConfigRuleSource, []config.ProxyRule{
+		{Name: "static", Matches: []string{"^quay.io/"}, Replace: "harbor.example.com/static-quay"},
+	}))
+	conf.URL = server.URL
+	conf.CredentialsSecret = "harbor-api"
+	discovery, err := NewDiscovery(conf, "webhook", kubeClient, rules)
+	require.NoError(t, err)
+	discovery.harbor.HTTP = server.Client()
+	return discovery, &webhook.OfflineRewriter{Proxier: proxier}
+}
+
+func TestDiscovery_Sync(t *testing.T) {
+	harbor := &fakeHarbor{
+		registries: []Registry{
+			{ID: 1, Name: "docker hub", Type: "docker-hub", URL: "https://hub.docker.com"},
+			{ID: 2, Name: "quay", Type: "quay", URL: "https://quay.io"},
+			{ID: 3, Name: "ghcr", Type: "github-ghcr", URL: "https://ghcr.io"},
+		},
+	}
+	// more projects than fit on a page
+	for i := 0; i < 150; i++ {
+		harbor.projects = append(harbor.projects, Project{ProjectID: int64(i + 10), Name: fmt.Sprintf("team-%03d", i)})
+	}
+	harbor.projects = append(harbor.projects,
+		Project{ProjectID: 1, Name: "dockerhub-proxy", RegistryID: 1},
+		Project{ProjectID: 2, Name: "quay-proxy", RegistryID: 2},
+		Project{ProjectID: 3, Name: "ghcr-proxy", RegistryID: 3},
+		Project{ProjectID: 4, Name: "deleted-registry-proxy", RegistryID: 4},
+	)
+	server := httptest.NewTLSServer(harbor)
+	defer server.Close()
+
+	discovery, rewriter := newDiscovery(t, server, config.HarborDiscoveryConfig{
+		Registry: "harbor.example.com",
+		Projects: []string{"-proxy$"},
+		Rule:     config.ProxyRule{Mode: config.ModeEnforce, Platforms: []string{config.DefaultPlatform}},
+	})
+	require.NoError(t, discovery.Sync(context.TODO()))
+
+	names := []string{}
+	for _, rule := range discovery.Rules.Rules() {
+		names = append(names, rule.Name)
+	}
+	require.Equal(t, []string{"static", "harbor/dockerhub-proxy", "harbor/ghcr-proxy", "harbor/quay-proxy"}, names)
+
+	type testcase struct {
+		image    string
+		expected string
+	}
+	tests := []testcase{
+		{image: "nginx:1.27", expected: "harbor.example.com/dockerhub-proxy/library/nginx:1.27"},
+		{image: "ghcr.io/org/app:v1", expected: "harbor.example.com/ghcr-proxy/org/app:v1"},
+		{image: "quay.io/prometheus/prometheus:v3.0.0", expected: "harbor.example.com/static-quay/prometheus/prometheus:v3.0.0"},
+		{image: "registry.k8s.io/pause:3.10", expected: "registry.k8s.io/pause:3.10"},
+	}
+	for _, tc := range tests {
+		rewrite, err := rewriter.RewriteImage(context.TODO(), tc.image)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, rewrite.Rewritten, "static rules are evaluated first")
+	}
+
+	// a failed discovery keeps the previous rules
+	harbor.mu.Lock()
+	harbor.failing = true
+	harbor.mu.Unlock()
+	require.Error(t, discovery.Sync(context.TODO()))
+	require.Len(t, discovery.Rules.Rules(), 4)
+
+	// deleted projects are removed
+	harbor.mu.Lock()
+	harbor.failing = false
+	harbor.projects = harbor.projects[:len(harbor.projects)-3]
+	harbor.mu.Unlock()
+	require.NoError(t, discovery.Sync(context.TODO()))
+	require.Len(t, discovery.Rules.Rules(), 2)
+	rewrite, err := rewriter.RewriteImage(context.TODO(), "ghcr.io/org/app:v1")
+	require.NoError(t, err)
+	require.Equal(t, "ghcr.io/org/app:v1", rewrite.Rewritten)
+}
+
+func TestDiscovery_SyncUnauthorized(t *testing.T) {
+	server := httptest.NewTLSServer(&fakeHarbor{})
+	defer server.Close()
+
+	discovery, _ := newDiscovery(t, server, config.HarborDiscoveryConfig{})
+	discovery.conf.CredentialsSecret = ""
+	err := discovery.Sync(context.TODO())
+	require.ErrorContains(t, err, "401 Unauthorized: unauthorized")
+
+	discovery.conf.CredentialsSecret = "missing"
+	require.Error(t, discovery.Sync(context.TODO()))
+	require.Len(t, discovery.Rules.Rules(), 1)
+}
+
+func TestDiscovery_SyncInsecure(t *testing.T) {
+	server := httptest.NewServer(&fakeHarbor{})
+	defer server.Close()
+
+	discovery, _ := newDiscovery(t, server, config.HarborDiscoveryConfig{})
+	err := discovery.Sync(context.TODO())
+	require.ErrorContains(t, err, "refusing to send the credentials to "+strings.TrimPrefix(server.URL, "http://")+" over http")
+	require.Len(t, discovery.Rules.Rules(), 1)
+}
+
+func TestUpstreamHost(t *testing.T) {
+	type testcase struct {
+		registry Registry
+		expected string
+		err      bool
+	}
+	tests := []testcase{
+		{registry: Registry{Type: "docker-hub", URL: "https://hub.docker.com"}, expected: "docker.io"},
+		{registry: Registry{Type: "docker-registry", URL: "https://registry-1.docker.io"}, expected: "docker.io"},
+		{registry: Registry{Type: "docker-registry", URL: "https://registry.k8s.io"}, expected: "registry.k8s.io"},
+		{registry: Registry{Type: "harbor", URL: "https://harbor.eu.example.com:8443/"}, expected: "harbor.eu.example.com:8443"},
+		{registry: Registry{Type: "docker-registry", URL: "registry.k8s.io"}, err: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.registry.URL, func(t *testing.T) {
+			host, err := upstreamHost(tc.registry)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, host)
+		})
+	}
+}
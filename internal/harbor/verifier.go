@@ -0,0 +1,248 @@
+package harbor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/webhook"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var verificationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "hcw",
+	Subsystem: "harbor_verification",
+	Name:      "errors",
+	Help:      "verifications of the replacements of the rules which failed to query the harbor API, keeping the previous state of the rules",
+})
+
+func init() {
+	metrics.Registry.MustRegister(verificationErrors)
+}
+
+// Verifier verifies that the replacements of the rules of the RuleStore are Harbor proxy cache projects of a registry
+// which their matches mention, and disables the rules whose replacements aren't, so that a typo in a project name
+// doesn't rewrite images to a path which doesn't exist. Replacements whose project can't be told, such as templates
+// computing the project, are not verified. If the API of a registry fails, the rules keep their previous state.
+type Verifier struct {
+	// Client reads the credentials secret.
+	Client client.Client
+	Rules  *webhook.RuleStore
+	// Namespace of the credentials secret, the namespace the webhook is running in.
+	Namespace string
+
+	conf config.ProjectVerificationConfig
+	http *http.Client
+
+	mu       sync.Mutex
+	verified bool
+	// disabled maps the names of the disabled rules to the reason.
+	disabled map[string]string
+}
+
+// projectResult is the verification of a project, cached for the duration of a single verification.
+type projectResult struct {
+	// upstream is the host of the registry the project proxies.
+	upstream string
+	// invalid is the reason the project can't be a replacement.
+	invalid string
+	err     error
+}
+
+// NewVerifier creates a verifier from the configuration.
+func NewVerifier(conf config.ProjectVerificationConfig, namespace string, c client.Client, rules *webhook.RuleStore) *Verifier {
+	return &Verifier{
+		Client:    c,
+		Rules:     rules,
+		Namespace: namespace,
+		conf:      conf,
+		http:      &http.Client{Timeout: conf.Timeout},
+		disabled:  map[string]string{},
+	}
+}
+
+// Start verifies the rules at startup and every interval until the context is cancelled. It implements
+// manager.Runnable.
+func (v *Verifier) Start(ctx context.Context) error {
+	ticker := time.NewTicker(v.conf.Interval)
+	defer ticker.Stop()
+	for {
+		if err := v.Verify(ctx); err != nil {
+			logger.Info(fmt.Sprintf("failed to verify the replacements of the rules: %s", err.Error()))
+			verificationErrors.Inc()
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica verifies its rules itself.
+func (v *Verifier) NeedLeaderElection() bool {
+	return false
+}
+
+// Check fails while any rule is disabled, or before the first verification completed. It implements
+// healthz.Checker.
+func (v *Verifier) Check(_ *http.Request) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.verified {
+		return errors.New("the replacements of the rules haven't been verified yet")
+	}
+	if len(v.disabled) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(v.disabled))
+	for name := range v.disabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("rules %s are disabled, their replacements aren't harbor proxy cache projects", strings.Join(names, ", "))
+}
+
+// Verify verifies the replacements of every rule, and replaces the disabled rules of the RuleStore. Rules whose
+// replacements couldn't be verified keep their previous state, and the errors are returned.
+func (v *Verifier) Verify(ctx context.Context) error {
+	var username, password string
+	if v.conf.CredentialsSecret != "" {
+		var err error
+		username, password, err = readCredentials(ctx, v.Client, types.NamespacedName{Namespace: v.Namespace, Name: v.conf.CredentialsSecret})
+		if err != nil {
+			return err
+		}
+	}
+	v.mu.Lock()
+	previous := v.disabled
+	v.mu.Unlock()
+
+	results := map[string]projectResult{}
+	disabled := map[string]string{}
+	var errs []error
+	for _, rule := range v.Rules.Rules() {
+		for _, replace := range append([]string{rule.Replace}, rule.Fallbacks...) {
+			host, project, ok := replacementProject(replace)
+			if !ok {
+				continue
+			}
+			key := host + "/" + project
+			result, ok := results[key]
+			if !ok {
+				result = v.verifyProject(ctx, host, project, username, password)
+				results[key] = result
+			}
+			if result.err != nil {
+				errs = append(errs, fmt.Errorf("rule %q: %w", rule.Name, result.err))
+				if reason, ok := previous[rule.Name]; ok {
+					disabled[rule.Name] = reason
+				}
+				break
+			}
+			if result.invalid == "" && !mentions(rule.Matches, result.upstream) {
+				result.invalid = fmt.Sprintf("project %s proxies %s, which none of the matches of the rule mention", key, result.upstream)
+			}
+			if result.invalid != "" {
+				disabled[rule.Name] = result.invalid
+				break
+			}
+		}
+	}
+
+	names := make(map[string]bool, len(disabled))
+	for name, reason := range disabled {
+		names[name] = true
+		if _, ok := previous[name]; !ok {
+			logger.Info(fmt.Sprintf("disabling rule %q: %s", name, reason))
+		}
+	}
+	if err := v.Rules.SetDisabled(names); err != nil {
+		return fmt.Errorf("failed to disable rules: %w", err)
+	}
+	v.mu.Lock()
+	v.disabled = disabled
+	v.verified = true
+	v.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// verifyProject looks up the project and its registry in the Harbor API of the host. The credentials are only sent to
+// the configured registries, over https, and the API of other hosts is queried anonymously.
+func (v *Verifier) verifyProject(ctx context.Context, host, project, username, password string) projectResult {
+	registry, err := name.NewRegistry(host)
+	if err != nil {
+		return projectResult{err: err}
+	}
+	harbor := &Client{
+		URL:  fmt.Sprintf("%s://%s", registry.Scheme(), registry.RegistryStr()),
+		HTTP: v.http,
+	}
+	if username != "" && slices.Contains(v.conf.Registries, host) {
+		harbor.URL = "https://" + registry.RegistryStr()
+		harbor.Username, harbor.Password = username, password
+	}
+	found, ok, err := harbor.Project(ctx, project)
+	if err != nil {
+		return projectResult{err: fmt.Errorf("failed to verify project %s/%s: %w", host, project, err)}
+	}
+	if !ok {
+		return projectResult{invalid: fmt.Sprintf("project %s/%s doesn't exist", host, project)}
+	}
+	if found.RegistryID == 0 {
+		return projectResult{invalid: fmt.Sprintf("project %s/%s isn't a proxy cache", host, project)}
+	}
+	upstream, err := harbor.Registry(ctx, found.RegistryID)
+	if err != nil {
+		return projectResult{err: fmt.Errorf("failed to verify project %s/%s: %w", host, project, err)}
+	}
+	upstreamRegistry, err := upstreamHost(upstream)
+	if err != nil {
+		return projectResult{err: fmt.Errorf("failed to verify project %s/%s: %w", host, project, err)}
+	}
+	return projectResult{upstream: upstreamRegistry}
+}
+
+// replacementProject returns the registry host and project of a replace or fallback, if they can be told without an
+// image. Templates are only verified if their host and project are literal, e.g. harbor.example.com/proxy/${repository}.
+func replacementProject(replace string) (string, string, bool) {
+	if replace == config.FallbackOrigin {
+		return "", "", false
+	}
+	segments := strings.Split(strings.TrimSuffix(replace, "/"), "/")
+	if i := strings.Index(replace, "$"); i >= 0 {
+		// the last segment of the literal prefix is incomplete
+		segments = strings.Split(replace[:i], "/")
+		segments = segments[:len(segments)-1]
+	}
+	if len(segments) < 2 || segments[0] == "" || segments[1] == "" {
+		return "", "", false
+	}
+	return segments[0], segments[1], true
+}
+
+// mentions returns if any of the match regexes mentions the host, ignoring escapes, e.g. ^docker\.io/ mentions
+// docker.io.
+func mentions(matches []string, host string) bool {
+	for _, match := range matches {
+		if strings.Contains(strings.ReplaceAll(match, `\`, ""), host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package harbor
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/webhook"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifier_Verify(t *testing.T) {
+	harbor := &fakeHarbor{
+		registries: []Registry{
+			{ID: 1, Name: "docker hub", Type: "docker-hub", URL: "https://hub.docker.com"},
+			{ID: 2, Name: "quay", Type: "quay", URL: "https://quay.io"},
+		},
+		projects: []Project{
+			{ProjectID: 1, Name: "dockerhub-proxy", RegistryID: 1},
+			{ProjectID: 2, Name: "quay-proxy", RegistryID: 2},
+			{ProjectID: 3, Name: "library"},
+		},
+	}
+	server := httptest.NewTLSServer(harbor)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	host := u.Host
+	// another harbor, which must not receive the credentials
+	anonymous := httptest.NewServer(&fakeHarbor{
+		anonymous:  true,
+		registries: []Registry{{ID: 1, Name: "ghcr", Type: "github-ghcr", URL: "https://ghcr.io"}},
+		projects:   []Project{{ProjectID: 1, Name: "ghcr-proxy", RegistryID: 1}},
+	})
+	defer anonymous.Close()
+	anonymousHost := strings.TrimPrefix(anonymous.URL, "http://")
+
+	discovery, rewriter := newDiscovery(t, server, config.HarborDiscoveryConfig{})
+	rules := discovery.Rules
+	require.NoError(t, rules.Set(webhook.ConfigRuleSource, []config.ProxyRule{
+		{Name: "dockerhub", Matches: []string{`^docker\.io/`}, Replace: host + "/dockerhub-proxy"},
+		{Name: "typo", Matches: []string{"^docker.io/"}, Replace: host + "/dockerhub-proxi"},
+		{Name: "not a proxy cache", Matches: []string{"^docker.io/"}, Replace: host + "/library"},
+		{Name: "wrong upstream", Matches: []string{"^docker.io/"}, Replace: host + "/quay-proxy"},
+		{Name: "bad fallback", Matches: []string{"^quay.io/"}, Replace: host + "/quay-proxy", Fallbacks: []string{host + "/missing", config.FallbackOrigin}},
+		{Name: "template", Matches: []string{"^quay.io/"}, Replace: host + "/quay-proxy/${repository}:${tag}"},
+		{Name: "template project", Matches: []string{"^(.+)$"}, Replace: host + "/${1}"},
+		{Name: "catch all", Matches: []string{"^quay.io/"}, Replace: host + "/quay-proxy"},
+		{Name: "other harbor", Matches: []string{"^ghcr.io/"}, Replace: anonymousHost + "/ghcr-proxy"},
+	}))
+	verifier := NewVerifier(config.ProjectVerificationConfig{CredentialsSecret: "harbor-api", Registries: []string{host}}, "webhook", discovery.Client, rules)
+	verifier.http = server.Client()
+	require.Error(t, verifier.Check(nil), "not ready before the first verification")
+
+	require.NoError(t, verifier.Verify(context.TODO()))
+	require.Equal(t, map[string]string{
+		"typo":              "project " + host + "/dockerhub-proxi doesn't exist",
+		"not a proxy cache": "project " + host + "/library isn't a proxy cache",
+		"wrong upstream":    "project " + host + "/quay-proxy proxies quay.io, which none of the matches of the rule mention",
+		"bad fallback":      "project " + host + "/missing doesn't exist",
+	}, verifier.disabled)
+	require.ErrorContains(t, verifier.Check(nil), "rules bad fallback, not a proxy cache, typo, wrong upstream are disabled")
+	require.Len(t, rules.Rules(), 9, "disabled rules are kept")
+
+	rewrite, err := rewriter.RewriteImage(context.TODO(), "quay.io/prometheus/prometheus:v3.0.0")
+	require.NoError(t, err)
+	require.Equal(t, host+"/quay-proxy/prometheus/prometheus:v3.0.0", rewrite.Rewritten)
+	require.Equal(t, "template", rewrite.Decisions[len(rewrite.Decisions)-1].Rule, "disabled rules aren't evaluated")
+
+	// the previous state is kept while harbor fails
+	harbor.mu.Lock()
+	harbor.failing = true
+	harbor.mu.Unlock()
+	require.Error(t, verifier.Verify(context.TODO()))
+	require.Len(t, verifier.disabled, 4)
+
+	// fixed rules are enabled again
+	harbor.mu.Lock()
+	harbor.failing = false
+	harbor.projects = append(harbor.projects, Project{ProjectID: 4, Name: "dockerhub-proxi", RegistryID: 1}, Project{ProjectID: 5, Name: "missing", RegistryID: 2})
+	harbor.mu.Unlock()
+	require.NoError(t, verifier.Verify(context.TODO()))
+	require.Equal(t, map[string]string{
+		"not a proxy cache": "project " + host + "/library isn't a proxy cache",
+		"wrong upstream":    "project " + host + "/quay-proxy proxies quay.io, which none of the matches of the rule mention",
+	}, verifier.disabled)
+}
+
+func TestReplacementProject(t *testing.T) {
+	type testcase struct {
+		replace string
+		host    string
+		project string
+	}
+	tests := []testcase{
+		{replace: "harbor.example.com/dockerhub-proxy", host: "harbor.example.com", project: "dockerhub-proxy"},
+		{replace: "harbor.example.com/dockerhub-proxy/", host: "harbor.example.com", project: "dockerhub-proxy"},
+		{replace: "harbor.example.com:8443/proxy/nested", host: "harbor.example.com:8443", project: "proxy"},
+		{replace: "harbor.example.com/proxy/${repository}", host: "harbor.example.com", project: "proxy"},
+		{replace: "harbor.example.com/proxy-${1}/${repository}"},
+		{replace: "harbor.example.com"},
+		{replace: "${registry}/proxy"},
+		{replace: config.FallbackOrigin},
+	}
+	for _, tc := range tests {
+		t.Run(tc.replace, func(t *testing.T) {
+			host, project, ok := replacementProject(tc.replace)
+			require.Equal(t, tc.host != "", ok)
+			require.Equal(t, tc.host, host)
+			require.Equal(t, tc.project, project)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/audit"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// admissionAudit logs the audit records of the containers of a single admission request.
+type admissionAudit struct {
+	logger *audit.Logger
+	// request are the fields of the records shared by every container of the request.
+	request audit.Record
+}
+
+// newAdmissionAudit returns the audit of the admitted pod or workload, or nil if the logger is nil.
+func newAdmissionAudit(logger *audit.Logger, req admission.Request, object metav1.Object) *admissionAudit {
+	if logger == nil {
+		return nil
+	}
+	request := audit.Record{
+		RequestUID:   string(req.UID),
+		Kind:         req.Kind.Kind,
+		Namespace:    req.Namespace,
+		Name:         object.GetName(),
+		GenerateName: object.GetGenerateName(),
+		DryRun:       req.DryRun != nil && *req.DryRun,
+	}
+	if request.Name == "" {
+		request.Name = req.Name
+	}
+	if owner := metav1.GetControllerOfNoCopy(object); owner != nil {
+		request.Owner = owner.Kind + "/" + owner.Name
+	}
+	return &admissionAudit{logger: logger, request: request}
+}
+
+// log logs the record of a container, with the fields of the request. A nil admissionAudit logs nothing.
+func (a *admissionAudit) log(container audit.Record, start time.Time) {
+	if a == nil {
+		return
+	}
+	record := a.request
+	record.Time = time.Now()
+	record.Container = container.Container
+	record.ContainerType = container.ContainerType
+	record.OriginalImage = container.OriginalImage
+	record.FinalImage = container.FinalImage
+	record.WouldRewrite = container.WouldRewrite
+	record.Rule = container.Rule
+	record.Decision = container.Decision
+	record.UpstreamChecks = container.UpstreamChecks
+	record.LatencyMilliseconds = float64(record.Time.Sub(start).Microseconds()) / 1000
+	record.Error = container.Error
+	a.logger.Log(record)
+}
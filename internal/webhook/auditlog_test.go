@@ -0,0 +1,134 @@
+package webhook
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/audit"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/stretchr/testify/require"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestPodContainerProxier_HandleAuditLog(t *testing.T) {
+	upstream := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+	image, err := random.Image(256, 1)
+	require.NoError(t, err)
+	require.NoError(t, crane.Push(image, upstreamHost+"/dockerhub-proxy/library/nginx:1.27"))
+
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:          "docker.io proxy cache",
+			Matches:       []string{"^docker.io"},
+			Replace:       upstreamHost + "/dockerhub-proxy",
+			CheckUpstream: true,
+			Platforms:     []string{config.DefaultPlatform},
+		},
+	}, nil)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.NewLogger(config.AuditLogConfig{Enabled: true, Path: path, MaxSize: 1})
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	proxier := PodContainerProxier{
+		Decoder:      admission.NewDecoder(scheme),
+		Transformers: transformers,
+		Audit:        auditLog,
+	}
+
+	isController := true
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "app-5d8f-", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-5d8f", UID: "1234", Controller: &isController},
+		}, Annotations: map[string]string{AnnotationDisabledContainers: "debug"}},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "busybox:1.37"}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "nginx:1.27"},
+				{Name: "exporter", Image: "quay.io/prometheus/nginx-exporter:v1"},
+				{Name: "debug", Image: "ubuntu:24.04"},
+			},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err)
+	resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UID:       "5678",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Operation: admissionv1.Create,
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	require.True(t, resp.Allowed)
+	require.NoError(t, auditLog.Close())
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	records := []audit.Record{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := audit.Record{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		require.Equal(t, "5678", record.RequestUID)
+		require.Equal(t, "default", record.Namespace)
+		require.Equal(t, "app-5d8f-", record.GenerateName)
+		require.Equal(t, "ReplicaSet/app-5d8f", record.Owner)
+		require.False(t, record.Time.IsZero())
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, records, 4, "one record per container")
+
+	type testcase struct {
+		container string
+		final     string
+		rule      string
+		decision  string
+		checks    []string
+	}
+	tests := []testcase{
+		{container: "init", final: "busybox:1.37", decision: audit.DecisionUnchanged, checks: []string{audit.UpstreamNotFound}},
+		{container: "app", final: upstreamHost + "/dockerhub-proxy/library/nginx:1.27", rule: "docker.io proxy cache", decision: audit.DecisionRewritten, checks: []string{audit.UpstreamFound}},
+		{container: "exporter", final: "quay.io/prometheus/nginx-exporter:v1", decision: audit.DecisionUnchanged},
+		{container: "debug", final: "ubuntu:24.04", decision: audit.DecisionDisabled},
+	}
+	for i, tc := range tests {
+		record := records[i]
+		require.Equal(t, tc.container, record.Container)
+		require.Equal(t, tc.final, record.FinalImage)
+		require.Equal(t, tc.rule, record.Rule)
+		require.Equal(t, tc.decision, record.Decision)
+		results := []string{}
+		for _, check := range record.UpstreamChecks {
+			results = append(results, check.Result)
+		}
+		require.ElementsMatch(t, tc.checks, results, tc.container)
+	}
+	require.Equal(t, "init", records[0].ContainerType)
+	require.Equal(t, "normal", records[1].ContainerType)
+}
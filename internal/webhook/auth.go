@@ -0,0 +1,465 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/chrismellard/docker-credential-acr-env/pkg/credhelper"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/google"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// credentialProviderAPIVersion is the default API version of the kubelet credential provider plugin protocol.
+	credentialProviderAPIVersion = "credentialprovider.kubelet.k8s.io/v1"
+
+	// credentialExpiryMargin renews cached credentials shortly before they expire, so they don't expire mid-check.
+	credentialExpiryMargin = time.Minute
+)
+
+// ecrHostPattern matches ECR registry hosts, capturing the account ID and region.
+var ecrHostPattern = regexp.MustCompile(`^(\d{12})\.dkr(?:-fips)?\.ecr\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// cloudProviderHosts are the registry hosts each cloud auth provider may send the webhook's cloud credentials to.
+var cloudProviderHosts = map[string]struct {
+	pattern     *regexp.Regexp
+	description string
+}{
+	config.AuthProviderECR: {ecrHostPattern, "<account>.dkr.ecr.<region>.amazonaws.com"},
+	config.AuthProviderGCR: {regexp.MustCompile(`^(?:[a-z0-9-]+\.)?gcr\.io$|^[a-z0-9-]+-docker\.pkg\.dev$`), "gcr.io, *.gcr.io and *-docker.pkg.dev"},
+	config.AuthProviderACR: {regexp.MustCompile(`^[a-z0-9-]+\.azurecr\.io$`), "*.azurecr.io"},
+}
+
+// checkCloudProviderHost ensures the cloud auth provider only authenticates to the registries of its cloud.
+func checkCloudProviderHost(provider, host string) error {
+	hosts, ok := cloudProviderHosts[provider]
+	if !ok || hosts.pattern.MatchString(host) {
+		return nil
+	}
+	return fmt.Errorf("auth provider %q can't authenticate to %q, only to %s", provider, host, hosts.description)
+}
+
+// credentialHTTPClient is used for requests to the ECR API.
+var credentialHTTPClient = awshttp.NewBuildableClient().WithTimeout(10 * time.Second)
+
+// upstreamAuthenticator resolves the credentials of a rule's upstream checks.
+type upstreamAuthenticator interface {
+	// Authenticator returns the credentials to fetch the manifest of the image reference.
+	Authenticator(ctx context.Context, imageRef string) (authn.Authenticator, error)
+}
+
+// authProvider returns the authentication provider of the rule, defaulting to its secret if set.
+func authProvider(rule config.ProxyRule) string {
+	if rule.Auth != nil && rule.Auth.Provider != "" {
+		return rule.Auth.Provider
+	}
+	if rule.AuthSecretName != "" {
+		return config.AuthProviderSecret
+	}
+	return config.AuthProviderAnonymous
+}
+
+// validateUpstreamAuth checks the auth of the rule, whose upstream checks go to the registries.
+func validateUpstreamAuth(rule config.ProxyRule, registries []string) error {
+	switch provider := authProvider(rule); provider {
+	case config.AuthProviderAnonymous:
+	case config.AuthProviderECR, config.AuthProviderGCR, config.AuthProviderACR:
+		for _, registry := range registries {
+			if err := checkCloudProviderHost(provider, registry); err != nil {
+				return err
+			}
+		}
+	case config.AuthProviderSecret:
+		if rule.AuthSecretName == "" {
+			return fmt.Errorf("auth provider %q requires authSecretName", provider)
+		}
+	case config.AuthProviderExec:
+		if rule.Auth.CredentialProvider == "" {
+			return fmt.Errorf("auth provider %q requires credentialProvider", provider)
+		}
+	default:
+		return fmt.Errorf("invalid auth provider %q, must be one of %s, %s, %s, %s, %s or %s", provider,
+			config.AuthProviderAnonymous, config.AuthProviderSecret, config.AuthProviderExec,
+			config.AuthProviderECR, config.AuthProviderGCR, config.AuthProviderACR)
+	}
+	return nil
+}
+
+// newUpstreamAuthenticator creates the authenticator of a rule which passed validateUpstreamAuth.
+func newUpstreamAuthenticator(rule config.ProxyRule, keychain *SecretKeychain, providers map[string]config.CredentialProvider) upstreamAuthenticator {
+	var authenticator upstreamAuthenticator
+	switch authProvider(rule) {
+	case config.AuthProviderSecret:
+		authenticator = &secretAuthenticator{
+			keychain: keychain,
+			key:      types.NamespacedName{Namespace: rule.Namespace, Name: rule.AuthSecretName},
+		}
+	case config.AuthProviderExec:
+		authenticator = &execAuthenticator{
+			name:     rule.Auth.CredentialProvider,
+			provider: providers[rule.Auth.CredentialProvider],
+			cache:    newCredentialCache(),
+		}
+	case config.AuthProviderECR:
+		authenticator = &cloudAuthenticator{
+			upstreamAuthenticator: &ecrAuthenticator{region: rule.Auth.Region, cache: newCredentialCache()},
+			provider:              config.AuthProviderECR,
+		}
+	case config.AuthProviderGCR:
+		authenticator = &cloudAuthenticator{
+			upstreamAuthenticator: &gcrAuthenticator{},
+			provider:              config.AuthProviderGCR,
+		}
+	case config.AuthProviderACR:
+		authenticator = &cloudAuthenticator{
+			upstreamAuthenticator: &acrAuthenticator{helper: credhelper.NewACRCredentialsHelper(), cache: newCredentialCache()},
+			provider:              config.AuthProviderACR,
+		}
+	default:
+		return anonymousAuthenticator{}
+	}
+	if rule.Auth != nil && rule.Auth.AnonymousFallback {
+		return &fallbackAuthenticator{upstreamAuthenticator: authenticator, rule: rule.Name}
+	}
+	return authenticator
+}
+
+// anonymousAuthenticator checks the registry without credentials.
+type anonymousAuthenticator struct{}
+
+func (anonymousAuthenticator) Authenticator(context.Context, string) (authn.Authenticator, error) {
+	return authn.Anonymous, nil
+}
+
+// fallbackAuthenticator checks the registry anonymously if the credentials can't be resolved.
+type fallbackAuthenticator struct {
+	upstreamAuthenticator
+	rule string
+}
+
+func (a *fallbackAuthenticator) Authenticator(ctx context.Context, imageRef string) (authn.Authenticator, error) {
+	auth, err := a.upstreamAuthenticator.Authenticator(ctx, imageRef)
+	if err != nil {
+		logger.Info(fmt.Sprintf("rule %q falling back to anonymous upstream checks for %q: %s", a.rule, imageRef, err.Error()))
+		return authn.Anonymous, nil
+	}
+	return auth, nil
+}
+
+// cloudAuthenticator only resolves the credentials of a cloud provider for the registries of its cloud, as images
+// rewritten by templates or the origin fallback can be on any registry.
+type cloudAuthenticator struct {
+	upstreamAuthenticator
+	provider string
+}
+
+func (a *cloudAuthenticator) Authenticator(ctx context.Context, imageRef string) (authn.Authenticator, error) {
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCloudProviderHost(a.provider, ref.Context().RegistryStr()); err != nil {
+		return nil, err
+	}
+	return a.upstreamAuthenticator.Authenticator(ctx, imageRef)
+}
+
+// secretAuthenticator uses the credentials of a kubernetes.io/dockerconfigjson image pull secret.
+type secretAuthenticator struct {
+	keychain *SecretKeychain
+	key      types.NamespacedName
+}
+
+func (a *secretAuthenticator) Authenticator(ctx context.Context, imageRef string) (authn.Authenticator, error) {
+	keyring, err := a.keychain.Keyring(ctx, a.key)
+	if err != nil {
+		return nil, err
+	}
+	auth, found := keyring.lookup(imageRef)
+	if !found {
+		return nil, fmt.Errorf("auth secret %q has no credentials for %q", a.key.Name, imageRef)
+	}
+	return authn.FromConfig(auth), nil
+}
+
+// credentialCache caches short-lived credentials until shortly before they expire.
+type credentialCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedCredential
+	now     func() time.Time
+}
+
+type cachedCredential struct {
+	auth    authn.AuthConfig
+	expires time.Time
+}
+
+func newCredentialCache() *credentialCache {
+	return &credentialCache{entries: map[string]cachedCredential{}, now: time.Now}
+}
+
+func (c *credentialCache) get(key string) (authn.AuthConfig, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || c.now().Add(credentialExpiryMargin).After(entry.expires) {
+		return authn.AuthConfig{}, false
+	}
+	return entry.auth, true
+}
+
+func (c *credentialCache) set(key string, auth authn.AuthConfig, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cachedCredential{auth: auth, expires: expires}
+}
+
+// credentialProviderRequest and credentialProviderResponse are the kubelet credential provider plugin protocol.
+type credentialProviderRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+type credentialProviderResponse struct {
+	APIVersion    string       `json:"apiVersion"`
+	Kind          string       `json:"kind"`
+	CacheKeyType  string       `json:"cacheKeyType"`
+	CacheDuration string       `json:"cacheDuration"`
+	Auth          DockerConfig `json:"auth"`
+}
+
+// execAuthenticator runs a kubelet credential provider plugin, caching its credentials as the plugin requests.
+type execAuthenticator struct {
+	name     string
+	provider config.CredentialProvider
+	cache    *credentialCache
+}
+
+func (a *execAuthenticator) Authenticator(ctx context.Context, imageRef string) (authn.Authenticator, error) {
+	if a.provider.Command == "" {
+		return nil, fmt.Errorf("credential provider %q is not configured", a.name)
+	}
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	// the cache keys of the Image, Registry and Global cache key types
+	cacheKeys := map[string]string{
+		"Image":    ref.Context().Name(),
+		"Registry": ref.Context().RegistryStr(),
+		"Global":   "",
+	}
+	for _, key := range []string{cacheKeys["Image"], cacheKeys["Registry"], cacheKeys["Global"]} {
+		if auth, ok := a.cache.get(key); ok {
+			return authn.FromConfig(auth), nil
+		}
+	}
+
+	apiVersion := a.provider.APIVersion
+	if apiVersion == "" {
+		apiVersion = credentialProviderAPIVersion
+	}
+	request, err := json.Marshal(credentialProviderRequest{APIVersion: apiVersion, Kind: "CredentialProviderRequest", Image: imageRef})
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, a.provider.Command, a.provider.Args...)
+	cmd.Env = os.Environ()
+	for _, env := range a.provider.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	cmd.Stdin = bytes.NewReader(request)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential provider %q failed: %w: %s", a.name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	response := credentialProviderResponse{}
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("failed to parse the response of credential provider %q: %w", a.name, err)
+	}
+	if response.Kind != "CredentialProviderResponse" {
+		return nil, fmt.Errorf("credential provider %q returned unexpected kind %q", a.name, response.Kind)
+	}
+	keyring, err := newDockerKeyring(response.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the credentials of credential provider %q: %w", a.name, err)
+	}
+	auth, found := keyring.lookup(imageRef)
+	if !found {
+		return nil, fmt.Errorf("credential provider %q returned no credentials for %q", a.name, imageRef)
+	}
+	if duration, err := time.ParseDuration(response.CacheDuration); err == nil && duration > 0 {
+		if key, ok := cacheKeys[response.CacheKeyType]; ok {
+			a.cache.set(key, auth, a.cache.now().Add(duration))
+		}
+	}
+	return authn.FromConfig(auth), nil
+}
+
+// gcrAuthenticator uses the access token of the Google application default credentials of the webhook, e.g. the
+// GCP service account bound to its kubernetes service account with GKE workload identity.
+type gcrAuthenticator struct {
+	mu   sync.Mutex
+	auth authn.Authenticator
+}
+
+func (a *gcrAuthenticator) Authenticator(context.Context, string) (authn.Authenticator, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.auth == nil {
+		// the authenticator refreshes its token for every later check, so it can't use the context of this one
+		auth, err := google.NewEnvAuthenticator(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get GCP access token: %w", err)
+		}
+		a.auth = auth
+	}
+	return a.auth, nil
+}
+
+// acrAuthenticator exchanges an Azure AD token of the webhook's workload identity, managed identity or service
+// principal for an ACR refresh token, caching it until it expires.
+type acrAuthenticator struct {
+	helper authn.Helper
+	cache  *credentialCache
+}
+
+func (a *acrAuthenticator) Authenticator(_ context.Context, imageRef string) (authn.Authenticator, error) {
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	host := ref.Context().RegistryStr()
+	if auth, ok := a.cache.get(host); ok {
+		return authn.FromConfig(auth), nil
+	}
+	username, refreshToken, err := a.helper.Get(host)
+	if err != nil {
+		return nil, err
+	}
+	// the refresh token is an identity token, like the credential helpers of docker return them
+	auth := authn.AuthConfig{Username: username, IdentityToken: refreshToken}
+	if expires, ok := jwtExpiry(refreshToken); ok {
+		a.cache.set(host, auth, expires)
+	}
+	return authn.FromConfig(auth), nil
+}
+
+// jwtExpiry returns the expiry of a JWT, without verifying it.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	claims := struct {
+		Expiry int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Expiry == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Expiry, 0), true
+}
+
+// ecrAuthenticator exchanges the AWS credentials of the webhook for an ECR authorization token. Credentials are
+// resolved by the default credential chain of the AWS SDK, e.g. from the environment, EKS pod identity or IAM roles
+// for service accounts.
+type ecrAuthenticator struct {
+	region string
+	// endpoint overrides the regional ECR API endpoint.
+	endpoint string
+	cache    *credentialCache
+
+	mu sync.Mutex
+	// clients are the ECR clients of each region, which cache the AWS credentials.
+	clients map[string]*ecr.Client
+}
+
+func (a *ecrAuthenticator) Authenticator(ctx context.Context, imageRef string) (authn.Authenticator, error) {
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	host := ref.Context().RegistryStr()
+	if auth, ok := a.cache.get(host); ok {
+		return authn.FromConfig(auth), nil
+	}
+
+	region, input := a.region, &ecr.GetAuthorizationTokenInput{}
+	if match := ecrHostPattern.FindStringSubmatch(host); match != nil {
+		input.RegistryIds = []string{match[1]}
+		if region == "" {
+			region = match[2]
+		}
+	}
+	if region == "" {
+		return nil, fmt.Errorf("can't determine the ECR region of %q, set the region of the rule's auth", host)
+	}
+	client, err := a.client(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	output, err := client.GetAuthorizationToken(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ECR authorization token: %w", err)
+	}
+	if len(output.AuthorizationData) == 0 {
+		return nil, fmt.Errorf("no ECR authorization token returned for %q", host)
+	}
+	data := output.AuthorizationData[0]
+	user, pass, err := decodeDockerConfigFieldAuth(aws.ToString(data.AuthorizationToken))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ECR authorization token: %w", err)
+	}
+	auth := authn.AuthConfig{Username: user, Password: pass}
+	a.cache.set(host, auth, aws.ToTime(data.ExpiresAt))
+	return authn.FromConfig(auth), nil
+}
+
+// client returns the ECR client of the region.
+func (a *ecrAuthenticator) client(ctx context.Context, region string) (*ecr.Client, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if client, ok := a.clients[region]; ok {
+		return client, nil
+	}
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region), awsconfig.WithHTTPClient(credentialHTTPClient))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the AWS config: %w", err)
+	}
+	client := ecr.NewFromConfig(awsConfig, func(options *ecr.Options) {
+		if a.endpoint != "" {
+			options.BaseEndpoint = aws.String(a.endpoint)
+		}
+	})
+	if a.clients == nil {
+		a.clients = map[string]*ecr.Client{}
+	}
+	a.clients[region] = client
+	return client, nil
+}
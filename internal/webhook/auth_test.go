@@ -0,0 +1,346 @@
+package webhook
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// tokenAuthRegistry emulates a registry with docker token authentication. Manifests require a bearer token from the
+// token endpoint, which is issued for the basic auth credentials of a user, or anonymously for public repositories.
+// Like ACR, it's also issued for the refresh token of the "<token>" user with the OAuth 2 refresh token grant.
+type tokenAuthRegistry struct {
+	*httptest.Server
+	host   string
+	users  map[string]string
+	public string
+}
+
+func newTokenAuthRegistry(t *testing.T, users map[string]string, public string) *tokenAuthRegistry {
+	registry := &tokenAuthRegistry{users: users, public: public}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", registry.token)
+	mux.HandleFunc("/v2/", registry.manifest)
+	registry.Server = httptest.NewServer(mux)
+	registry.host = strings.TrimPrefix(registry.URL, "http://")
+	t.Cleanup(registry.Close)
+	return registry
+}
+
+func (r *tokenAuthRegistry) token(w http.ResponseWriter, req *http.Request) {
+	repository := strings.TrimSuffix(strings.TrimPrefix(req.FormValue("scope"), "repository:"), ":pull")
+	user, pass, ok := req.BasicAuth()
+	switch {
+	case ok && pass != "" && r.users[user] == pass:
+	case req.PostFormValue("grant_type") == "refresh_token" && r.users["<token>"] == req.PostFormValue("refresh_token"):
+	case !ok && r.public != "" && strings.HasPrefix(repository, r.public):
+	default:
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"token": base64.StdEncoding.EncodeToString([]byte(repository))})
+}
+
+func (r *tokenAuthRegistry) manifest(w http.ResponseWriter, req *http.Request) {
+	repository, _, isManifest := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v2/"), "/manifests/")
+	token := base64.StdEncoding.EncodeToString([]byte(repository))
+	if !isManifest || req.Header.Get("Authorization") != "Bearer "+token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="%s"`, r.URL, r.host))
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	_, _ = w.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`))
+}
+
+// staticHelper is a docker credential helper which returns static credentials, and counts how often it's called.
+type staticHelper struct {
+	username, secret string
+	calls            int
+}
+
+func (h *staticHelper) Get(string) (string, string, error) {
+	h.calls++
+	return h.username, h.secret, nil
+}
+
+// writeCredentialProvider writes a credential provider plugin which records its requests and returns the response.
+func writeCredentialProvider(t *testing.T, response string) (command, requests string) {
+	dir := t.TempDir()
+	command = filepath.Join(dir, "credential-provider")
+	requests = filepath.Join(dir, "requests")
+	script := fmt.Sprintf("#!/bin/sh\ncat >> %q\necho >> %q\necho '%s'\n", requests, requests, response)
+	require.NoError(t, os.WriteFile(command, []byte(script), 0o755))
+	return command, requests
+}
+
+func TestUpstreamAuthenticators(t *testing.T) {
+	registry := newTokenAuthRegistry(t, map[string]string{
+		"robot$webhook": "secret-password",
+		"exec-user":     "exec-password",
+		"AWS":           "ecr-password",
+		"_token":        "gcp-token",
+		"<token>":       "acr-refresh-token",
+	}, "public/")
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	dockerConfig, err := json.Marshal(DockerConfigJSON{Auths: DockerConfig{
+		registry.host: {Auth: encodeDockerConfigFieldAuth("robot$webhook", "secret-password")},
+	}})
+	require.NoError(t, err)
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "harbor-pull-secret", Namespace: "webhook"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: dockerConfig},
+	}).Build()
+
+	execCommand, _ := writeCredentialProvider(t, fmt.Sprintf(
+		`{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","auth":{"%s":{"username":"exec-user","password":"exec-password"}}}`,
+		registry.host))
+
+	ecr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Amz-Target") != "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken" ||
+			!strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+			http.Error(w, "invalid request", http.StatusForbidden)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"authorizationData":[{"authorizationToken":%q,"expiresAt":%d}]}`,
+			encodeDockerConfigFieldAuth("AWS", "ecr-password"), time.Now().Add(12*time.Hour).Unix())
+	}))
+	defer ecr.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+
+	// the GCE metadata server, without any other application default credentials
+	gcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Metadata-Flavor") != "Google" ||
+			req.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+			http.Error(w, "invalid request", http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"gcp-token","expires_in":3599,"token_type":"Bearer"}`))
+	}))
+	defer gcp.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(gcp.URL, "http://"))
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("HOME", t.TempDir())
+
+	type testcase struct {
+		name          string
+		rule          config.ProxyRule
+		authenticator upstreamAuthenticator
+		repository    string
+		expectErr     bool
+	}
+	tests := []testcase{
+		{
+			name:       "anonymous checks of a public repository",
+			rule:       config.ProxyRule{},
+			repository: "public/nginx",
+		},
+		{
+			name:       "anonymous checks of a private repository fail",
+			rule:       config.ProxyRule{},
+			repository: "private/nginx",
+			expectErr:  true,
+		},
+		{
+			name:       "static image pull secret",
+			rule:       config.ProxyRule{AuthSecretName: "harbor-pull-secret"},
+			repository: "private/nginx",
+		},
+		{
+			name:       "missing image pull secret",
+			rule:       config.ProxyRule{AuthSecretName: "missing-pull-secret"},
+			repository: "private/nginx",
+			expectErr:  true,
+		},
+		{
+			name: "missing image pull secret falling back to anonymous checks",
+			rule: config.ProxyRule{
+				AuthSecretName: "missing-pull-secret",
+				Auth:           &config.UpstreamAuth{Provider: config.AuthProviderSecret, AnonymousFallback: true},
+			},
+			repository: "public/nginx",
+		},
+		{
+			name: "credential provider plugin",
+			rule: config.ProxyRule{
+				Auth: &config.UpstreamAuth{Provider: config.AuthProviderExec, CredentialProvider: "plugin"},
+			},
+			repository: "private/nginx",
+		},
+		{
+			name: "unknown credential provider plugin",
+			rule: config.ProxyRule{
+				Auth: &config.UpstreamAuth{Provider: config.AuthProviderExec, CredentialProvider: "unknown"},
+			},
+			repository: "private/nginx",
+			expectErr:  true,
+		},
+		{
+			name:          "ecr authorization token",
+			authenticator: &ecrAuthenticator{region: "us-east-1", endpoint: ecr.URL, cache: newCredentialCache()},
+			repository:    "private/nginx",
+		},
+		{
+			name:          "gcp access token",
+			authenticator: &gcrAuthenticator{},
+			repository:    "private/nginx",
+		},
+		{
+			name:          "acr refresh token",
+			authenticator: &acrAuthenticator{helper: &staticHelper{username: "<token>", secret: "acr-refresh-token"}, cache: newCredentialCache()},
+			repository:    "private/nginx",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := tc.rule
+			rule.Name = tc.name
+			rule.Matches = []string{".*"}
+			rule.Replace = registry.host
+			rule.CheckUpstream = true
+			rule.Namespace = "webhook"
+			transformers, err := MakeTransformers([]config.ProxyRule{rule}, kubeClient, WithCredentialProviders([]config.CredentialProvider{
+				{Name: "plugin", Command: execCommand},
+			}))
+			require.NoError(t, err)
+			transformer := transformers[0].(*ruleTransformer)
+			if tc.authenticator != nil {
+				transformer.authenticator = tc.authenticator
+			}
+
+			image, err := transformer.CheckUpstream(context.TODO(), registry.host+"/"+tc.repository+":1.27")
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, image.Found)
+		})
+	}
+}
+
+func TestExecAuthenticator_CacheDuration(t *testing.T) {
+	command, requests := writeCredentialProvider(t,
+		`{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderResponse","cacheKeyType":"Registry","cacheDuration":"1h","auth":{"harbor.example.com":{"username":"exec-user","password":"exec-password"}}}`)
+	authenticator := &execAuthenticator{
+		name:     "plugin",
+		provider: config.CredentialProvider{Name: "plugin", Command: command, Args: []string{"get-credentials"}},
+		cache:    newCredentialCache(),
+	}
+
+	for _, image := range []string{"harbor.example.com/proxy/nginx:1.27", "harbor.example.com/proxy/envoy:1.33"} {
+		auth, err := authenticator.Authenticator(context.TODO(), image)
+		require.NoError(t, err)
+		authConfig, err := auth.Authorization()
+		require.NoError(t, err)
+		require.Equal(t, "exec-user", authConfig.Username)
+		require.Equal(t, "exec-password", authConfig.Password)
+	}
+
+	data, err := os.ReadFile(requests)
+	require.NoError(t, err)
+	require.Equal(t, `{"apiVersion":"credentialprovider.kubelet.k8s.io/v1","kind":"CredentialProviderRequest","image":"harbor.example.com/proxy/nginx:1.27"}`,
+		strings.TrimSpace(string(data)), "the credentials of the registry should be cached")
+}
+
+func TestACRAuthenticator_CacheExpiry(t *testing.T) {
+	now := time.Now()
+	claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, now.Add(3*time.Hour).Unix())))
+	helper := &staticHelper{username: "<token>", secret: "eyJhbGciOiJSUzI1NiJ9." + claims + ".signature"}
+	authenticator := &acrAuthenticator{helper: helper, cache: newCredentialCache()}
+	authenticator.cache.now = func() time.Time { return now }
+
+	for _, image := range []string{"example.azurecr.io/nginx:1.27", "example.azurecr.io/envoy:1.33"} {
+		auth, err := authenticator.Authenticator(context.TODO(), image)
+		require.NoError(t, err)
+		authConfig, err := auth.Authorization()
+		require.NoError(t, err)
+		require.Equal(t, helper.secret, authConfig.IdentityToken)
+	}
+	require.Equal(t, 1, helper.calls, "the refresh token should be cached until it expires")
+
+	authenticator.cache.now = func() time.Time { return now.Add(3 * time.Hour) }
+	_, err := authenticator.Authenticator(context.TODO(), "example.azurecr.io/nginx:1.27")
+	require.NoError(t, err)
+	require.Equal(t, 2, helper.calls, "an expired refresh token should be exchanged again")
+
+	// refresh tokens without an expiry aren't cached
+	helper.secret = "opaque-refresh-token"
+	authenticator.cache = newCredentialCache()
+	for range 2 {
+		_, err := authenticator.Authenticator(context.TODO(), "example.azurecr.io/nginx:1.27")
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, helper.calls)
+}
+
+func TestValidateUpstreamAuth(t *testing.T) {
+	require.NoError(t, validateUpstreamAuth(config.ProxyRule{}, []string{"harbor.example.com"}))
+	require.NoError(t, validateUpstreamAuth(config.ProxyRule{Auth: &config.UpstreamAuth{Provider: config.AuthProviderECR}}, []string{"123456789012.dkr.ecr.us-east-1.amazonaws.com"}))
+	require.Error(t, validateUpstreamAuth(config.ProxyRule{Auth: &config.UpstreamAuth{Provider: "vault"}}, nil))
+	require.Error(t, validateUpstreamAuth(config.ProxyRule{Auth: &config.UpstreamAuth{Provider: config.AuthProviderSecret}}, nil))
+	require.Error(t, validateUpstreamAuth(config.ProxyRule{Auth: &config.UpstreamAuth{Provider: config.AuthProviderExec}}, nil))
+}
+
+func TestCheckCloudProviderHost(t *testing.T) {
+	type testcase struct {
+		provider string
+		host     string
+		allowed  bool
+	}
+	tests := []testcase{
+		{provider: config.AuthProviderECR, host: "123456789012.dkr.ecr.us-east-1.amazonaws.com", allowed: true},
+		{provider: config.AuthProviderECR, host: "harbor.example.com"},
+		{provider: config.AuthProviderGCR, host: "gcr.io", allowed: true},
+		{provider: config.AuthProviderGCR, host: "eu.gcr.io", allowed: true},
+		{provider: config.AuthProviderGCR, host: "europe-west1-docker.pkg.dev", allowed: true},
+		{provider: config.AuthProviderGCR, host: "gcr.io.example.com"},
+		{provider: config.AuthProviderACR, host: "example.azurecr.io", allowed: true},
+		{provider: config.AuthProviderACR, host: "evil.io"},
+		{provider: config.AuthProviderSecret, host: "harbor.example.com", allowed: true},
+	}
+	for _, tc := range tests {
+		err := checkCloudProviderHost(tc.provider, tc.host)
+		if tc.allowed {
+			require.NoError(t, err, tc.host)
+		} else {
+			require.Error(t, err, tc.host)
+		}
+	}
+
+	_, err := newRuleTransformer(config.ProxyRule{
+		Name:    "gcr",
+		Matches: []string{"^docker.io"},
+		Replace: "harbor.example.com/dockerhub-proxy",
+		Auth:    &config.UpstreamAuth{Provider: config.AuthProviderGCR},
+	})
+	require.ErrorContains(t, err, `auth provider "gcr" can't authenticate to "harbor.example.com"`)
+
+	// the registry of templates and the origin fallback is only known when checking an image
+	authenticator := newUpstreamAuthenticator(config.ProxyRule{Auth: &config.UpstreamAuth{Provider: config.AuthProviderGCR}}, nil, nil)
+	_, err = authenticator.Authenticator(context.TODO(), "evil.io/library/nginx:1.27")
+	require.ErrorContains(t, err, `auth provider "gcr" can't authenticate to "evil.io"`)
+}
@@ -0,0 +1,171 @@
+package webhook
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"golang.org/x/sync/singleflight"
+
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "hcw",
+		Subsystem: "upstream_cache",
+		Name:      "hits",
+		Help:      "upstream manifest checks answered from the cache",
+	})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "hcw",
+		Subsystem: "upstream_cache",
+		Name:      "misses",
+		Help:      "upstream manifest checks which were not cached and were fetched from the registry",
+	})
+	cacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "hcw",
+		Subsystem: "upstream_cache",
+		Name:      "evictions",
+		Help:      "upstream manifest check results evicted from the cache to stay within the size bounds",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(cacheHits, cacheMisses, cacheEvictions)
+}
+
+// upstreamCheckTimeout bounds a manifest fetch shared by concurrent checks, which isn't tied to the admission requests
+// waiting for it.
+const upstreamCheckTimeout = 30 * time.Second
+
+// UpstreamCache caches the results of upstream manifest checks, so that rolling out many replicas of the same image
+// only checks the registry once, and pins every replica to the same digest. Images which exist are cached for the TTL,
+// images which the registry reports as missing are cached for the negative TTL, and errors are never cached.
+// Concurrent checks of the same image share a single registry request.
+type UpstreamCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	group   singleflight.Group
+}
+
+type upstreamCacheEntry struct {
+	key     string
+	image   UpstreamImage
+	expires time.Time
+}
+
+// NewUpstreamCache creates a cache from the configuration, or returns nil if caching is disabled.
+func NewUpstreamCache(conf config.UpstreamCacheConfig) *UpstreamCache {
+	if conf.Disabled {
+		return nil
+	}
+	return &UpstreamCache{
+		ttl:         conf.TTL,
+		negativeTTL: conf.NegativeTTL,
+		maxEntries:  conf.MaxEntries,
+		now:         time.Now,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// upstreamCacheKey identifies an upstream check by the rule and the rewritten image reference. Rules authenticate to
+// the registry with their own credentials, so a result fetched with the credentials of one rule is never shared with
+// another. The rule is identified by its whole definition, including its auth and required platforms, so that the
+// results of a rule aren't reused once a reload changed it.
+func upstreamCacheKey(rule config.ProxyRule, imageRef string) string {
+	definition, _ := json.Marshal(rule)
+	return fmt.Sprintf("%s|%x|%s", rule.Name, sha256.Sum256(definition), imageRef)
+}
+
+// Check returns the cached result for the key if present, otherwise calls fetch and caches its result. Concurrent
+// checks of the key share the fetch, which is detached from their context and bounded by upstreamCheckTimeout, while
+// each check returns as soon as its own context is done. A nil cache always calls fetch with the context.
+func (c *UpstreamCache) Check(ctx context.Context, key string, fetch func(context.Context) (UpstreamImage, error)) (UpstreamImage, error) {
+	if c == nil {
+		return fetch(ctx)
+	}
+	if image, ok := c.get(key); ok {
+		cacheHits.Inc()
+		return image, nil
+	}
+	cacheMisses.Inc()
+
+	results := c.group.DoChan(key, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), upstreamCheckTimeout)
+		defer cancel()
+		image, err := fetch(fetchCtx)
+		if err != nil {
+			return UpstreamImage{}, err
+		}
+		c.add(key, image)
+		return image, nil
+	})
+	select {
+	case <-ctx.Done():
+		return UpstreamImage{}, ctx.Err()
+	case result := <-results:
+		if result.Err != nil {
+			return UpstreamImage{}, result.Err
+		}
+		return result.Val.(UpstreamImage), nil
+	}
+}
+
+func (c *UpstreamCache) get(key string) (image UpstreamImage, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return UpstreamImage{}, false
+	}
+	entry := element.Value.(*upstreamCacheEntry)
+	if c.now().After(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return UpstreamImage{}, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.image, true
+}
+
+func (c *UpstreamCache) add(key string, image UpstreamImage) {
+	ttl := c.ttl
+	if !image.Found {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &upstreamCacheEntry{key: key, image: image, expires: c.now().Add(ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*upstreamCacheEntry).key)
+		cacheEvictions.Inc()
+	}
+}
@@ -0,0 +1,185 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestUpstreamCache(maxEntries int) (*UpstreamCache, *time.Time) {
+	now := time.Unix(0, 0)
+	cache := NewUpstreamCache(config.UpstreamCacheConfig{
+		TTL:         time.Minute,
+		NegativeTTL: 10 * time.Second,
+		MaxEntries:  maxEntries,
+	})
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+func TestUpstreamCache_TTL(t *testing.T) {
+	cache, now := newTestUpstreamCache(10)
+	calls := 0
+	fetch := func(found bool) func(context.Context) (UpstreamImage, error) {
+		return func(context.Context) (UpstreamImage, error) {
+			calls++
+			return UpstreamImage{Found: found}, nil
+		}
+	}
+
+	found, err := cache.Check(context.TODO(), "found", fetch(true))
+	require.NoError(t, err)
+	require.True(t, found.Found)
+	found, err = cache.Check(context.TODO(), "missing", fetch(false))
+	require.NoError(t, err)
+	require.False(t, found.Found)
+	require.Equal(t, 2, calls)
+
+	*now = now.Add(5 * time.Second)
+	_, _ = cache.Check(context.TODO(), "found", fetch(true))
+	_, _ = cache.Check(context.TODO(), "missing", fetch(false))
+	require.Equal(t, 2, calls, "both results should be cached")
+
+	*now = now.Add(10 * time.Second)
+	_, _ = cache.Check(context.TODO(), "found", fetch(true))
+	_, _ = cache.Check(context.TODO(), "missing", fetch(false))
+	require.Equal(t, 3, calls, "the negative result should expire after the negative ttl")
+
+	*now = now.Add(time.Minute)
+	_, _ = cache.Check(context.TODO(), "found", fetch(true))
+	require.Equal(t, 4, calls, "the positive result should expire after the ttl")
+}
+
+func TestUpstreamCache_ErrorsNotCached(t *testing.T) {
+	cache, _ := newTestUpstreamCache(10)
+	calls := 0
+	fetch := func(context.Context) (UpstreamImage, error) {
+		calls++
+		return UpstreamImage{}, errors.New("registry unavailable")
+	}
+	_, err := cache.Check(context.TODO(), "key", fetch)
+	require.Error(t, err)
+	_, err = cache.Check(context.TODO(), "key", fetch)
+	require.Error(t, err)
+	require.Equal(t, 2, calls)
+}
+
+func TestUpstreamCache_Eviction(t *testing.T) {
+	cache, _ := newTestUpstreamCache(2)
+	calls := 0
+	fetch := func(context.Context) (UpstreamImage, error) {
+		calls++
+		return UpstreamImage{Found: true}, nil
+	}
+	_, _ = cache.Check(context.TODO(), "a", fetch)
+	_, _ = cache.Check(context.TODO(), "b", fetch)
+	_, _ = cache.Check(context.TODO(), "a", fetch)
+	_, _ = cache.Check(context.TODO(), "c", fetch)
+	require.Equal(t, 3, calls)
+
+	_, _ = cache.Check(context.TODO(), "a", fetch)
+	require.Equal(t, 3, calls, "the most recently used entry should be kept")
+	_, _ = cache.Check(context.TODO(), "b", fetch)
+	require.Equal(t, 4, calls, "the least recently used entry should be evicted")
+}
+
+func TestUpstreamCache_Singleflight(t *testing.T) {
+	cache, _ := newTestUpstreamCache(10)
+	var calls int32
+	release := make(chan struct{})
+	fetch := func(context.Context) (UpstreamImage, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return UpstreamImage{Found: true}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, err := cache.Check(context.TODO(), "key", fetch)
+			require.NoError(t, err)
+			require.True(t, found.Found)
+		}()
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestUpstreamCache_Disabled(t *testing.T) {
+	cache := NewUpstreamCache(config.UpstreamCacheConfig{Disabled: true})
+	require.Nil(t, cache)
+	calls := 0
+	for i := 0; i < 2; i++ {
+		_, err := cache.Check(context.TODO(), "key", func(context.Context) (UpstreamImage, error) {
+			calls++
+			return UpstreamImage{Found: true}, nil
+		})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, calls)
+}
+
+func TestUpstreamCacheKey(t *testing.T) {
+	rule := config.ProxyRule{
+		Name:      "docker.io",
+		Matches:   []string{"^docker.io"},
+		Replace:   "harbor.example.com/proxy",
+		Platforms: []string{"linux/amd64"},
+	}
+	imageRef := "harbor.example.com/proxy/library/nginx:1"
+	require.Equal(t, upstreamCacheKey(rule, imageRef), upstreamCacheKey(rule, imageRef))
+
+	authenticated := rule
+	authenticated.Name = "docker.io authenticated"
+	require.NotEqual(t, upstreamCacheKey(rule, imageRef), upstreamCacheKey(authenticated, imageRef),
+		"rules with different credentials don't share results")
+	reloaded := rule
+	reloaded.AuthSecretName = "harbor-credentials"
+	require.NotEqual(t, upstreamCacheKey(rule, imageRef), upstreamCacheKey(reloaded, imageRef),
+		"the results of a rule aren't reused once its definition changed")
+	reloaded = rule
+	reloaded.Platforms = []string{"linux/amd64", "linux/arm64"}
+	require.NotEqual(t, upstreamCacheKey(rule, imageRef), upstreamCacheKey(reloaded, imageRef))
+}
+
+func TestUpstreamCache_CheckCanceled(t *testing.T) {
+	cache, _ := newTestUpstreamCache(10)
+	var calls int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (UpstreamImage, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return UpstreamImage{Found: true}, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan error)
+	go func() {
+		_, err := cache.Check(ctx, "key", fetch)
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled, "the check returns without waiting for the shared fetch")
+
+	close(release)
+	require.Eventually(t, func() bool {
+		_, ok := cache.get("key")
+		return ok
+	}, time.Second, time.Millisecond, "the shared fetch isn't canceled with the check that started it")
+	found, err := cache.Check(context.TODO(), "key", fetch)
+	require.NoError(t, err)
+	require.True(t, found.Found)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
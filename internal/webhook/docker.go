@@ -30,6 +30,45 @@ func ReplaceRegistryInImageRef(imageReference, replacementRegistry string) (imag
 	return strings.Replace(named.String(), reference.Domain(named), replacementRegistry, 1), nil
 }
 
+// ReplaceRegistryAndPathInImageRef returns the image reference with the registry replaced and the repository path
+// rewritten by rewritePath. Unlike ReplaceRegistryInImageRef, both the tag and digest of the image are kept.
+func ReplaceRegistryAndPathInImageRef(imageReference, replacementRegistry string, rewritePath func(path string) string) (imageRef string, err error) {
+	named, err := reference.ParseNormalizedNamed(imageReference)
+	if err != nil {
+		return "", err
+	}
+	named = reference.TagNameOnly(named)
+
+	rewritten := replacementRegistry + "/" + rewritePath(reference.Path(named))
+	if tagged, ok := named.(reference.Tagged); ok {
+		rewritten += ":" + tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		rewritten += "@" + digested.Digest().String()
+	}
+	if _, err := reference.ParseNormalizedNamed(rewritten); err != nil {
+		return "", fmt.Errorf("rewritten image reference %q is invalid: %w", rewritten, err)
+	}
+	return rewritten, nil
+}
+
+// PinDigestInImageRef returns the image reference pinned to the digest, keeping its tag, e.g. image:tag@sha256:...
+// Image references which already have a digest are returned as is.
+func PinDigestInImageRef(imageReference, digest string) (imageRef string, err error) {
+	named, err := reference.ParseNormalizedNamed(imageReference)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return imageReference, nil
+	}
+	pinned := imageReference + "@" + digest
+	if _, err := reference.ParseNormalizedNamed(pinned); err != nil {
+		return "", fmt.Errorf("pinned image reference %q is invalid: %w", pinned, err)
+	}
+	return pinned, nil
+}
+
 // below is adapted from kubelet internals, see: https://github.com/kubernetes/kubernetes/blob/master/pkg/credentialprovider/config.go
 /*
 Copyright 2014 The Kubernetes Authors.
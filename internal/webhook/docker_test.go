@@ -1,6 +1,7 @@
 package webhook
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/containers/image/v5/docker/reference"
@@ -152,3 +153,82 @@ func Test_ReplaceRegistryInImageRef(t *testing.T) {
 		require.Equal(t, testcase.expectedRef, output, testcase.description)
 	}
 }
+
+func Test_ReplaceRegistryAndPathInImageRef(t *testing.T) {
+	type testcase struct {
+		description string
+		imageRef    string
+		expectedRef string
+	}
+	stripLibrary := func(path string) string {
+		return strings.TrimPrefix(path, "library/")
+	}
+	tests := []testcase{
+		{
+			description: "bare image reference with no image tag set",
+			imageRef:    "busybox",
+			expectedRef: "harbor.example.com/proxy-cache/busybox:latest",
+		},
+		{
+			description: "image reference with image tag set",
+			imageRef:    "docker.io/library/busybox:1.32.0",
+			expectedRef: "harbor.example.com/proxy-cache/busybox:1.32.0",
+		},
+		{
+			description: "image reference with image sha set",
+			imageRef:    "busybox@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+			expectedRef: "harbor.example.com/proxy-cache/busybox@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+		},
+		{
+			description: "image reference with image tag and sha set",
+			imageRef:    "busybox:1.32.0@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+			expectedRef: "harbor.example.com/proxy-cache/busybox:1.32.0@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+		},
+		{
+			description: "image reference with hostname with port and a path not matching the prefix",
+			imageRef:    "somehost:443/public/busybox:1.32.0",
+			expectedRef: "harbor.example.com/proxy-cache/public/busybox:1.32.0",
+		},
+	}
+	for _, testcase := range tests {
+		output, err := ReplaceRegistryAndPathInImageRef(testcase.imageRef, "harbor.example.com/proxy-cache", stripLibrary)
+		require.NoError(t, err, testcase.description)
+		require.Equal(t, testcase.expectedRef, output, testcase.description)
+	}
+}
+
+func Test_ReplaceRegistryAndPathInImageRef_InvalidPath(t *testing.T) {
+	_, err := ReplaceRegistryAndPathInImageRef("busybox", "harbor.example.com/proxy-cache", func(string) string {
+		return "Invalid/Path"
+	})
+	require.Error(t, err)
+}
+
+func Test_PinDigestInImageRef(t *testing.T) {
+	type testcase struct {
+		description string
+		imageRef    string
+		expectedRef string
+	}
+	digest := "sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa"
+	tests := []testcase{
+		{
+			description: "image reference with image tag set",
+			imageRef:    "harbor.example.com/proxy-cache/library/busybox:1.32.0",
+			expectedRef: "harbor.example.com/proxy-cache/library/busybox:1.32.0@" + digest,
+		},
+		{
+			description: "image reference with image sha set",
+			imageRef:    "harbor.example.com/proxy-cache/library/busybox@sha256:3fbc632167424a6d997e74f52b878d7cc478225cffac6bc977eedfe51c7f4e79",
+			expectedRef: "harbor.example.com/proxy-cache/library/busybox@sha256:3fbc632167424a6d997e74f52b878d7cc478225cffac6bc977eedfe51c7f4e79",
+		},
+	}
+	for _, testcase := range tests {
+		output, err := PinDigestInImageRef(testcase.imageRef, digest)
+		require.NoError(t, err, testcase.description)
+		require.Equal(t, testcase.expectedRef, output, testcase.description)
+	}
+
+	_, err := PinDigestInImageRef("harbor.example.com/proxy-cache/library/busybox:1.32.0", "sha256:invalid")
+	require.Error(t, err)
+}
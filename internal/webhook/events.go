@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// EventReasonRewritten is the reason of the Normal events recorded when the image of a container is rewritten.
+	EventReasonRewritten = "ImageRewritten"
+	// EventReasonUpstreamCheckFailed is the reason of the Warning events recorded when a rewritten image couldn't be
+	// found in the upstream registry, so the image wasn't rewritten to it.
+	EventReasonUpstreamCheckFailed = "UpstreamCheckFailed"
+	// EventReasonRewriteFailed is the reason of the Warning events recorded when the images of a pod couldn't be
+	// rewritten at all, such as an image reference which can't be parsed.
+	EventReasonRewriteFailed = "RewriteFailed"
+
+	// maxRecentEvents bounds the number of recorded events remembered to deduplicate them.
+	maxRecentEvents = 10000
+)
+
+var suppressedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "hcw",
+	Subsystem: "events",
+	Name:      "suppressed",
+	Help:      "events which weren't recorded, because an identical event was recently recorded about the same object or the rate limit was exceeded",
+}, []string{"reason"})
+
+func init() {
+	metrics.Registry.MustRegister(suppressedEvents)
+}
+
+// EventRecorder records Kubernetes events about the rewrites of pods. Identical events about the same object are only
+// recorded once per window, and the events about every object are rate limited, so that a large rollout doesn't flood
+// the API server.
+type EventRecorder struct {
+	recorder record.EventRecorder
+	window   time.Duration
+	limiter  flowcontrol.RateLimiter
+	recent   *cache.LRUExpireCache
+}
+
+// NewEventRecorder creates an event recorder from the configuration, or returns nil if events are disabled.
+func NewEventRecorder(conf config.EventsConfig, recorder record.EventRecorder) *EventRecorder {
+	if conf.Disabled {
+		return nil
+	}
+	return &EventRecorder{
+		recorder: recorder,
+		window:   conf.Window,
+		limiter:  flowcontrol.NewTokenBucketRateLimiter(conf.QPS, conf.Burst),
+		recent:   cache.NewLRUExpireCache(maxRecentEvents),
+	}
+}
+
+// record records the event about the object, unless an identical event was recorded within the window or the rate
+// limit is exceeded. A nil recorder records nothing.
+func (r *EventRecorder) record(object *corev1.ObjectReference, eventType, reason, format string, args ...interface{}) {
+	if r == nil || object == nil {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	key := strings.Join([]string{object.Kind, object.Namespace, object.Name, string(object.UID), eventType, reason, message}, "|")
+	if _, ok := r.recent.Get(key); ok {
+		suppressedEvents.WithLabelValues(reason).Inc()
+		return
+	}
+	if !r.limiter.TryAccept() {
+		suppressedEvents.WithLabelValues(reason).Inc()
+		return
+	}
+	r.recent.Add(key, struct{}{}, r.window)
+	r.recorder.Event(object, eventType, reason, message)
+}
+
+// podEvents records the events of the admission of a single pod or pod template against the same object.
+type podEvents struct {
+	recorder *EventRecorder
+	object   *corev1.ObjectReference
+}
+
+// record records the event about the object of the admission. A nil podEvents records nothing.
+func (e *podEvents) record(eventType, reason, format string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+	e.recorder.record(e.object, eventType, reason, format, args...)
+}
+
+// newPodEvents returns the events of an admitted pod or workload, recorded against its controller, the object itself
+// if it already exists, or otherwise its namespace, as pods and workloads don't exist yet when they're created.
+// It returns nil if the recorder is nil.
+func newPodEvents(recorder *EventRecorder, kind metav1.GroupVersionKind, object metav1.Object, namespace string) *podEvents {
+	if recorder == nil {
+		return nil
+	}
+	reference := &corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: namespace, Namespace: namespace}
+	if owner := metav1.GetControllerOfNoCopy(object); owner != nil {
+		reference = &corev1.ObjectReference{
+			APIVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+			Name:       owner.Name,
+			Namespace:  namespace,
+			UID:        owner.UID,
+		}
+	} else if object.GetUID() != "" {
+		apiVersion := kind.Version
+		if kind.Group != "" {
+			apiVersion = kind.Group + "/" + kind.Version
+		}
+		reference = &corev1.ObjectReference{
+			APIVersion: apiVersion,
+			Kind:       kind.Kind,
+			Name:       object.GetName(),
+			Namespace:  namespace,
+			UID:        object.GetUID(),
+		}
+	}
+	return &podEvents{recorder: recorder, object: reference}
+}
@@ -0,0 +1,141 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/stretchr/testify/require"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// recordedEvents drains the events of the fake recorder.
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventRecorder_record(t *testing.T) {
+	fake := record.NewFakeRecorder(10)
+	recorder := NewEventRecorder(config.EventsConfig{Window: time.Minute, QPS: 0.001, Burst: 2}, fake)
+	object := &corev1.ObjectReference{Kind: "ReplicaSet", Namespace: "default", Name: "app-5d8f"}
+
+	recorder.record(object, corev1.EventTypeNormal, EventReasonRewritten, "rewrote %q", "nginx")
+	recorder.record(object, corev1.EventTypeNormal, EventReasonRewritten, "rewrote %q", "nginx")
+	require.Equal(t, []string{`Normal ImageRewritten rewrote "nginx"`}, recordedEvents(fake), "identical events are deduplicated")
+
+	recorder.record(object, corev1.EventTypeNormal, EventReasonRewritten, "rewrote %q", "busybox")
+	recorder.record(object, corev1.EventTypeNormal, EventReasonRewritten, "rewrote %q", "ubuntu")
+	require.Equal(t, []string{`Normal ImageRewritten rewrote "busybox"`}, recordedEvents(fake), "events over the burst are dropped")
+
+	var disabled *EventRecorder
+	disabled.record(object, corev1.EventTypeNormal, EventReasonRewritten, "rewrote")
+	require.Nil(t, NewEventRecorder(config.EventsConfig{Disabled: true}, fake))
+}
+
+func TestNewPodEvents(t *testing.T) {
+	recorder := NewEventRecorder(config.EventsConfig{Window: time.Minute, QPS: 1, Burst: 1}, record.NewFakeRecorder(1))
+	isController := true
+	type testcase struct {
+		name     string
+		kind     metav1.GroupVersionKind
+		object   metav1.ObjectMeta
+		expected corev1.ObjectReference
+	}
+	tests := []testcase{
+		{
+			name: "pods are recorded against their controller",
+			kind: metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			object: metav1.ObjectMeta{GenerateName: "app-5d8f-", OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-5d8f", UID: "1234", Controller: &isController},
+			}},
+			expected: corev1.ObjectReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-5d8f", Namespace: "team-a", UID: "1234"},
+		},
+		{
+			name:     "existing objects are recorded against themselves",
+			kind:     metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			object:   metav1.ObjectMeta{Name: "app", UID: "5678"},
+			expected: corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", Namespace: "team-a", UID: "5678"},
+		},
+		{
+			name:     "created objects are recorded against their namespace",
+			kind:     metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			object:   metav1.ObjectMeta{Name: "debug"},
+			expected: corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: "team-a", Namespace: "team-a"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			events := newPodEvents(recorder, tc.kind, &tc.object, "team-a")
+			require.Equal(t, tc.expected, *events.object)
+		})
+	}
+	require.Nil(t, newPodEvents(nil, metav1.GroupVersionKind{}, &metav1.ObjectMeta{}, "team-a"))
+}
+
+func TestPodContainerProxier_HandleEvents(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:    "docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/dockerhub-proxy",
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	fake := record.NewFakeRecorder(10)
+	proxier := PodContainerProxier{
+		Decoder:      admission.NewDecoder(scheme),
+		Transformers: transformers,
+		Events:       NewEventRecorder(config.EventsConfig{Window: time.Minute, QPS: 1, Burst: 10}, fake),
+	}
+	handle := func(image string, dryRun bool) {
+		pod := corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{GenerateName: "app-", Namespace: "default"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		}
+		raw, err := json.Marshal(pod)
+		require.NoError(t, err)
+		proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Operation: admissionv1.Create,
+			Namespace: "default",
+			DryRun:    &dryRun,
+			Object:    runtime.RawExtension{Raw: raw},
+		}})
+	}
+
+	handle("nginx:1.27", false)
+	handle("nginx:1.27", false)
+	require.Equal(t, []string{
+		`Normal ImageRewritten rewrote the image of container "app" from "nginx:1.27" to "harbor.example.com/dockerhub-proxy/library/nginx:1.27" with rule "docker.io proxy cache"`,
+	}, recordedEvents(fake), "the replicas of a rollout record a single event")
+
+	handle("nginx:1.28", true)
+	require.Empty(t, recordedEvents(fake), "dry runs don't record events")
+
+	handle("nginx:1.27@sha256:invalid", false)
+	events := recordedEvents(fake)
+	require.Len(t, events, 1)
+	require.Contains(t, events[0], "Warning RewriteFailed failed to rewrite the images of a pod: ")
+}
@@ -0,0 +1,221 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var registryHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "hcw",
+	Subsystem: "registry",
+	Name:      "healthy",
+	Help:      "1 if the replacement registry is healthy according to its probes, 0 if it's unhealthy",
+}, []string{"registry"})
+
+func init() {
+	metrics.Registry.MustRegister(registryHealthy)
+}
+
+// RegistryHealth tracks the health of the replacement registries, so that rules with fallbacks or skipUnhealthy
+// avoid them without making any requests during admission. A registry is unhealthy for the cooldown after it failed
+// an upstream check, or until a check succeeds. Once started, it also probes the /v2/ endpoint of every registry in
+// the background, and a registry is unhealthy after consecutive failed probes, until consecutive probes succeed.
+// A nil RegistryHealth considers every registry healthy.
+type RegistryHealth struct {
+	cooldown time.Duration
+	probe    config.RegistryProbeConfig
+	client   *http.Client
+	now      func() time.Time
+
+	mu       sync.Mutex
+	failures map[string]time.Time
+	probes   map[string]*probeState
+}
+
+// probeState is the probed health of a registry.
+type probeState struct {
+	unhealthy bool
+	// flips counts the consecutive probes whose result contradicts the current health.
+	flips int
+}
+
+// NewRegistryHealth creates a registry health tracker from the configuration.
+func NewRegistryHealth(conf config.RegistryHealthConfig) *RegistryHealth {
+	return &RegistryHealth{
+		cooldown: conf.Cooldown,
+		probe:    conf.Probe,
+		client:   &http.Client{Timeout: conf.Probe.Timeout},
+		now:      time.Now,
+		failures: map[string]time.Time{},
+		probes:   map[string]*probeState{},
+	}
+}
+
+// Healthy returns if the registry didn't fail an upstream check within the cooldown, and its probes succeed.
+func (h *RegistryHealth) Healthy(registry string) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state, ok := h.probes[registry]; ok && state.unhealthy {
+		return false
+	}
+	failed, ok := h.failures[registry]
+	if !ok {
+		return true
+	}
+	if h.now().Sub(failed) >= h.cooldown {
+		delete(h.failures, registry)
+		return true
+	}
+	return false
+}
+
+// ReportFailure marks the registry unhealthy for the cooldown.
+func (h *RegistryHealth) ReportFailure(registry string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures[registry] = h.now()
+}
+
+// ReportSuccess marks the registry healthy again, unless its probes fail.
+func (h *RegistryHealth) ReportSuccess(registry string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.failures, registry)
+}
+
+// SetRegistries replaces the registries which are probed. Registries start out healthy.
+func (h *RegistryHealth) SetRegistries(registries []string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := make(map[string]bool, len(registries))
+	for _, registry := range registries {
+		current[registry] = true
+		if _, ok := h.probes[registry]; !ok {
+			h.probes[registry] = &probeState{}
+		}
+	}
+	for registry := range h.probes {
+		if !current[registry] {
+			delete(h.probes, registry)
+			registryHealthy.DeleteLabelValues(registry)
+		}
+	}
+}
+
+// Start probes the registries every interval until the context is cancelled. It implements manager.Runnable.
+func (h *RegistryHealth) Start(ctx context.Context) error {
+	ticker := time.NewTicker(h.probe.Interval)
+	defer ticker.Stop()
+	for {
+		h.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica probes the registries itself.
+func (h *RegistryHealth) NeedLeaderElection() bool {
+	return false
+}
+
+func (h *RegistryHealth) probeAll(ctx context.Context) {
+	h.mu.Lock()
+	registries := make([]string, 0, len(h.probes))
+	for registry := range h.probes {
+		registries = append(registries, registry)
+	}
+	h.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, registry := range registries {
+		wg.Add(1)
+		go func(registry string) {
+			defer wg.Done()
+			h.recordProbe(registry, h.ping(ctx, registry))
+		}(registry)
+	}
+	wg.Wait()
+}
+
+// ping requests the /v2/ endpoint of the registry. Any response but a server error or rate limit, including
+// unauthorized, means the registry is up.
+func (h *RegistryHealth) ping(ctx context.Context, registry string) error {
+	reg, err := name.NewRegistry(registry)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/v2/", reg.Scheme(), reg.RegistryStr()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// recordProbe updates the health of the registry from a probe, flipping it once the threshold of consecutive probes
+// is reached.
+func (h *RegistryHealth) recordProbe(registry string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.probes[registry]
+	if !ok {
+		// the rules no longer rewrite to the registry
+		return
+	}
+	if (err != nil) != state.unhealthy {
+		state.flips++
+	} else {
+		state.flips = 0
+	}
+	threshold := h.probe.FailureThreshold
+	if state.unhealthy {
+		threshold = h.probe.SuccessThreshold
+	}
+	if state.flips >= max(threshold, 1) {
+		state.unhealthy = !state.unhealthy
+		state.flips = 0
+		if state.unhealthy {
+			logger.Info(fmt.Sprintf("registry %s is unhealthy, probes failed: %s", registry, err.Error()))
+		} else {
+			logger.Info(fmt.Sprintf("registry %s is healthy again", registry))
+		}
+	}
+	if state.unhealthy {
+		registryHealthy.WithLabelValues(registry).Set(0)
+	} else {
+		registryHealthy.WithLabelValues(registry).Set(1)
+	}
+}
@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryHealth_Cooldown(t *testing.T) {
+	now := time.Now()
+	health := NewRegistryHealth(config.RegistryHealthConfig{Cooldown: time.Minute})
+	health.now = func() time.Time { return now }
+
+	require.True(t, health.Healthy("harbor.example.com"))
+	health.ReportFailure("harbor.example.com")
+	require.False(t, health.Healthy("harbor.example.com"))
+	require.True(t, health.Healthy("harbor-eu.example.com"))
+
+	now = now.Add(time.Minute)
+	require.True(t, health.Healthy("harbor.example.com"), "registries are healthy again after the cooldown")
+
+	health.ReportFailure("harbor.example.com")
+	health.ReportSuccess("harbor.example.com")
+	require.True(t, health.Healthy("harbor.example.com"), "registries are healthy again once a check succeeds")
+
+	var disabled *RegistryHealth
+	disabled.ReportFailure("harbor.example.com")
+	require.True(t, disabled.Healthy("harbor.example.com"))
+}
+
+func TestRegistryHealth_Probe(t *testing.T) {
+	status := http.StatusUnauthorized
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v2/", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	health := NewRegistryHealth(config.RegistryHealthConfig{
+		Cooldown: time.Minute,
+		Probe:    config.RegistryProbeConfig{Timeout: time.Second, FailureThreshold: 3, SuccessThreshold: 2},
+	})
+	health.SetRegistries([]string{host})
+	probe := func(times int) {
+		for i := 0; i < times; i++ {
+			health.probeAll(context.TODO())
+		}
+	}
+
+	probe(1)
+	require.True(t, health.Healthy(host), "registries requiring authentication are up")
+	require.Equal(t, float64(1), testutil.ToFloat64(registryHealthy.WithLabelValues(host)))
+
+	status = http.StatusBadGateway
+	probe(2)
+	require.True(t, health.Healthy(host), "registries stay healthy until the failure threshold")
+	probe(1)
+	require.False(t, health.Healthy(host))
+	require.Equal(t, float64(0), testutil.ToFloat64(registryHealthy.WithLabelValues(host)))
+
+	status = http.StatusOK
+	probe(1)
+	require.False(t, health.Healthy(host), "registries stay unhealthy until the success threshold")
+	health.ReportSuccess(host)
+	require.False(t, health.Healthy(host), "upstream checks don't override the probes")
+	probe(1)
+	require.True(t, health.Healthy(host))
+	require.Equal(t, float64(1), testutil.ToFloat64(registryHealthy.WithLabelValues(host)))
+
+	server.Close()
+	probe(3)
+	require.False(t, health.Healthy(host), "unreachable registries are unhealthy")
+
+	health.SetRegistries(nil)
+	require.True(t, health.Healthy(host), "registries no rule rewrites to aren't probed")
+	require.False(t, registryHealthy.DeleteLabelValues(host), "the gauge of registries which aren't probed is removed")
+}
@@ -0,0 +1,321 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	authSecretInvalid = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hcw",
+		Subsystem: "auth",
+		Name:      "secret_invalid",
+		Help:      "auth secrets referenced by rules which are missing or malformed, by reason",
+	}, []string{"secret", "reason"})
+
+	errSecretMissing = errors.New("secret not found")
+)
+
+// legacyDockerHubHost is the docker hub registry as written by docker login, and as resolved by go-containerregistry.
+const legacyDockerHubHost = "index.docker.io"
+
+func init() {
+	metrics.Registry.MustRegister(authSecretInvalid)
+}
+
+// SecretKeychain keeps the parsed docker configs of the auth secrets referenced by rules. Secrets are loaded on
+// first use and, once the keychain is started, refreshed from the informer whenever they change, instead of being
+// fetched and parsed for every upstream check.
+type SecretKeychain struct {
+	Client client.Client
+	// Cache provides the secret informer. Without it, secrets are fetched for every lookup.
+	Cache cache.Cache
+
+	mu       sync.Mutex
+	watching bool
+	keyrings map[types.NamespacedName]secretKeyring
+}
+
+// secretKeyring is the parsed docker config of a secret, or the reason it's unusable.
+type secretKeyring struct {
+	keyring *dockerKeyring
+	err     error
+}
+
+// Start watches the referenced secrets until the context is cancelled. It implements manager.Runnable.
+func (k *SecretKeychain) Start(ctx context.Context) error {
+	if err := k.watch(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica checks upstream itself.
+func (k *SecretKeychain) NeedLeaderElection() bool {
+	return false
+}
+
+func (k *SecretKeychain) watch(ctx context.Context) error {
+	informer, err := k.Cache.GetInformer(ctx, &corev1.Secret{})
+	if err != nil {
+		return fmt.Errorf("failed to get the secret informer: %w", err)
+	}
+	_, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if secret, ok := obj.(*corev1.Secret); ok {
+				k.refresh(client.ObjectKeyFromObject(secret), secret)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if secret, ok := obj.(*corev1.Secret); ok {
+				k.refresh(client.ObjectKeyFromObject(secret), secret)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if secret, ok := obj.(*corev1.Secret); ok {
+				k.refresh(client.ObjectKeyFromObject(secret), nil)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch secrets: %w", err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.watching = true
+	k.keyrings = map[types.NamespacedName]secretKeyring{}
+	return nil
+}
+
+// Keyring returns the parsed docker config of the secret.
+func (k *SecretKeychain) Keyring(ctx context.Context, key types.NamespacedName) (*dockerKeyring, error) {
+	k.mu.Lock()
+	entry, ok := k.keyrings[key]
+	k.mu.Unlock()
+	if ok {
+		return entry.keyring, entry.err
+	}
+
+	if k.Client == nil {
+		// e.g. the rewrite subcommand, which runs without a cluster
+		return nil, fmt.Errorf("failed to get secret %q for upstream manifests: no kubernetes client", key.Name)
+	}
+	secret := &corev1.Secret{}
+	if err := k.Client.Get(ctx, key, secret); apierrors.IsNotFound(err) {
+		secret = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get secret %q for upstream manifests: %w", key.Name, err)
+	}
+	entry = parseSecretKeyring(key, secret)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if current, ok := k.keyrings[key]; ok {
+		// the informer refreshed the secret in the meantime
+		return current.keyring, current.err
+	}
+	if k.watching {
+		k.keyrings[key] = entry
+	}
+	reportSecretKeyring(key, secretKeyring{}, entry)
+	return entry.keyring, entry.err
+}
+
+// refresh re-parses a changed secret, or records it as missing if it was deleted, if a rule references it.
+func (k *SecretKeychain) refresh(key types.NamespacedName, secret *corev1.Secret) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	previous, ok := k.keyrings[key]
+	if !ok {
+		return
+	}
+	entry := parseSecretKeyring(key, secret)
+	k.keyrings[key] = entry
+	reportSecretKeyring(key, previous, entry)
+}
+
+// reportSecretKeyring logs and updates the metric when a secret becomes unusable, or usable again.
+func reportSecretKeyring(key types.NamespacedName, previous, current secretKeyring) {
+	reason := func(err error) string {
+		if errors.Is(err, errSecretMissing) {
+			return "missing"
+		}
+		return "malformed"
+	}
+	if previous.err != nil {
+		authSecretInvalid.DeleteLabelValues(key.String(), reason(previous.err))
+	}
+	if current.err != nil {
+		authSecretInvalid.WithLabelValues(key.String(), reason(current.err)).Set(1)
+		if previous.err == nil || previous.err.Error() != current.err.Error() {
+			logger.Info(fmt.Sprintf("auth secret %s is unusable, upstream checks of rules referencing it will fail: %s", key, current.err.Error()))
+		}
+	} else if previous.err != nil {
+		logger.Info(fmt.Sprintf("auth secret %s is usable again", key))
+	}
+}
+
+func parseSecretKeyring(key types.NamespacedName, secret *corev1.Secret) secretKeyring {
+	if secret == nil {
+		return secretKeyring{err: fmt.Errorf("failed to get secret %q for upstream manifests: %w", key.Name, errSecretMissing)}
+	}
+	dockerConfigJSONBytes, dockerConfigJSONExists := secret.Data[corev1.DockerConfigJsonKey]
+	if secret.Type != corev1.SecretTypeDockerConfigJson || !dockerConfigJSONExists || len(dockerConfigJSONBytes) == 0 {
+		return secretKeyring{err: fmt.Errorf("failed to parse auth secret %q, no docker config found", key.Name)}
+	}
+	dockerConfigJSON := DockerConfigJSON{}
+	if err := json.Unmarshal(dockerConfigJSONBytes, &dockerConfigJSON); err != nil {
+		return secretKeyring{err: fmt.Errorf("failed to parse auth secret %q: %w", key.Name, err)}
+	}
+	keyring, err := newDockerKeyring(dockerConfigJSON.Auths)
+	if err != nil {
+		return secretKeyring{err: fmt.Errorf("failed to parse auth secret %q: %w", key.Name, err)}
+	}
+	return secretKeyring{keyring: keyring}
+}
+
+// dockerKeyring matches image references to the credentials of a docker config, the way the kubelet does: the keys
+// of the auths are registry hosts, with an optional scheme, port and repository path prefix, and the labels of the
+// host may be globs such as *.example.com. The key with the longest path matching the image wins.
+type dockerKeyring struct {
+	entries []dockerKeyringEntry
+}
+
+type dockerKeyringEntry struct {
+	key  string
+	host string
+	port string
+	path string
+	auth authn.AuthConfig
+}
+
+func newDockerKeyring(auths DockerConfig) (*dockerKeyring, error) {
+	keyring := &dockerKeyring{entries: make([]dockerKeyringEntry, 0, len(auths))}
+	for key, method := range auths {
+		entry, err := parseDockerKeyringKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auths key %q: %w", key, err)
+		}
+		entry.auth = authn.AuthConfig{Username: method.Username, Password: method.Password}
+		if method.Auth != "" {
+			entry.auth.Username, entry.auth.Password, err = decodeDockerConfigFieldAuth(method.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the auth field of auths key %q: %w", key, err)
+			}
+		}
+		keyring.entries = append(keyring.entries, entry)
+	}
+	sort.Slice(keyring.entries, func(i, j int) bool {
+		return keyring.entries[i].moreSpecific(keyring.entries[j])
+	})
+	return keyring, nil
+}
+
+// parseDockerKeyringKey splits an auths key such as https://*.example.com:5000/proxy/ into its host, port and path.
+func parseDockerKeyringKey(key string) (dockerKeyringEntry, error) {
+	schemeless := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	if schemeless == "" {
+		return dockerKeyringEntry{}, errors.New("empty registry")
+	}
+	parsed, err := url.Parse("https://" + schemeless)
+	if err != nil {
+		return dockerKeyringEntry{}, err
+	}
+	if parsed.Host == "" || parsed.User != nil || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return dockerKeyringEntry{}, errors.New("not a registry host and path")
+	}
+	entry := dockerKeyringEntry{key: key, host: parsed.Hostname(), port: parsed.Port(), path: strings.Trim(parsed.Path, "/")}
+	for _, label := range strings.Split(entry.host, ".") {
+		if _, err := path.Match(label, ""); err != nil {
+			return dockerKeyringEntry{}, fmt.Errorf("invalid host glob: %w", err)
+		}
+	}
+	if entry.host == legacyDockerHubHost && entry.path == "v1" {
+		// docker login writes https://index.docker.io/v1/ for docker hub
+		entry.path = ""
+	}
+	if entry.host == legacyDockerHubHost {
+		entry.host = BareRegistry
+	}
+	return entry, nil
+}
+
+// moreSpecific orders the entries by the length of the path, preferring hosts without globs and then longer hosts,
+// and falls back to the key so that the order doesn't depend on the map iteration order.
+func (e dockerKeyringEntry) moreSpecific(other dockerKeyringEntry) bool {
+	if len(e.path) != len(other.path) {
+		return len(e.path) > len(other.path)
+	}
+	if globs, otherGlobs := strings.Count(e.host, "*"), strings.Count(other.host, "*"); globs != otherGlobs {
+		return globs < otherGlobs
+	}
+	if len(e.host) != len(other.host) {
+		return len(e.host) > len(other.host)
+	}
+	return e.key < other.key
+}
+
+// matches reports whether the entry applies to the repository of an image, given as host[:port]/path.
+func (e dockerKeyringEntry) matches(host, port, repository string) bool {
+	if e.port != port {
+		return false
+	}
+	labels, hostLabels := strings.Split(e.host, "."), strings.Split(host, ".")
+	if len(labels) != len(hostLabels) {
+		return false
+	}
+	for i, label := range labels {
+		if matched, _ := path.Match(label, hostLabels[i]); !matched {
+			return false
+		}
+	}
+	return e.path == "" || repository == e.path || strings.HasPrefix(repository, e.path+"/")
+}
+
+// lookup returns the credentials matching the image reference.
+func (k *dockerKeyring) lookup(imageRef string) (authn.AuthConfig, bool) {
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return authn.AuthConfig{}, false
+	}
+	registry := ref.Context().RegistryStr()
+	if registry == legacyDockerHubHost {
+		registry = BareRegistry
+	}
+	host, port := registry, ""
+	if i := strings.LastIndex(registry, ":"); i >= 0 {
+		host, port = registry[:i], registry[i+1:]
+	}
+	repository := ref.Context().RepositoryStr()
+	for _, entry := range k.entries {
+		if entry.matches(host, port, repository) {
+			return entry.auth, true
+		}
+	}
+	return authn.AuthConfig{}, false
+}
@@ -0,0 +1,291 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func newDockerConfigSecret(t *testing.T, auths DockerConfig) *corev1.Secret {
+	dockerConfig, err := json.Marshal(DockerConfigJSON{Auths: auths})
+	require.NoError(t, err)
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "harbor-pull-secret", Namespace: "webhook"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: dockerConfig},
+	}
+}
+
+func TestSecretKeychain_Watch(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	secret := newDockerConfigSecret(t, DockerConfig{
+		"harbor.example.com": {Auth: encodeDockerConfigFieldAuth("robot$webhook", "password")},
+	})
+	gets := 0
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).WithInterceptorFuncs(interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			gets++
+			return c.Get(ctx, key, obj, opts...)
+		},
+	}).Build()
+	informers := &informertest.FakeInformers{Scheme: scheme}
+	informer, err := informers.FakeInformerFor(context.TODO(), &corev1.Secret{})
+	require.NoError(t, err)
+
+	keychain := &SecretKeychain{Client: kubeClient, Cache: informers}
+	require.NoError(t, keychain.watch(context.TODO()))
+	// other tests may have reported unusable secrets
+	reported := testutil.CollectAndCount(authSecretInvalid)
+	key := types.NamespacedName{Namespace: "webhook", Name: "harbor-pull-secret"}
+	lookup := func() (string, error) {
+		keyring, err := keychain.Keyring(context.TODO(), key)
+		if err != nil {
+			return "", err
+		}
+		auth, _ := keyring.lookup("harbor.example.com/proxy/library/nginx:1.27")
+		return auth.Password, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		password, err := lookup()
+		require.NoError(t, err)
+		require.Equal(t, "password", password)
+	}
+	require.Equal(t, 1, gets, "the secret should only be fetched once")
+
+	rotated := newDockerConfigSecret(t, DockerConfig{
+		"harbor.example.com": {Auth: encodeDockerConfigFieldAuth("robot$webhook", "rotated")},
+	})
+	informer.Update(secret, rotated)
+	password, err := lookup()
+	require.NoError(t, err)
+	require.Equal(t, "rotated", password, "the secret should be refreshed when it changes")
+
+	malformed := rotated.DeepCopy()
+	malformed.Data[corev1.DockerConfigJsonKey] = []byte("{")
+	informer.Update(rotated, malformed)
+	_, err = lookup()
+	require.Error(t, err)
+	require.Equal(t, float64(1), testutil.ToFloat64(authSecretInvalid.WithLabelValues("webhook/harbor-pull-secret", "malformed")))
+
+	informer.Delete(malformed)
+	_, err = lookup()
+	require.ErrorIs(t, err, errSecretMissing)
+	require.Equal(t, float64(1), testutil.ToFloat64(authSecretInvalid.WithLabelValues("webhook/harbor-pull-secret", "missing")))
+	require.Equal(t, reported+1, testutil.CollectAndCount(authSecretInvalid), "only the current reason should be reported")
+
+	informer.Add(secret)
+	password, err = lookup()
+	require.NoError(t, err)
+	require.Equal(t, "password", password)
+	require.Equal(t, reported, testutil.CollectAndCount(authSecretInvalid))
+	require.Equal(t, 1, gets)
+
+	// secrets which no rule references aren't parsed
+	other := secret.DeepCopy()
+	other.Name = "unrelated"
+	informer.Add(other)
+	require.Len(t, keychain.keyrings, 1)
+}
+
+func TestSecretKeychain_Malformed(t *testing.T) {
+	type testcase struct {
+		name   string
+		secret *corev1.Secret
+	}
+	opaque := newDockerConfigSecret(t, DockerConfig{"harbor.example.com": {Username: "robot", Password: "password"}})
+	opaque.Type = corev1.SecretTypeOpaque
+	tests := []testcase{
+		{
+			name:   "secret of the wrong type",
+			secret: opaque,
+		},
+		{
+			name:   "invalid auth field",
+			secret: newDockerConfigSecret(t, DockerConfig{"harbor.example.com": {Auth: "not base64!"}}),
+		},
+		{
+			name:   "invalid auths key",
+			secret: newDockerConfigSecret(t, DockerConfig{"harbor.example.com:port": {Username: "robot", Password: "password"}}),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			entry := parseSecretKeyring(client.ObjectKeyFromObject(tc.secret), tc.secret)
+			require.Error(t, entry.err)
+			require.NotErrorIs(t, entry.err, errSecretMissing)
+		})
+	}
+}
+
+func TestDockerKeyring_Lookup(t *testing.T) {
+	type testcase struct {
+		name     string
+		auths    []string
+		imageRef string
+		expected string
+	}
+	tests := []testcase{
+		{
+			name:     "host",
+			auths:    []string{"harbor.example.com"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+			expected: "harbor.example.com",
+		},
+		{
+			name:     "scheme is stripped",
+			auths:    []string{"https://harbor.example.com"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+			expected: "https://harbor.example.com",
+		},
+		{
+			name:     "http scheme and trailing slash",
+			auths:    []string{"http://harbor.example.com/"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+			expected: "http://harbor.example.com/",
+		},
+		{
+			name:     "dots are not wildcards",
+			auths:    []string{"harbor.example.com"},
+			imageRef: "harbor-example-com.evil.io/proxy/library/nginx:1.27",
+		},
+		{
+			name:     "host is not a substring match",
+			auths:    []string{"example.com"},
+			imageRef: "harbor.example.com.evil.io/proxy/library/nginx:1.27",
+		},
+		{
+			name:     "regex metacharacters are literal",
+			auths:    []string{"harbor.example.com/(proxy"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+		},
+		{
+			name:     "port must match",
+			auths:    []string{"harbor.example.com:5000"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+		},
+		{
+			name:     "image port must match",
+			auths:    []string{"harbor.example.com"},
+			imageRef: "harbor.example.com:5000/proxy/library/nginx:1.27",
+		},
+		{
+			name:     "host and port",
+			auths:    []string{"harbor.example.com", "harbor.example.com:5000"},
+			imageRef: "harbor.example.com:5000/proxy/library/nginx:1.27",
+			expected: "harbor.example.com:5000",
+		},
+		{
+			name:     "path prefix",
+			auths:    []string{"harbor.example.com/proxy"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+			expected: "harbor.example.com/proxy",
+		},
+		{
+			name:     "path prefix matches whole path segments",
+			auths:    []string{"harbor.example.com/proxy"},
+			imageRef: "harbor.example.com/proxy-other/library/nginx:1.27",
+		},
+		{
+			name:     "path prefix matches the repository itself",
+			auths:    []string{"harbor.example.com/proxy/library/nginx/"},
+			imageRef: "harbor.example.com/proxy/library/nginx@sha256:2d2f20c7ebd4d8b5e2d1e5d1c6f8a4a0b7b9b1c0e2b9ee6a4cd7e0a1b1c2d3e4",
+			expected: "harbor.example.com/proxy/library/nginx/",
+		},
+		{
+			name:     "wildcard subdomain",
+			auths:    []string{"*.example.com"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+			expected: "*.example.com",
+		},
+		{
+			name:     "wildcard matches a single label",
+			auths:    []string{"*.example.com"},
+			imageRef: "harbor.eu.example.com/proxy/library/nginx:1.27",
+		},
+		{
+			name:     "wildcard doesn't match the apex",
+			auths:    []string{"*.example.com"},
+			imageRef: "example.com/proxy/library/nginx:1.27",
+		},
+		{
+			name:     "wildcard label prefix",
+			auths:    []string{"harbor-*.example.com"},
+			imageRef: "harbor-eu.example.com/proxy/library/nginx:1.27",
+			expected: "harbor-*.example.com",
+		},
+		{
+			name:     "exact host wins over wildcard",
+			auths:    []string{"*.example.com", "harbor.example.com"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+			expected: "harbor.example.com",
+		},
+		{
+			name:     "longest path wins",
+			auths:    []string{"harbor.example.com", "harbor.example.com/proxy/library", "harbor.example.com/proxy"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+			expected: "harbor.example.com/proxy/library",
+		},
+		{
+			name:     "wildcard with a path wins over host",
+			auths:    []string{"harbor.example.com", "*.example.com/proxy"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+			expected: "*.example.com/proxy",
+		},
+		{
+			name:     "equally specific keys are ordered by key",
+			auths:    []string{"https://harbor.example.com", "harbor.example.com", "http://harbor.example.com"},
+			imageRef: "harbor.example.com/proxy/library/nginx:1.27",
+			expected: "harbor.example.com",
+		},
+		{
+			name:     "docker hub legacy key",
+			auths:    []string{"https://index.docker.io/v1/"},
+			imageRef: "nginx:1.27",
+			expected: "https://index.docker.io/v1/",
+		},
+		{
+			name:     "docker hub",
+			auths:    []string{"docker.io"},
+			imageRef: "docker.io/library/nginx:1.27",
+			expected: "docker.io",
+		},
+		{
+			name:     "no match",
+			auths:    []string{"harbor.example.com", "*.example.com"},
+			imageRef: "quay.io/prometheus/prometheus:v3.0.0",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			auths := DockerConfig{}
+			for _, key := range tc.auths {
+				auths[key] = dockerConfigEntryWithAuth{Username: key, Password: "password"}
+			}
+			// the result must not depend on the map iteration order
+			for i := 0; i < 10; i++ {
+				keyring, err := newDockerKeyring(auths)
+				require.NoError(t, err)
+				auth, found := keyring.lookup(tc.imageRef)
+				require.Equal(t, tc.expected != "", found)
+				require.Equal(t, tc.expected, auth.Username)
+			}
+		})
+	}
+}
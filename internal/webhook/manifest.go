@@ -1,5 +1,7 @@
 package webhook
 
+import "strings"
+
 // slimManifest is a partial representation of the oci manifest to access the mediaType.
 type slimManifest struct {
 	MediaType string `json:"mediaType"`
@@ -8,6 +10,14 @@ type slimManifest struct {
 type platform struct {
 	Architecture string `json:"architecture"`
 	OS           string `json:"os"`
+	Variant      string `json:"variant"`
+}
+
+// matches returns whether the platform is the os/arch or os/arch/variant of a rule, where os/arch matches any variant.
+func (p platform) matches(rulePlatform string) bool {
+	os, arch, _ := strings.Cut(rulePlatform, "/")
+	arch, variant, hasVariant := strings.Cut(arch, "/")
+	return p.OS == os && p.Architecture == arch && (!hasVariant || p.Variant == variant)
 }
 
 // indexManifest is a partial representation of the sub manifest present in a manifest list.
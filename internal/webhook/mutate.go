@@ -5,31 +5,293 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/audit"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
+const (
+	// AnnotationWouldRewrite records the images that rules in audit mode would have rewritten, as a JSON object of
+	// container names to rewritten images.
+	AnnotationWouldRewrite = "harbor-container-webhook/would-rewrite"
+	// AnnotationOriginalImages records the images of rewritten containers before they were rewritten, as a JSON
+	// object of container names to OriginalImage.
+	AnnotationOriginalImages = "harbor-container-webhook/original-images"
+	// AnnotationDisabledContainers is a comma separated list of container names whose images must not be rewritten,
+	// or * for every container.
+	AnnotationDisabledContainers = "harbor-container-webhook/disabled-containers"
+	// AnnotationForceRules is a JSON object of container names, or * for every container, to the name of the only
+	// rule which is evaluated for their images.
+	AnnotationForceRules = "harbor-container-webhook/force-rules"
+	// AnnotationSkipUpstreamCheck is a comma separated list of container names, or * for every container, whose
+	// rewritten images aren't checked in the upstream registry even if the rule enables checkUpstream.
+	AnnotationSkipUpstreamCheck = "harbor-container-webhook/skip-upstream-check"
+
+	// allContainers matches every container in the opt-out annotations.
+	allContainers = "*"
+)
+
+// OriginalImage records a rewritten container image, in the AnnotationOriginalImages annotation.
+type OriginalImage struct {
+	// Image is the image of the container before it was rewritten.
+	Image string `json:"image"`
+	// Rule is the name of the rule which rewrote the image.
+	Rule string `json:"rule"`
+	// Rewritten is the image the container was rewritten to.
+	Rewritten string `json:"rewritten"`
+}
+
 var (
 	logger = ctrl.Log.WithName("mutator")
+
+	auditRewrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hcw",
+		Subsystem: "rules",
+		Name:      "audit_rewrites",
+		Help:      "images this rule would have rewritten if it were not in audit mode",
+	}, []string{"name"})
+	fallbackRewrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hcw",
+		Subsystem: "rules",
+		Name:      "fallback_rewrites",
+		Help:      "images this rule rewrote to one of its fallbacks, or kept at the origin, instead of its replace registry",
+	}, []string{"name"})
 )
 
-// PodContainerProxier mutates init containers and containers to redirect them to the harbor proxy cache if one exists.
+func init() {
+	metrics.Registry.MustRegister(auditRewrites, fallbackRewrites)
+}
+
+// podRequest describes the admission request of a pod or pod template.
+type podRequest struct {
+	namespace Namespace
+	// dryRun requests must not have side effects, so image pull secrets aren't copied into the namespace.
+	dryRun bool
+	// injectPullSecrets is set if image pull secrets may be added to the pod spec, which pod updates can't change.
+	injectPullSecrets bool
+	// skipUpstreamCheck rewrites the images of every container without checking they exist in the upstream registry.
+	skipUpstreamCheck bool
+	// explain receives the decision of each rule evaluated for the image of a container, if set.
+	explain func(container string, decision RuleDecision)
+	// warnings collects the admission warnings of the request, if set.
+	warnings *admissionWarnings
+	// events records the events of the request, if set.
+	events *podEvents
+	// audit logs the decision of each container, if set.
+	audit *admissionAudit
+}
+
+// podMutation collects the state of rewriting the containers of a single pod or pod template.
+type podMutation struct {
+	request podRequest
+	// previous are the containers already rewritten, from the annotations of the pod.
+	previous map[string]OriginalImage
+	// originals maps container names to their image before this or a previous admission rewrote it.
+	originals map[string]OriginalImage
+	// wouldRewrite maps container names to the images rules in audit mode would have rewritten them to.
+	wouldRewrite map[string]string
+	// pullSecrets are the image pull secrets of the rules which rewrote containers.
+	pullSecrets map[types.NamespacedName]bool
+
+	// disabled, forceRules and skipUpstream are the opt-outs of the pod annotations, keyed by container name or *.
+	disabled     map[string]bool
+	forceRules   map[string]string
+	skipUpstream map[string]bool
+}
+
+func newPodMutation(request podRequest, meta *metav1.ObjectMeta) *podMutation {
+	mutation := &podMutation{
+		request:      request,
+		previous:     map[string]OriginalImage{},
+		originals:    map[string]OriginalImage{},
+		wouldRewrite: map[string]string{},
+		pullSecrets:  map[types.NamespacedName]bool{},
+	}
+	if previous, ok := meta.Annotations[AnnotationOriginalImages]; ok {
+		if err := json.Unmarshal([]byte(previous), &mutation.previous); err != nil {
+			logger.Info(fmt.Sprintf("ignoring malformed %s annotation on %s/%s: %s", AnnotationOriginalImages, meta.Namespace, meta.Name, err.Error()))
+			request.warnings.add(false, "ignoring malformed %s annotation: %s", AnnotationOriginalImages, err.Error())
+		}
+	}
+	mutation.disabled = containerSet(meta.Annotations[AnnotationDisabledContainers])
+	mutation.skipUpstream = containerSet(meta.Annotations[AnnotationSkipUpstreamCheck])
+	if forceRules, ok := meta.Annotations[AnnotationForceRules]; ok {
+		if err := json.Unmarshal([]byte(forceRules), &mutation.forceRules); err != nil {
+			logger.Info(fmt.Sprintf("ignoring malformed %s annotation on %s/%s: %s", AnnotationForceRules, meta.Namespace, meta.Name, err.Error()))
+			request.warnings.add(false, "ignoring malformed %s annotation: %s", AnnotationForceRules, err.Error())
+		}
+	}
+	return mutation
+}
+
+// containerSet parses a comma separated list of container names.
+func containerSet(value string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// options returns the rule evaluation options of the container, from the opt-out annotations of the pod.
+func (m *podMutation) options(name string) rewriteOptions {
+	rule, ok := m.forceRules[name]
+	if !ok {
+		rule = m.forceRules[allContainers]
+	}
+	options := rewriteOptions{
+		rule:              rule,
+		skipUpstreamCheck: m.request.skipUpstreamCheck || m.skipUpstream[name] || m.skipUpstream[allContainers],
+		container:         name,
+		warnings:          m.request.warnings,
+		events:            m.request.events,
+	}
+	if m.request.explain != nil {
+		options.explain = func(decision RuleDecision) {
+			m.request.explain(name, decision)
+		}
+	}
+	return options
+}
+
+// rewritten returns if the container image was already rewritten by a previous admission of the pod, such as a
+// reinvocation of the webhook or an update, and records it as rewritten again. The annotation can be written by
+// anyone creating the pod, so it's only trusted if the rule of the container applies to the namespace and still
+// rewrites the original image to the image of the container.
+func (m *podMutation) rewritten(name, image string, transformers []ContainerTransformer) bool {
+	previous, ok := m.previous[name]
+	if !ok || previous.Rewritten != image {
+		return false
+	}
+	if !rewrittenBy(transformers, m.request.namespace, previous) {
+		logger.Info(fmt.Sprintf("ignoring the %s annotation of container %q, rule %q doesn't rewrite %q to %q in namespace %q",
+			AnnotationOriginalImages, name, previous.Rule, previous.Image, previous.Rewritten, m.request.namespace.Name))
+		return false
+	}
+	m.originals[name] = previous
+	return true
+}
+
+// rewrittenBy returns if the rule of the original image applies to the namespace, and rewrites the image to the
+// rewritten image, to its fallbacks, or to either pinned to a digest.
+func rewrittenBy(transformers []ContainerTransformer, namespace Namespace, original OriginalImage) bool {
+	for _, transformer := range transformers {
+		if transformer.Name() != original.Rule {
+			continue
+		}
+		if !transformer.AppliesTo(namespace) || transformer.Audit() {
+			return false
+		}
+		candidates, err := transformer.Fallbacks(original.Image)
+		if err != nil {
+			return false
+		}
+		rewritten := original.Image
+		if t, ok := transformer.(*ruleTransformer); ok {
+			// not counted in the rewrite metrics
+			_, rewritten, err = t.doRewriteImage(original.Image)
+		} else {
+			rewritten, err = transformer.RewriteImage(original.Image)
+		}
+		if err != nil {
+			return false
+		}
+		for _, candidate := range append(candidates, rewritten) {
+			if candidate != original.Image && (original.Rewritten == candidate || strings.HasPrefix(original.Rewritten, candidate+"@")) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// annotate records the mutation in the pod annotations, and reports if they were changed.
+func (m *podMutation) annotate(meta *metav1.ObjectMeta) (bool, error) {
+	originalsChanged, err := setJSONAnnotation(meta, AnnotationOriginalImages, m.originals)
+	if err != nil {
+		return false, err
+	}
+	// would-rewrite annotations are only added, so the impact of audit rules is still visible after an update
+	if len(m.wouldRewrite) == 0 {
+		return originalsChanged, nil
+	}
+	wouldRewriteChanged, err := setJSONAnnotation(meta, AnnotationWouldRewrite, m.wouldRewrite)
+	if err != nil {
+		return false, err
+	}
+	return originalsChanged || wouldRewriteChanged, nil
+}
+
+// setJSONAnnotation sets the annotation to the JSON encoded value, or removes it if the value is empty, and reports
+// if the annotations were changed.
+func setJSONAnnotation[V any](meta *metav1.ObjectMeta, key string, value map[string]V) (bool, error) {
+	current, exists := meta.Annotations[key]
+	if len(value) == 0 {
+		if !exists {
+			return false, nil
+		}
+		delete(meta.Annotations, key)
+		return true, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	if exists && current == string(encoded) {
+		return false, nil
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[key] = string(encoded)
+	return true, nil
+}
+
+// PodContainerProxier mutates init containers, containers and ephemeral containers to redirect them to the harbor
+// proxy cache if one exists.
 type PodContainerProxier struct {
-	Client       client.Client
-	Decoder      admission.Decoder
+	Client  client.Client
+	Decoder admission.Decoder
+	// Transformers are the initial transformers, use SetTransformers to replace them while handling requests.
 	Transformers []ContainerTransformer
-	Verbose      bool
+	// Health tracks the registries failing upstream checks, which rules with fallbacks skip.
+	Health  *RegistryHealth
+	Verbose bool
+	// Warnings is the verbosity of the admission warnings about skipped or degraded rewrites, one of
+	// config.WarningsNone, config.WarningsDegraded (the default) or config.WarningsAll.
+	Warnings string
+	// Events records the rewrites and their failures as Kubernetes events, if set.
+	Events *EventRecorder
+	// Audit logs the decision of every container of every admission, if set.
+	Audit *audit.Logger
+
+	mu sync.RWMutex
 
 	// kube config settings
 	KubeClientBurst int
 	KubeClientQPS   float32
 }
 
-// Handle mutates init containers and containers.
+// Handle mutates init containers, containers and ephemeral containers. Ephemeral containers are added through the
+// pods/ephemeralcontainers subresource, whose admission requests also carry the full pod.
 func (p *PodContainerProxier) Handle(ctx context.Context, req admission.Request) admission.Response {
 	pod := &corev1.Pod{}
 
@@ -38,25 +300,115 @@ func (p *PodContainerProxier) Handle(ctx context.Context, req admission.Request)
 		return admission.Errored(http.StatusBadRequest, err)
 	}
 
-	initContainers, updatedInit, err := p.updateContainers(ctx, pod.Spec.InitContainers, "init")
-	if err != nil {
-		return admission.Errored(http.StatusInternalServerError, err)
+	request := podRequest{
+		namespace: p.lookupNamespace(ctx, req.Namespace),
+		dryRun:    req.DryRun != nil && *req.DryRun,
+		// the image pull secrets of existing pods can't be changed
+		injectPullSecrets: req.Operation == admissionv1.Create && req.SubResource == "",
+		warnings:          newAdmissionWarnings(p.Warnings),
 	}
-	containers, updated, err := p.updateContainers(ctx, pod.Spec.Containers, "normal")
+	if !request.dryRun {
+		request.events = newPodEvents(p.Events, req.Kind, pod, req.Namespace)
+	}
+	request.audit = newAdmissionAudit(p.Audit, req, pod)
+	meta := &pod.ObjectMeta
+	if req.SubResource != "" {
+		// the api server only accepts changes to the ephemeral containers through the subresource
+		meta = pod.ObjectMeta.DeepCopy()
+	}
+	updated, err := p.updatePodSpec(ctx, request, meta, &pod.Spec)
 	if err != nil {
+		request.events.record(corev1.EventTypeWarning, EventReasonRewriteFailed, "failed to rewrite the images of a pod: %s", err.Error())
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
-	if !updated && !updatedInit {
-		return admission.Allowed("no updates")
+	if !updated {
+		return admission.Allowed("no updates").WithWarnings(request.warnings.list()...)
 	}
-	pod.Spec.InitContainers = initContainers
-	pod.Spec.Containers = containers
 
 	marshaledPod, err := json.Marshal(pod)
 	if err != nil {
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
-	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod).WithWarnings(request.warnings.list()...)
+}
+
+// updatePodSpec rewrites the images of every container in the pod spec in place, adds the image pull secrets of the
+// rules which rewrote them, annotates the pod metadata with the original images and any rewrites made by rules in
+// audit mode, and reports if any were changed.
+func (p *PodContainerProxier) updatePodSpec(ctx context.Context, request podRequest, meta *metav1.ObjectMeta, spec *corev1.PodSpec) (bool, error) {
+	mutation := newPodMutation(request, meta)
+	initContainers, updatedInit, err := p.updateContainers(ctx, mutation, spec.InitContainers, "init")
+	if err != nil {
+		return false, err
+	}
+	containers, updated, err := p.updateContainers(ctx, mutation, spec.Containers, "normal")
+	if err != nil {
+		return false, err
+	}
+	ephemeralContainers, updatedEphemeral, err := p.updateEphemeralContainers(ctx, mutation, spec.EphemeralContainers)
+	if err != nil {
+		return false, err
+	}
+	annotated, err := mutation.annotate(meta)
+	if err != nil {
+		return false, err
+	}
+	pullSecretsAdded := false
+	if request.injectPullSecrets {
+		pullSecretsAdded = p.injectPullSecrets(ctx, request, mutation, spec)
+	}
+	if !updated && !updatedInit && !updatedEphemeral && !annotated && !pullSecretsAdded {
+		return false, nil
+	}
+	spec.InitContainers = initContainers
+	spec.Containers = containers
+	spec.EphemeralContainers = ephemeralContainers
+	return true, nil
+}
+
+// injectPullSecrets copies the image pull secrets of the rules which rewrote containers into the namespace, unless the
+// request is a dry run, and adds them to the pod spec. Secrets which fail to be copied are logged and not added, so
+// the pod can still pull the images which don't need them.
+func (p *PodContainerProxier) injectPullSecrets(ctx context.Context, request podRequest, mutation *podMutation, spec *corev1.PodSpec) bool {
+	secrets := make([]types.NamespacedName, 0, len(mutation.pullSecrets))
+	for secret := range mutation.pullSecrets {
+		secrets = append(secrets, secret)
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].String() < secrets[j].String()
+	})
+
+	added := false
+	for _, secret := range secrets {
+		if !request.dryRun {
+			if err := ensurePullSecret(ctx, p.Client, secret, request.namespace.Name); err != nil {
+				logger.Info(fmt.Sprintf("not adding image pull secret %s to the pod: %s", secret, err.Error()))
+				request.warnings.add(false, "image pull secret %q wasn't added, the rewritten images may fail to pull", secret.Name)
+				pullSecretErrors.WithLabelValues(secret.String()).Inc()
+				continue
+			}
+		}
+		if addImagePullSecret(spec, secret.Name) {
+			added = true
+		}
+	}
+	return added
+}
+
+// lookupNamespace returns the namespace of the request with its labels, for rules scoped by a namespace selector.
+// If the labels can't be looked up, rules with a namespace selector won't match.
+func (p *PodContainerProxier) lookupNamespace(ctx context.Context, name string) Namespace {
+	namespace := Namespace{Name: name}
+	if p.Client == nil || name == "" {
+		return namespace
+	}
+	ns := corev1.Namespace{}
+	if err := p.Client.Get(ctx, client.ObjectKey{Name: name}, &ns); err != nil {
+		logger.Info(fmt.Sprintf("failed to lookup namespace %q labels, namespace selectors will not match: %s", name, err.Error()))
+		return namespace
+	}
+	namespace.Labels = ns.Labels
+	return namespace
 }
 
 func (p *PodContainerProxier) lookupNodeArchAndOS(ctx context.Context, restClient client.Client, nodeName string) (platform, os string, err error) {
@@ -68,20 +420,38 @@ func (p *PodContainerProxier) lookupNodeArchAndOS(ctx context.Context, restClien
 	return node.Status.NodeInfo.Architecture, node.Status.NodeInfo.OperatingSystem, nil
 }
 
-func (p *PodContainerProxier) updateContainers(ctx context.Context, containers []corev1.Container, kind string) ([]corev1.Container, bool, error) {
+func (p *PodContainerProxier) updateContainers(ctx context.Context, mutation *podMutation, containers []corev1.Container, kind string) ([]corev1.Container, bool, error) {
 	containersReplacement := make([]corev1.Container, 0, len(containers))
 	updated := false
 	for i := range containers {
 		container := containers[i]
-		imageRef, err := p.rewriteImage(ctx, container.Image)
+		imageRef, err := p.updateContainer(ctx, mutation, container.Name, container.Image, kind)
 		if err != nil {
 			return []corev1.Container{}, false, err
 		}
 		if !updated {
 			updated = imageRef != container.Image
 		}
+		container.Image = imageRef
+		containersReplacement = append(containersReplacement, container)
+	}
+	return containersReplacement, updated, nil
+}
+
+func (p *PodContainerProxier) updateEphemeralContainers(ctx context.Context, mutation *podMutation, containers []corev1.EphemeralContainer) ([]corev1.EphemeralContainer, bool, error) {
+	if len(containers) == 0 {
+		return containers, false, nil
+	}
+	containersReplacement := make([]corev1.EphemeralContainer, 0, len(containers))
+	updated := false
+	for i := range containers {
+		container := containers[i]
+		imageRef, err := p.updateContainer(ctx, mutation, container.Name, container.Image, "ephemeral")
+		if err != nil {
+			return []corev1.EphemeralContainer{}, false, err
+		}
 		if imageRef != container.Image {
-			logger.Info(fmt.Sprintf("rewriting the image of %q from %q to %q", container.Name, container.Image, imageRef))
+			updated = true
 		}
 		container.Image = imageRef
 		containersReplacement = append(containersReplacement, container)
@@ -89,25 +459,297 @@ func (p *PodContainerProxier) updateContainers(ctx context.Context, containers [
 	return containersReplacement, updated, nil
 }
 
-func (p *PodContainerProxier) rewriteImage(ctx context.Context, imageRef string) (string, error) {
-	for _, transformer := range p.Transformers {
+// updateContainer returns the image the container should use. Images already rewritten by a previous admission are
+// kept as is, and rewrites by rules in audit mode are only recorded in the mutation. The decision is logged to the
+// audit log of the request, if set.
+func (p *PodContainerProxier) updateContainer(ctx context.Context, mutation *podMutation, name, image, kind string) (rewritten string, err error) {
+	options := mutation.options(name)
+	record := audit.Record{Container: name, ContainerType: kind, OriginalImage: image, Decision: audit.DecisionUnchanged}
+	if mutation.request.audit != nil {
+		start := time.Now()
+		options.upstreamChecks = &record.UpstreamChecks
+		defer func() {
+			record.FinalImage = rewritten
+			if err != nil {
+				record.FinalImage, record.Decision, record.Error = image, audit.DecisionError, err.Error()
+			}
+			mutation.request.audit.log(record, start)
+		}()
+	}
+	if mutation.rewritten(name, image, p.transformers()) {
+		rule := mutation.previous[name].Rule
+		options.note(rule, "already rewritten from %q by a previous admission", mutation.previous[name].Image)
+		record.OriginalImage, record.Rule, record.Decision = mutation.previous[name].Image, rule, audit.DecisionPreviouslyRewritten
+		p.recordPullSecret(mutation, rule)
+		return image, nil
+	}
+	if mutation.disabled[name] || mutation.disabled[allContainers] {
+		record.Decision = audit.DecisionDisabled
+		logger.Info(fmt.Sprintf("skipping %s container %q, rewriting is disabled by the %s annotation", kind, name, AnnotationDisabledContainers))
+		options.note("", "rewriting is disabled by the %s annotation", AnnotationDisabledContainers)
+		options.warn(true, "image %q not rewritten, rewriting is disabled by the %s annotation", image, AnnotationDisabledContainers)
+		return image, nil
+	}
+	result, err := p.rewriteImage(ctx, mutation.request.namespace, image, options)
+	if err != nil {
+		return "", err
+	}
+	if would := result.audit; would != nil {
+		logger.Info(fmt.Sprintf("audit: would rewrite the image of %s container %q from %q to %q", kind, name, image, would.image))
+		auditRewrites.WithLabelValues(would.metricName).Inc()
+		options.warn(true, "image %q would be rewritten to %q by rule %q, which is in audit mode", image, would.image, would.rule)
+		mutation.wouldRewrite[name] = would.image
+		record.WouldRewrite, record.Rule, record.Decision = would.image, would.rule, audit.DecisionAudit
+	}
+	if result.image == image {
+		return image, nil
+	}
+	logger.Info(fmt.Sprintf("rewriting the image of %s container %q from %q to %q", kind, name, image, result.image))
+	options.events.record(corev1.EventTypeNormal, EventReasonRewritten, "rewrote the image of container %q from %q to %q with rule %q", name, image, result.image, result.rule)
+	mutation.originals[name] = OriginalImage{Image: image, Rule: result.rule, Rewritten: result.image}
+	record.Rule, record.Decision = result.rule, audit.DecisionRewritten
+	p.recordPullSecret(mutation, result.rule)
+	return result.image, nil
+}
+
+// recordPullSecret records the image pull secret of the rule, if it has one, to be added to the pod.
+func (p *PodContainerProxier) recordPullSecret(mutation *podMutation, rule string) {
+	for _, transformer := range p.transformers() {
+		if transformer.Name() != rule {
+			continue
+		}
+		if secret := transformer.ImagePullSecret(); secret.Name != "" {
+			mutation.pullSecrets[secret] = true
+		}
+		return
+	}
+}
+
+// SetTransformers atomically replaces the transformers used for subsequent requests.
+func (p *PodContainerProxier) SetTransformers(transformers []ContainerTransformer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Transformers = transformers
+	p.Health.SetRegistries(transformerRegistries(transformers))
+}
+
+// transformerRegistries returns the distinct registries the transformers rewrite images to.
+func transformerRegistries(transformers []ContainerTransformer) []string {
+	seen := map[string]bool{}
+	registries := []string{}
+	for _, transformer := range transformers {
+		for _, registry := range transformer.Registries() {
+			if !seen[registry] {
+				seen[registry] = true
+				registries = append(registries, registry)
+			}
+		}
+	}
+	return registries
+}
+
+func (p *PodContainerProxier) transformers() []ContainerTransformer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Transformers
+}
+
+// rewriteResult is the outcome of evaluating the rules against an image.
+type rewriteResult struct {
+	// image is the rewritten image, or the original image if no rule rewrote it.
+	image string
+	// rule is the name of the rule which rewrote the image.
+	rule string
+	// metricName is the metric label of the rule which rewrote the image.
+	metricName string
+	// audit is the rewrite of the first rule in audit mode which matched the image, which is only recorded, if any.
+	audit *rewriteResult
+}
+
+// rewriteOptions override the rule evaluation for a single container.
+type rewriteOptions struct {
+	// rule is the name of the only rule to evaluate, if set.
+	rule string
+	// skipUpstreamCheck rewrites images without checking they exist in the upstream registry.
+	skipUpstreamCheck bool
+	// explain receives the decision of each evaluated rule, if set.
+	explain func(decision RuleDecision)
+	// container is the name of the container whose image is rewritten, for the admission warnings.
+	container string
+	// warnings collects the admission warnings about the image, if set.
+	warnings *admissionWarnings
+	// events records the events about the image, if set.
+	events *podEvents
+	// upstreamChecks collects the upstream checks of the rewritten images for the audit log, if set.
+	upstreamChecks *[]audit.UpstreamCheck
+}
+
+// note reports the decision of a rule to the explain callback, if set.
+func (o rewriteOptions) note(rule, format string, args ...interface{}) {
+	if o.explain != nil {
+		o.explain(RuleDecision{Rule: rule, Reason: fmt.Sprintf(format, args...)})
+	}
+}
+
+// checked records the result of an upstream check for the audit log, if set.
+func (o rewriteOptions) checked(image, result string, err error) {
+	if o.upstreamChecks == nil {
+		return
+	}
+	check := audit.UpstreamCheck{Image: image, Result: result}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	*o.upstreamChecks = append(*o.upstreamChecks, check)
+}
+
+// warn adds an admission warning about the image of the container, if warnings of the verbosity are enabled.
+func (o rewriteOptions) warn(verbose bool, format string, args ...interface{}) {
+	o.warnings.add(verbose, "container %q: %s", o.container, fmt.Sprintf(format, args...))
+}
+
+// rewriteImage evaluates the rules in order against the image, and returns the rewrite of the first rule in enforce
+// mode which rewrites it. Rules in audit mode don't stop the evaluation, so they have no effect on the rewrite, and
+// only the first of them which would rewrite the image is returned, as it would be the one to apply.
+func (p *PodContainerProxier) rewriteImage(ctx context.Context, namespace Namespace, imageRef string, options rewriteOptions) (rewriteResult, error) {
+	forcedRuleFound := false
+	var wouldRewrite *rewriteResult
+	for _, transformer := range p.transformers() {
+		if options.rule != "" {
+			if transformer.Name() != options.rule {
+				options.note(transformer.Name(), "not evaluated, the %s annotation forces the rule %q", AnnotationForceRules, options.rule)
+				continue
+			}
+			forcedRuleFound = true
+		}
+		if !transformer.AppliesTo(namespace) {
+			options.note(transformer.Name(), "doesn't apply to the namespace %q", namespace.Name)
+			continue
+		}
 		updatedRef, err := transformer.RewriteImage(imageRef)
 		if err != nil {
-			return "", fmt.Errorf("transformer %q failed to update imageRef %q: %w", transformer.Name(), imageRef, err)
+			return rewriteResult{}, fmt.Errorf("transformer %q failed to update imageRef %q: %w", transformer.Name(), imageRef, err)
 		}
-		if updatedRef != imageRef {
-			if found, err := transformer.CheckUpstream(ctx, updatedRef); err != nil {
-				logger.Info(fmt.Sprintf("transformer %q skipping rewriting %q to %q, could not fetch image manifest: %s", transformer.Name(), imageRef, updatedRef, err.Error()))
+		if updatedRef == imageRef {
+			if options.explain != nil || options.warnings.enabled(true) {
+				reason, excluded := noMatchReason(transformer, imageRef)
+				options.note(transformer.Name(), "%s", reason)
+				if excluded {
+					options.warn(true, "image %q not rewritten by rule %q, %s", imageRef, transformer.Name(), reason)
+				}
+			}
+			continue
+		}
+		fallbacks, err := transformer.Fallbacks(imageRef)
+		if err != nil {
+			return rewriteResult{}, fmt.Errorf("transformer %q failed to update imageRef %q for its fallbacks: %w", transformer.Name(), imageRef, err)
+		}
+		candidates := append([]string{updatedRef}, fallbacks...)
+		for i, candidate := range candidates {
+			if candidate == imageRef && transformer.Audit() {
+				options.note(transformer.Name(), "would keep the image, falling back to the origin, the rule is in audit mode")
+				break
+			}
+			if candidate == imageRef {
+				logger.Info(fmt.Sprintf("transformer %q keeping %q, falling back to the origin", transformer.Name(), imageRef))
+				options.note(transformer.Name(), "kept the image, falling back to the origin")
+				options.warn(false, "image %q not rewritten by rule %q, falling back to the origin", imageRef, transformer.Name())
+				fallbackRewrites.WithLabelValues(metricName(transformer.Name())).Inc()
+				return rewriteResult{image: imageRef, audit: wouldRewrite}, nil
+			}
+			// unless the rule skips unhealthy registries, the last candidate is tried even if its registry is
+			// unhealthy, like rules without fallbacks
+			if (i < len(candidates)-1 || transformer.SkipUnhealthy()) && !p.registryHealthy(candidate) {
+				logger.Info(fmt.Sprintf("transformer %q skipping rewriting %q to %q, the registry is unhealthy", transformer.Name(), imageRef, candidate))
+				options.note(transformer.Name(), "skipped rewriting to %q, the registry is unhealthy", candidate)
+				options.warn(false, "image %q not rewritten to %q by rule %q, the registry is unhealthy", imageRef, candidate, transformer.Name())
 				continue
-			} else if !found {
-				logger.Info(fmt.Sprintf("transformer %q skipping rewriting %q to %q, registry reported image not found.", transformer.Name(), imageRef, updatedRef))
+			}
+			rewrittenRef, ok, err := p.checkUpstream(ctx, transformer, imageRef, candidate, options)
+			if err != nil {
+				return rewriteResult{}, err
+			}
+			if !ok {
 				continue
 			}
-			logger.Info(fmt.Sprintf("transformer %q rewriting %q to %q", transformer.Name(), imageRef, updatedRef))
-			return updatedRef, nil
+			if i > 0 {
+				logger.Info(fmt.Sprintf("transformer %q falling back to %q for %q", transformer.Name(), candidate, imageRef))
+				fallbackRewrites.WithLabelValues(metricName(transformer.Name())).Inc()
+				options.warn(false, "image %q rewritten to the fallback %q by rule %q", imageRef, rewrittenRef, transformer.Name())
+			}
+			result := rewriteResult{
+				image:      rewrittenRef,
+				rule:       transformer.Name(),
+				metricName: metricName(transformer.Name()),
+			}
+			if transformer.Audit() {
+				options.note(transformer.Name(), "would rewrite to %q, the rule is in audit mode", rewrittenRef)
+				if wouldRewrite == nil {
+					wouldRewrite = &result
+				}
+				break
+			}
+			logger.Info(fmt.Sprintf("transformer %q rewriting %q to %q", transformer.Name(), imageRef, rewrittenRef))
+			options.note(transformer.Name(), "rewrote to %q", rewrittenRef)
+			result.audit = wouldRewrite
+			return result, nil
 		}
 	}
-	return imageRef, nil
+	if options.rule != "" && !forcedRuleFound {
+		logger.Info(fmt.Sprintf("not rewriting %q, the rule %q forced by the %s annotation doesn't exist", imageRef, options.rule, AnnotationForceRules))
+		options.note(options.rule, "the rule forced by the %s annotation doesn't exist", AnnotationForceRules)
+		options.warn(false, "image %q not rewritten, the rule %q forced by the %s annotation doesn't exist", imageRef, options.rule, AnnotationForceRules)
+	}
+	return rewriteResult{image: imageRef, audit: wouldRewrite}, nil
+}
+
+// checkUpstream checks the rewritten image in the upstream registry, unless skipped by the annotations of the pod, and
+// returns it pinned to its digest if the rule pins digests. It returns false if the image can't be used.
+func (p *PodContainerProxier) checkUpstream(ctx context.Context, transformer ContainerTransformer, imageRef, updatedRef string, options rewriteOptions) (string, bool, error) {
+	if options.skipUpstreamCheck {
+		logger.Info(fmt.Sprintf("transformer %q not checking upstream for %q, skipped by the %s annotation", transformer.Name(), updatedRef, AnnotationSkipUpstreamCheck))
+		options.checked(updatedRef, audit.UpstreamSkipped, nil)
+		return updatedRef, true, nil
+	}
+	upstreamImage, err := transformer.CheckUpstream(ctx, updatedRef)
+	if err != nil {
+		logger.Info(fmt.Sprintf("transformer %q skipping rewriting %q to %q, could not fetch image manifest: %s", transformer.Name(), imageRef, updatedRef, err.Error()))
+		options.checked(updatedRef, audit.UpstreamError, err)
+		options.note(transformer.Name(), "skipped rewriting to %q, could not fetch the image manifest: %s", updatedRef, err.Error())
+		options.warn(false, "image %q not rewritten to %q by rule %q, could not fetch the image manifest: %s", imageRef, updatedRef, transformer.Name(), err.Error())
+		options.events.record(corev1.EventTypeWarning, EventReasonUpstreamCheckFailed, "the image %q of container %q wasn't rewritten to %q by rule %q, could not fetch the image manifest: %s",
+			imageRef, options.container, updatedRef, transformer.Name(), err.Error())
+		return "", false, nil
+	}
+	if !upstreamImage.Found {
+		logger.Info(fmt.Sprintf("transformer %q skipping rewriting %q to %q, registry reported image not found.", transformer.Name(), imageRef, updatedRef))
+		options.checked(updatedRef, audit.UpstreamNotFound, nil)
+		options.note(transformer.Name(), "skipped rewriting to %q, the registry reported the image not found", updatedRef)
+		options.warn(false, "image %q not rewritten to %q by rule %q, the registry reported the image not found", imageRef, updatedRef, transformer.Name())
+		options.events.record(corev1.EventTypeWarning, EventReasonUpstreamCheckFailed, "the image %q of container %q wasn't rewritten to %q by rule %q, the registry reported the image not found",
+			imageRef, options.container, updatedRef, transformer.Name())
+		return "", false, nil
+	}
+	if upstreamImage.Checked {
+		options.checked(updatedRef, audit.UpstreamFound, nil)
+	}
+	if upstreamImage.Digest == "" {
+		return updatedRef, true, nil
+	}
+	pinnedRef, err := PinDigestInImageRef(updatedRef, upstreamImage.Digest)
+	if err != nil {
+		return "", false, fmt.Errorf("transformer %q failed to pin imageRef %q: %w", transformer.Name(), updatedRef, err)
+	}
+	return pinnedRef, true, nil
+}
+
+// registryHealthy returns if the registry of the image hasn't recently failed upstream checks.
+func (p *PodContainerProxier) registryHealthy(imageRef string) bool {
+	registry, err := RegistryFromImageRef(imageRef)
+	if err != nil {
+		return true
+	}
+	return p.Health.Healthy(registry)
 }
 
 // PodContainerProxier implements admission.DecoderInjector.
@@ -2,11 +2,32 @@ package webhook
 
 import (
 	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 
 	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
 
 	"github.com/stretchr/testify/require"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
 func TestPodContainerProxier_rewriteImage(t *testing.T) {
@@ -93,9 +114,786 @@ func TestPodContainerProxier_rewriteImage(t *testing.T) {
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			rewritten, err := proxier.rewriteImage(context.TODO(), tc.image)
+			rewritten, err := proxier.rewriteImage(context.TODO(), Namespace{}, tc.image, rewriteOptions{})
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, rewritten.image)
+		})
+	}
+}
+
+func TestPodContainerProxier_HandleEphemeralContainers(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:    "docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/dockerhub-proxy",
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	proxier := PodContainerProxier{
+		Decoder:      admission.NewDecoder(scheme),
+		Transformers: transformers,
+	}
+
+	pod := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "debug-me", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "harbor.example.com/dockerhub-proxy/library/nginx:latest"}},
+			EphemeralContainers: []corev1.EphemeralContainer{{
+				EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "busybox:1.36"},
+			}},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err)
+
+	resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UID:         "ephemeral",
+		Operation:   admissionv1.Update,
+		SubResource: "ephemeralcontainers",
+		Object:      runtime.RawExtension{Raw: raw},
+	}})
+	require.True(t, resp.Allowed)
+	require.Len(t, resp.Patches, 1, "annotations can't be changed through the ephemeralcontainers subresource")
+	require.Equal(t, "/spec/ephemeralContainers/0/image", resp.Patches[0].Path)
+	require.Equal(t, "harbor.example.com/dockerhub-proxy/library/busybox:1.36", resp.Patches[0].Value)
+}
+
+func TestPodContainerProxier_HandleNamespaceScopedRules(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:              "team-a docker.io proxy cache",
+			Matches:           []string{"^docker.io"},
+			Replace:           "harbor.example.com/team-a-dockerhub",
+			NamespaceSelector: &config.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+		},
+		{
+			Name:    "shared docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/dockerhub-proxy",
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"team": "b"}}},
+	).Build()
+	proxier := PodContainerProxier{
+		Client:       kubeClient,
+		Decoder:      admission.NewDecoder(scheme),
+		Transformers: transformers,
+	}
+
+	for namespace, expected := range map[string]string{
+		"team-a": "harbor.example.com/team-a-dockerhub/library/nginx:latest",
+		"team-b": "harbor.example.com/dockerhub-proxy/library/nginx:latest",
+	} {
+		pod := corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: namespace},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx"}}},
+		}
+		raw, err := json.Marshal(pod)
+		require.NoError(t, err)
+		resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Create,
+			Namespace: namespace,
+			Object:    runtime.RawExtension{Raw: raw},
+		}})
+		require.True(t, resp.Allowed)
+		require.Equal(t, expected, patchesByPath(resp)["/spec/containers/0/image"], namespace)
+	}
+}
+
+func TestPodContainerProxier_HandleAuditMode(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:    "quay.io proxy cache",
+			Matches: []string{"^quay.io"},
+			Replace: "harbor.example.com/quay-proxy",
+			Mode:    config.ModeEnforce,
+		},
+		{
+			Name:    "docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/dockerhub-proxy",
+			Mode:    config.ModeAudit,
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	proxier := PodContainerProxier{
+		Decoder:      admission.NewDecoder(scheme),
+		Transformers: transformers,
+	}
+
+	pod := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "audited", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "busybox"}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "nginx:1.27"},
+				{Name: "exporter", Image: "quay.io/prometheus/nginx-exporter:v1"},
+			},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err)
+	resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	require.True(t, resp.Allowed)
+
+	patches := patchesByPath(resp)
+	require.Len(t, patches, 2)
+	require.Equal(t, "harbor.example.com/quay-proxy/prometheus/nginx-exporter:v1", patches["/spec/containers/1/image"])
+	annotations := patches["/metadata/annotations"].(map[string]interface{})
+	require.Equal(t, `{"app":"harbor.example.com/dockerhub-proxy/library/nginx:1.27","init":"harbor.example.com/dockerhub-proxy/library/busybox:latest"}`,
+		annotations[AnnotationWouldRewrite])
+}
+
+func TestPodContainerProxier_HandleAuditModeBeforeEnforce(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:    "new docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor-next.example.com/dockerhub-proxy",
+			Mode:    config.ModeAudit,
+		},
+		{
+			Name:    "docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/dockerhub-proxy",
+			Mode:    config.ModeEnforce,
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	proxier := PodContainerProxier{
+		Decoder:      admission.NewDecoder(scheme),
+		Transformers: transformers,
+	}
+
+	pod := corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "audited", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "nginx:1.27"}},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err)
+	resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: admissionv1.Create,
+		Namespace: "default",
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	require.True(t, resp.Allowed)
+
+	// the rule in audit mode records its rewrite, and the rule after it still rewrites the image
+	patches := patchesByPath(resp)
+	require.Equal(t, "harbor.example.com/dockerhub-proxy/library/nginx:1.27", patches["/spec/containers/0/image"])
+	annotations := patches["/metadata/annotations"].(map[string]interface{})
+	require.Equal(t, `{"app":"harbor-next.example.com/dockerhub-proxy/library/nginx:1.27"}`, annotations[AnnotationWouldRewrite])
+	require.Contains(t, annotations, AnnotationOriginalImages)
+}
+
+func TestPodContainerProxier_HandleOriginalImages(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			// a rule which matches its own rewritten images, which must not be rewritten twice
+			Name:    "everything proxy cache",
+			Matches: []string{".*"},
+			Replace: "harbor.example.com/proxy",
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	proxier := PodContainerProxier{
+		Decoder:      admission.NewDecoder(scheme),
+		Transformers: transformers,
+	}
+	handle := func(pod *corev1.Pod) admission.Response {
+		raw, err := json.Marshal(pod)
+		require.NoError(t, err)
+		resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: admissionv1.Create,
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: raw},
+		}})
+		require.True(t, resp.Allowed)
+		return resp
+	}
+
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "traced", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx:1.27"}}},
+	}
+	patches := patchesByPath(handle(pod))
+	rewritten := "harbor.example.com/proxy/library/nginx:1.27"
+	require.Equal(t, rewritten, patches["/spec/containers/0/image"])
+	annotation := patches["/metadata/annotations"].(map[string]interface{})[AnnotationOriginalImages].(string)
+	originals := map[string]OriginalImage{}
+	require.NoError(t, json.Unmarshal([]byte(annotation), &originals))
+	require.Equal(t, map[string]OriginalImage{
+		"app": {Image: "nginx:1.27", Rule: "everything proxy cache", Rewritten: rewritten},
+	}, originals)
+
+	// reinvocation of the webhook with the rewritten pod should not rewrite it again
+	pod.Annotations = map[string]string{AnnotationOriginalImages: annotation}
+	pod.Spec.Containers[0].Image = rewritten
+	require.Empty(t, handle(pod).Patches)
+
+	// a changed image should be rewritten, and the annotation updated
+	pod.Spec.Containers[0].Image = "nginx:1.28"
+	patches = patchesByPath(handle(pod))
+	require.Equal(t, "harbor.example.com/proxy/library/nginx:1.28", patches["/spec/containers/0/image"])
+	require.Contains(t, patches["/metadata/annotations/harbor-container-webhook~1original-images"], `"image":"nginx:1.28"`)
+}
+
+func TestPodContainerProxier_HandleOptOutAnnotations(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:    "docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/dockerhub-proxy",
+		},
+		{
+			Name:    "docker.io mirror",
+			Matches: []string{"^docker.io"},
+			Replace: "mirror.example.com",
+		},
+		{
+			// nothing listens on the port, so upstream checks always fail
+			Name:          "quay.io proxy cache",
+			Matches:       []string{"^quay.io"},
+			Replace:       "127.0.0.1:1/quay-proxy",
+			CheckUpstream: true,
+			Platforms:     []string{config.DefaultPlatform},
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	proxier := PodContainerProxier{
+		Decoder:      admission.NewDecoder(scheme),
+		Transformers: transformers,
+	}
+
+	type testcase struct {
+		name        string
+		annotations map[string]string
+		expected    map[string]interface{}
+	}
+	tests := []testcase{
+		{
+			name: "without annotations",
+			expected: map[string]interface{}{
+				"/spec/containers/0/image": "harbor.example.com/dockerhub-proxy/library/nginx:1.27",
+				"/spec/containers/1/image": "harbor.example.com/dockerhub-proxy/library/envoy:1.33",
+			},
+		},
+		{
+			name:        "a disabled container is not rewritten",
+			annotations: map[string]string{AnnotationDisabledContainers: "sidecar"},
+			expected: map[string]interface{}{
+				"/spec/containers/0/image": "harbor.example.com/dockerhub-proxy/library/nginx:1.27",
+			},
+		},
+		{
+			name:        "every container is disabled",
+			annotations: map[string]string{AnnotationDisabledContainers: "*"},
+			expected:    map[string]interface{}{},
+		},
+		{
+			name:        "a forced rule is the only rule evaluated",
+			annotations: map[string]string{AnnotationForceRules: `{"sidecar":"docker.io mirror"}`},
+			expected: map[string]interface{}{
+				"/spec/containers/0/image": "harbor.example.com/dockerhub-proxy/library/nginx:1.27",
+				"/spec/containers/1/image": "mirror.example.com/library/envoy:1.33",
+			},
+		},
+		{
+			name:        "an unknown forced rule doesn't rewrite",
+			annotations: map[string]string{AnnotationForceRules: `{"*":"missing"}`},
+			expected:    map[string]interface{}{},
+		},
+		{
+			name:        "skipping the upstream check rewrites the image",
+			annotations: map[string]string{AnnotationSkipUpstreamCheck: "app, exporter", AnnotationDisabledContainers: "sidecar"},
+			expected: map[string]interface{}{
+				"/spec/containers/0/image": "harbor.example.com/dockerhub-proxy/library/nginx:1.27",
+				"/spec/containers/2/image": "127.0.0.1:1/quay-proxy/prometheus/nginx-exporter:v1",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+				ObjectMeta: metav1.ObjectMeta{Name: "opt-out", Namespace: "default", Annotations: tc.annotations},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{
+					{Name: "app", Image: "nginx:1.27"},
+					{Name: "sidecar", Image: "envoy:1.33"},
+					{Name: "exporter", Image: "quay.io/prometheus/nginx-exporter:v1"},
+				}},
+			}
+			raw, err := json.Marshal(pod)
 			require.NoError(t, err)
-			require.Equal(t, tc.expected, rewritten)
+
+			resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: raw},
+			}})
+			require.True(t, resp.Allowed)
+
+			patches := patchesByPath(resp)
+			images := map[string]interface{}{}
+			for path, value := range patches {
+				if strings.HasPrefix(path, "/spec/") {
+					images[path] = value
+				}
+			}
+			require.Equal(t, tc.expected, images)
 		})
 	}
 }
+
+func TestPodContainerProxier_rewriteImagePinDigest(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	image, err := random.Image(256, 1)
+	require.NoError(t, err)
+	require.NoError(t, crane.Push(image, host+"/proxy/library/nginx:1.27"))
+	digest, err := image.Digest()
+	require.NoError(t, err)
+
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:      "docker.io pinned proxy cache",
+			Matches:   []string{"^docker.io"},
+			Replace:   host + "/proxy",
+			PinDigest: true,
+			Platforms: []string{config.DefaultPlatform},
+		},
+	}, nil, WithUpstreamCache(NewUpstreamCache(config.UpstreamCacheConfig{TTL: time.Minute})))
+	require.NoError(t, err)
+	proxier := PodContainerProxier{Transformers: transformers}
+
+	pinned := host + "/proxy/library/nginx:1.27@" + digest.String()
+	rewritten, err := proxier.rewriteImage(context.TODO(), Namespace{}, "nginx:1.27", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, pinned, rewritten.image)
+
+	// moving the tag mid-rollout should not change the digest of the remaining replicas
+	moved, err := random.Image(256, 1)
+	require.NoError(t, err)
+	require.NoError(t, crane.Push(moved, host+"/proxy/library/nginx:1.27"))
+	rewritten, err = proxier.rewriteImage(context.TODO(), Namespace{}, "nginx:1.27", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, pinned, rewritten.image)
+
+	// images which already have a digest are kept as is
+	rewritten, err = proxier.rewriteImage(context.TODO(), Namespace{}, "nginx@"+digest.String(), rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, host+"/proxy/library/nginx@"+digest.String(), rewritten.image)
+
+	// images missing from the registry can't be pinned and are not rewritten
+	rewritten, err = proxier.rewriteImage(context.TODO(), Namespace{}, "nginx:missing", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "nginx:missing", rewritten.image)
+}
+
+func TestRuleTransformer_CheckUpstreamCache(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:          "docker.io proxy cache",
+			Matches:       []string{"^docker.io"},
+			Replace:       host + "/proxy",
+			CheckUpstream: true,
+			Platforms:     []string{config.DefaultPlatform},
+		},
+	}, nil, WithUpstreamCache(NewUpstreamCache(config.UpstreamCacheConfig{TTL: time.Minute, NegativeTTL: time.Minute})))
+	require.NoError(t, err)
+	transformer := transformers[0]
+
+	found, err := transformer.CheckUpstream(context.TODO(), host+"/proxy/library/nginx:1.27")
+	require.NoError(t, err, "a missing manifest is not an error")
+	require.False(t, found.Found)
+	require.True(t, found.Checked)
+
+	image, err := random.Image(256, 1)
+	require.NoError(t, err)
+	require.NoError(t, crane.Push(image, host+"/proxy/library/nginx:1.27"))
+	found, err = transformer.CheckUpstream(context.TODO(), host+"/proxy/library/nginx:1.27")
+	require.NoError(t, err)
+	require.False(t, found.Found, "the missing image should be cached for the negative ttl")
+}
+
+// patchesByPath returns the values of the response patches, keyed by path.
+func patchesByPath(resp admission.Response) map[string]interface{} {
+	patches := map[string]interface{}{}
+	for _, patch := range resp.Patches {
+		patches[patch.Path] = patch.Value
+	}
+	return patches
+}
+
+func TestPodContainerProxier_HandleImagePullSecrets(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:                     "docker.io proxy cache",
+			Matches:                  []string{"^docker.io"},
+			Replace:                  "harbor.example.com/dockerhub-proxy",
+			ImagePullSecret:          "harbor-pull-secret",
+			ImagePullSecretNamespace: "webhook",
+		},
+		{
+			Name:    "quay.io proxy cache",
+			Matches: []string{"^quay.io"},
+			Replace: "harbor.example.com/quay-proxy",
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(newDockerConfigSecret(t, DockerConfig{
+		"harbor.example.com": {Username: "robot", Password: "password"},
+	})).Build()
+	proxier := PodContainerProxier{
+		Client:       kubeClient,
+		Decoder:      admission.NewDecoder(scheme),
+		Transformers: transformers,
+	}
+	handle := func(image string, operation admissionv1.Operation, dryRun bool) map[string]interface{} {
+		pod := corev1.Pod{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		}
+		raw, err := json.Marshal(pod)
+		require.NoError(t, err)
+		resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: operation,
+			Namespace: "team-a",
+			DryRun:    &dryRun,
+			Object:    runtime.RawExtension{Raw: raw},
+		}})
+		require.True(t, resp.Allowed)
+		return patchesByPath(resp)
+	}
+	copied := func() bool {
+		err := kubeClient.Get(context.TODO(), client.ObjectKey{Namespace: "team-a", Name: "harbor-pull-secret"}, &corev1.Secret{})
+		return err == nil
+	}
+	pullSecrets := []interface{}{map[string]interface{}{"name": "harbor-pull-secret"}}
+
+	patches := handle("quay.io/prometheus/nginx-exporter:v1", admissionv1.Create, false)
+	require.NotContains(t, patches, "/spec/imagePullSecrets", "rules without a pull secret don't add one")
+
+	patches = handle("nginx:1.27", admissionv1.Create, true)
+	require.Equal(t, pullSecrets, patches["/spec/imagePullSecrets"])
+	require.False(t, copied(), "dry runs must not copy the secret")
+
+	patches = handle("nginx:1.27", admissionv1.Update, false)
+	require.NotContains(t, patches, "/spec/imagePullSecrets", "the pull secrets of existing pods can't be changed")
+
+	patches = handle("nginx:1.27", admissionv1.Create, false)
+	require.Equal(t, pullSecrets, patches["/spec/imagePullSecrets"])
+	require.True(t, copied())
+}
+
+func TestPodContainerProxier_HandleForgedOriginalImages(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:                     "team-a proxy cache",
+			Matches:                  []string{"^docker.io"},
+			Replace:                  "harbor.example.com/team-a-proxy",
+			Namespaces:               []string{"team-a"},
+			ImagePullSecret:          "harbor-pull-secret",
+			ImagePullSecretNamespace: "webhook",
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	kubeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(newDockerConfigSecret(t, DockerConfig{
+		"harbor.example.com": {Username: "robot", Password: "password"},
+	})).Build()
+	proxier := PodContainerProxier{
+		Client:       kubeClient,
+		Decoder:      admission.NewDecoder(scheme),
+		Transformers: transformers,
+	}
+
+	type testcase struct {
+		name        string
+		namespace   string
+		image       string
+		original    OriginalImage
+		pullSecrets bool
+	}
+	tests := []testcase{
+		{
+			name:      "rule which doesn't apply to the namespace",
+			namespace: "team-b",
+			image:     "evil.io/x:1",
+			original:  OriginalImage{Image: "nginx", Rule: "team-a proxy cache", Rewritten: "evil.io/x:1"},
+		},
+		{
+			name:      "rule which doesn't rewrite the image to the container image",
+			namespace: "team-a",
+			image:     "evil.io/x:1",
+			original:  OriginalImage{Image: "nginx", Rule: "team-a proxy cache", Rewritten: "evil.io/x:1"},
+		},
+		{
+			name:        "image rewritten by the rule",
+			namespace:   "team-a",
+			image:       "harbor.example.com/team-a-proxy/library/nginx:latest",
+			original:    OriginalImage{Image: "nginx", Rule: "team-a proxy cache", Rewritten: "harbor.example.com/team-a-proxy/library/nginx:latest"},
+			pullSecrets: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			annotation, err := json.Marshal(map[string]OriginalImage{"app": tc.original})
+			require.NoError(t, err)
+			pod := corev1.Pod{
+				TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: tc.namespace, Annotations: map[string]string{
+					AnnotationOriginalImages: string(annotation),
+				}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: tc.image}}},
+			}
+			raw, err := json.Marshal(pod)
+			require.NoError(t, err)
+			resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Namespace: tc.namespace,
+				Object:    runtime.RawExtension{Raw: raw},
+			}})
+			require.True(t, resp.Allowed)
+			patches := patchesByPath(resp)
+			require.NotContains(t, patches, "/spec/containers/0/image")
+			copyErr := kubeClient.Get(context.TODO(), client.ObjectKey{Namespace: tc.namespace, Name: "harbor-pull-secret"}, &corev1.Secret{})
+			if tc.pullSecrets {
+				require.Contains(t, patches, "/spec/imagePullSecrets")
+				require.NoError(t, copyErr)
+			} else {
+				require.NotContains(t, patches, "/spec/imagePullSecrets", "a forged annotation must not inject the secret")
+				require.Error(t, copyErr, "a forged annotation must not copy the secret")
+				require.Contains(t, patches, "/metadata/annotations", "the forged annotation is removed")
+			}
+		})
+	}
+}
+
+func TestPodContainerProxier_rewriteImageFallbacks(t *testing.T) {
+	regionalRequests := 0
+	regional := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		regionalRequests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer regional.Close()
+	central := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer central.Close()
+	regionalHost := strings.TrimPrefix(regional.URL, "http://")
+	centralHost := strings.TrimPrefix(central.URL, "http://")
+
+	image, err := random.Image(256, 1)
+	require.NoError(t, err)
+	require.NoError(t, crane.Push(image, centralHost+"/proxy/library/nginx:1.27"))
+
+	now := time.Now()
+	health := NewRegistryHealth(config.RegistryHealthConfig{Cooldown: time.Minute})
+	health.now = func() time.Time { return now }
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:          "docker.io proxy cache with fallbacks",
+			Matches:       []string{"^docker.io"},
+			Replace:       regionalHost + "/proxy",
+			Fallbacks:     []string{centralHost + "/proxy", config.FallbackOrigin},
+			CheckUpstream: true,
+			Platforms:     []string{config.DefaultPlatform},
+		},
+		{
+			Name:    "docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/proxy",
+		},
+	}, nil, WithRegistryHealth(health))
+	require.NoError(t, err)
+	proxier := PodContainerProxier{Transformers: transformers, Health: health}
+
+	rewritten, err := proxier.rewriteImage(context.TODO(), Namespace{}, "nginx:1.27", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, centralHost+"/proxy/library/nginx:1.27", rewritten.image, "the central registry is used while the regional one is down")
+	require.Equal(t, "docker.io proxy cache with fallbacks", rewritten.rule)
+	require.False(t, health.Healthy(regionalHost))
+	requests := regionalRequests
+
+	rewritten, err = proxier.rewriteImage(context.TODO(), Namespace{}, "nginx:1.27", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, centralHost+"/proxy/library/nginx:1.27", rewritten.image)
+	require.Equal(t, requests, regionalRequests, "unhealthy registries are skipped")
+
+	rewritten, err = proxier.rewriteImage(context.TODO(), Namespace{}, "nginx:missing", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "nginx:missing", rewritten.image, "the origin fallback keeps the image without evaluating further rules")
+	require.True(t, health.Healthy(centralHost), "images missing from a registry don't make it unhealthy")
+
+	now = now.Add(time.Minute)
+	rewritten, err = proxier.rewriteImage(context.TODO(), Namespace{}, "nginx:1.27", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, centralHost+"/proxy/library/nginx:1.27", rewritten.image)
+	require.Greater(t, regionalRequests, requests, "registries are tried again after the cooldown")
+}
+
+func TestPodContainerProxier_rewriteImageSkipUnhealthy(t *testing.T) {
+	health := NewRegistryHealth(config.RegistryHealthConfig{Cooldown: time.Minute})
+	proxier := PodContainerProxier{Health: health}
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:          "quay.io proxy cache",
+			Matches:       []string{"^quay.io"},
+			Replace:       "harbor.example.com/quay-proxy",
+			SkipUnhealthy: true,
+		},
+		{
+			Name:    "docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/dockerhub-proxy",
+		},
+	}, nil, WithRegistryHealth(health))
+	require.NoError(t, err)
+	proxier.SetTransformers(transformers)
+	require.Contains(t, health.probes, "harbor.example.com", "the replace registries are probed")
+
+	health.recordProbe("harbor.example.com", io.EOF)
+	health.recordProbe("harbor.example.com", io.EOF)
+	health.recordProbe("harbor.example.com", io.EOF)
+	require.False(t, health.Healthy("harbor.example.com"))
+
+	rewritten, err := proxier.rewriteImage(context.TODO(), Namespace{}, "quay.io/prometheus/prometheus:v3.0.0", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "quay.io/prometheus/prometheus:v3.0.0", rewritten.image, "rules skipping unhealthy registries don't rewrite to them")
+
+	rewritten, err = proxier.rewriteImage(context.TODO(), Namespace{}, "nginx:1.27", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "harbor.example.com/dockerhub-proxy/library/nginx:1.27", rewritten.image, "other rules still rewrite to unhealthy registries")
+}
+
+func TestPodContainerProxier_HandleWarnings(t *testing.T) {
+	upstream := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:          "quay.io proxy cache",
+			Matches:       []string{"^quay.io"},
+			Replace:       upstreamHost + "/quay-proxy",
+			CheckUpstream: true,
+			Platforms:     []string{config.DefaultPlatform},
+		},
+		{
+			Name:     "docker.io proxy cache",
+			Matches:  []string{"^docker.io"},
+			Excludes: []string{"^docker.io/library/ubuntu:"},
+			Replace:  "harbor.example.com/dockerhub-proxy",
+			Mode:     config.ModeAudit,
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+
+	pod := corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "warned", Namespace: "default", Annotations: map[string]string{
+			AnnotationDisabledContainers: "legacy",
+			AnnotationForceRules:         "{",
+		}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "quay.io/prometheus/prometheus:v3.0.0"},
+				{Name: "sidecar", Image: "nginx:1.27"},
+				{Name: "debug", Image: "ubuntu:24.04"},
+				{Name: "legacy", Image: "busybox"},
+			},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err)
+
+	degraded := []string{
+		"ignoring malformed harbor-container-webhook/force-rules annotation: unexpected end of JSON input",
+		`container "app": image "quay.io/prometheus/prometheus:v3.0.0" not rewritten to "` + upstreamHost +
+			`/quay-proxy/prometheus/prometheus:v3.0.0" by rule "quay.io proxy cache", the registry reported the image not found`,
+	}
+	type testcase struct {
+		level    string
+		expected []string
+	}
+	tests := []testcase{
+		{level: config.WarningsNone},
+		{level: "", expected: degraded},
+		{level: config.WarningsDegraded, expected: degraded},
+		{level: config.WarningsAll, expected: append(append([]string{}, degraded...),
+			`container "sidecar": image "nginx:1.27" would be rewritten to "harbor.example.com/dockerhub-proxy/library/nginx:1.27" by rule "docker.io proxy cache", which is in audit mode`,
+			`container "debug": image "ubuntu:24.04" not rewritten by rule "docker.io proxy cache", "docker.io/library/ubuntu:24.04" is excluded by "^docker.io/library/ubuntu:"`,
+			`container "legacy": image "busybox" not rewritten, rewriting is disabled by the harbor-container-webhook/disabled-containers annotation`,
+		)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.level, func(t *testing.T) {
+			proxier := PodContainerProxier{
+				Decoder:      admission.NewDecoder(scheme),
+				Transformers: transformers,
+				Warnings:     tc.level,
+			}
+			resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: raw},
+			}})
+			require.True(t, resp.Allowed)
+			require.Len(t, resp.Warnings, len(tc.expected))
+			for i, warning := range resp.Warnings {
+				require.True(t, strings.HasPrefix(warning, tc.expected[i]), warning)
+				require.NotContains(t, warning, "\n")
+			}
+		})
+	}
+}
+
+func TestAdmissionWarnings_add(t *testing.T) {
+	warnings := newAdmissionWarnings(config.WarningsDegraded)
+	warnings.add(true, "verbose")
+	warnings.add(false, "failed:\n%s", "unavailable")
+	warnings.add(false, "failed:\n%s", "unavailable")
+	require.Equal(t, []string{"failed: unavailable"}, warnings.list(), "verbose and duplicate warnings aren't added")
+
+	var discarded *admissionWarnings
+	discarded.add(false, "discarded")
+	require.Empty(t, discarded.list())
+}
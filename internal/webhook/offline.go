@@ -0,0 +1,325 @@
+package webhook
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	"sigs.k8s.io/yaml"
+)
+
+// RuleDecision explains why a rule did or didn't rewrite the image of a container.
+type RuleDecision struct {
+	// Rule is the name of the rule, or empty if no rule was evaluated.
+	Rule string
+	// Reason describes the decision.
+	Reason string
+}
+
+// ImageRewrite is the outcome of evaluating the rules against the image of a container.
+type ImageRewrite struct {
+	// Container is the name of the container, or empty for image references.
+	Container string
+	// Image is the image before it was rewritten.
+	Image string
+	// Rewritten is the image after it was rewritten, or the image if no rule rewrote it.
+	Rewritten string
+	// Decisions are the decisions of the evaluated rules, in evaluation order.
+	Decisions []RuleDecision
+}
+
+// ManifestRewrite is the outcome of evaluating the rules against the containers of a manifest.
+type ManifestRewrite struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// Containers are the rewrites of every init container, container and ephemeral container of the manifest.
+	Containers []ImageRewrite
+}
+
+// podTemplatePaths are the paths of the pod templates of the kinds with containers, an empty path for pods.
+var podTemplatePaths = map[string][]string{
+	"Pod":                   {},
+	"PodTemplate":           {"template"},
+	"ReplicationController": {"spec", "template"},
+	"ReplicaSet":            {"spec", "template"},
+	"Deployment":            {"spec", "template"},
+	"StatefulSet":           {"spec", "template"},
+	"DaemonSet":             {"spec", "template"},
+	"Job":                   {"spec", "template"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template"},
+}
+
+// OfflineRewriter evaluates the rules of a PodContainerProxier against image references and manifests without a
+// cluster, as the webhook would when they're admitted, and explains the decision of each rule. Image pull secrets
+// are added to the pod specs but not copied, and the namespaces only have the labels of the default namespace.
+type OfflineRewriter struct {
+	Proxier *PodContainerProxier
+	// Namespace is the namespace of the image references and of the manifests which don't set one.
+	Namespace Namespace
+	// CheckUpstream checks that the rewritten images exist in the upstream registry, as rules with checkUpstream do.
+	CheckUpstream bool
+}
+
+// RewriteImage evaluates the rules against an image reference.
+func (r *OfflineRewriter) RewriteImage(ctx context.Context, imageRef string) (ImageRewrite, error) {
+	rewrite := ImageRewrite{Image: imageRef}
+	result, err := r.Proxier.rewriteImage(ctx, r.Namespace, imageRef, rewriteOptions{
+		skipUpstreamCheck: !r.CheckUpstream,
+		explain: func(decision RuleDecision) {
+			rewrite.Decisions = append(rewrite.Decisions, decision)
+		},
+	})
+	if err != nil {
+		return ImageRewrite{}, err
+	}
+	rewrite.Rewritten = result.image
+	return rewrite, nil
+}
+
+// RewriteManifests evaluates the rules against the containers of a multi-document YAML stream of manifests, and writes
+// the rewritten manifests to out. Pods and the pod templates of workloads are rewritten, lists are rewritten item by
+// item, and other manifests are written as is. Documents which fail to be parsed or rewritten are written as is, and
+// their errors returned together once every document was rewritten.
+func (r *OfflineRewriter) RewriteManifests(ctx context.Context, in io.Reader, out io.Writer) ([]ManifestRewrite, error) {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(in))
+	rewrites := []ManifestRewrite{}
+	var errs []error
+	first := true
+	for index := 1; ; index++ {
+		document, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rewrites, errors.Join(errs...)
+		}
+		if err != nil {
+			return rewrites, errors.Join(append(errs, fmt.Errorf("failed to read manifest: %w", err))...)
+		}
+		output, manifestRewrites, err := r.rewriteDocument(ctx, document)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("document %d: %w", index, err))
+			output = document
+		}
+		if output == nil {
+			continue
+		}
+		rewrites = append(rewrites, manifestRewrites...)
+
+		if !first {
+			if _, err := io.WriteString(out, "---\n"); err != nil {
+				return nil, err
+			}
+		}
+		first = false
+		if _, err := out.Write(output); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rewriteDocument rewrites a YAML document, and returns the rewritten document, or nil for an empty document.
+func (r *OfflineRewriter) rewriteDocument(ctx context.Context, document []byte) ([]byte, []ManifestRewrite, error) {
+	data, err := yaml.YAMLToJSON(document)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if string(data) == "null" {
+		// empty document, e.g. a trailing ---
+		return nil, nil, nil
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(data); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	manifestRewrites, err := r.rewriteObject(ctx, obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	rewritten, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rewritten, manifestRewrites, nil
+}
+
+// rewriteObject rewrites the pod template of the object in place, or of every item of a list.
+func (r *OfflineRewriter) rewriteObject(ctx context.Context, obj *unstructured.Unstructured) ([]ManifestRewrite, error) {
+	if obj.IsList() {
+		rewrites := []ManifestRewrite{}
+		err := obj.EachListItem(func(item runtime.Object) error {
+			itemRewrites, err := r.rewriteObject(ctx, item.(*unstructured.Unstructured))
+			rewrites = append(rewrites, itemRewrites...)
+			return err
+		})
+		return rewrites, err
+	}
+	path, ok := podTemplatePaths[obj.GetKind()]
+	if !ok {
+		return nil, nil
+	}
+	template := obj.Object
+	if len(path) > 0 {
+		nested, found, err := unstructured.NestedMap(obj.Object, path...)
+		if err != nil || !found {
+			return nil, fmt.Errorf("%s %s has no pod template", obj.GetKind(), obj.GetName())
+		}
+		template = nested
+	}
+
+	podTemplate := &corev1.PodTemplateSpec{}
+	data, err := json.Marshal(template)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, podTemplate); err != nil {
+		return nil, fmt.Errorf("failed to parse the pod template of %s %s: %w", obj.GetKind(), obj.GetName(), err)
+	}
+
+	namespace := r.Namespace
+	if obj.GetNamespace() != "" && obj.GetNamespace() != namespace.Name {
+		namespace = Namespace{Name: obj.GetNamespace()}
+	}
+	decisions := map[string][]RuleDecision{}
+	request := podRequest{
+		namespace:         namespace,
+		dryRun:            true,
+		injectPullSecrets: true,
+		skipUpstreamCheck: !r.CheckUpstream,
+		explain: func(container string, decision RuleDecision) {
+			decisions[container] = append(decisions[container], decision)
+		},
+	}
+	original := podTemplate.Spec.DeepCopy()
+	updated, err := r.Proxier.updatePodSpec(ctx, request, &podTemplate.ObjectMeta, &podTemplate.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrite %s %s: %w", obj.GetKind(), obj.GetName(), err)
+	}
+
+	rewrite := ManifestRewrite{Kind: obj.GetKind(), Namespace: namespace.Name, Name: obj.GetName()}
+	for _, container := range podContainerImages(original) {
+		container.Decisions = decisions[container.Container]
+		rewrite.Containers = append(rewrite.Containers, container)
+	}
+	if updated {
+		rewritten := podContainerImages(&podTemplate.Spec)
+		for i := range rewrite.Containers {
+			rewrite.Containers[i].Rewritten = rewritten[i].Image
+		}
+		if err := setPodTemplate(template, podTemplate); err != nil {
+			return nil, fmt.Errorf("failed to rewrite %s %s: %w", obj.GetKind(), obj.GetName(), err)
+		}
+		if len(path) > 0 {
+			if err := unstructured.SetNestedMap(obj.Object, template, path...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return []ManifestRewrite{rewrite}, nil
+}
+
+// noMatchReason explains why the transformer didn't rewrite the image, and reports if the image matched the rule but
+// was excluded by it.
+func noMatchReason(transformer ContainerTransformer, imageRef string) (string, bool) {
+	t, ok := transformer.(*ruleTransformer)
+	if !ok {
+		return "doesn't match the image", false
+	}
+	registry, err := RegistryFromImageRef(imageRef)
+	if err != nil {
+		return err.Error(), false
+	}
+	normalizedRef, err := ReplaceRegistryInImageRef(imageRef, registry)
+	if err != nil {
+		return err.Error(), false
+	}
+	if t.findMatch(normalizedRef) == nil {
+		return fmt.Sprintf("%q matches none of %q", normalizedRef, t.rule.Matches), false
+	}
+	for i, exclude := range t.excludes {
+		if exclude.MatchString(normalizedRef) {
+			return fmt.Sprintf("%q is excluded by %q", normalizedRef, t.rule.Excludes[i]), true
+		}
+	}
+	if _, err := t.replace(replacement{replace: t.rule.Replace, template: t.template}, t.findMatch(normalizedRef), imageRef, normalizedRef); err != nil {
+		return err.Error(), false
+	}
+	return "the rewritten image is the same as the image", false
+}
+
+// podContainerImages returns the images of every init container, container and ephemeral container of the pod spec.
+func podContainerImages(spec *corev1.PodSpec) []ImageRewrite {
+	images := make([]ImageRewrite, 0, len(spec.InitContainers)+len(spec.Containers)+len(spec.EphemeralContainers))
+	for _, container := range spec.InitContainers {
+		images = append(images, ImageRewrite{Container: container.Name, Image: container.Image, Rewritten: container.Image})
+	}
+	for _, container := range spec.Containers {
+		images = append(images, ImageRewrite{Container: container.Name, Image: container.Image, Rewritten: container.Image})
+	}
+	for _, container := range spec.EphemeralContainers {
+		images = append(images, ImageRewrite{Container: container.Name, Image: container.Image, Rewritten: container.Image})
+	}
+	return images
+}
+
+// setPodTemplate copies the fields the webhook mutates, the container images, image pull secrets and annotations,
+// from the pod template into its unstructured manifest, keeping every other field as it was written.
+func setPodTemplate(template map[string]interface{}, podTemplate *corev1.PodTemplateSpec) error {
+	setImages := func(field string, images []string) error {
+		containers, _, err := unstructured.NestedSlice(template, "spec", field)
+		if err != nil {
+			return err
+		}
+		for i := range containers {
+			container, ok := containers[i].(map[string]interface{})
+			if !ok || i >= len(images) {
+				return fmt.Errorf("unexpected %s", field)
+			}
+			container["image"] = images[i]
+		}
+		if len(containers) == 0 {
+			return nil
+		}
+		return unstructured.SetNestedSlice(template, containers, "spec", field)
+	}
+	var initImages, images, ephemeralImages []string
+	for _, container := range podTemplate.Spec.InitContainers {
+		initImages = append(initImages, container.Image)
+	}
+	for _, container := range podTemplate.Spec.Containers {
+		images = append(images, container.Image)
+	}
+	for _, container := range podTemplate.Spec.EphemeralContainers {
+		ephemeralImages = append(ephemeralImages, container.Image)
+	}
+	if err := setImages("initContainers", initImages); err != nil {
+		return err
+	}
+	if err := setImages("containers", images); err != nil {
+		return err
+	}
+	if err := setImages("ephemeralContainers", ephemeralImages); err != nil {
+		return err
+	}
+
+	if len(podTemplate.Spec.ImagePullSecrets) > 0 {
+		secrets := make([]interface{}, 0, len(podTemplate.Spec.ImagePullSecrets))
+		for _, secret := range podTemplate.Spec.ImagePullSecrets {
+			secrets = append(secrets, map[string]interface{}{"name": secret.Name})
+		}
+		if err := unstructured.SetNestedSlice(template, secrets, "spec", "imagePullSecrets"); err != nil {
+			return err
+		}
+	}
+	if len(podTemplate.Annotations) > 0 {
+		return unstructured.SetNestedStringMap(template, podTemplate.Annotations, "metadata", "annotations")
+	}
+	unstructured.RemoveNestedField(template, "metadata", "annotations")
+	return nil
+}
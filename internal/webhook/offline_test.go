@@ -0,0 +1,233 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/yaml"
+)
+
+func newOfflineRewriter(t *testing.T) *OfflineRewriter {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:       "team-a",
+			Matches:    []string{"^docker.io"},
+			Replace:    "harbor.example.com/team-a",
+			Namespaces: []string{"team-a"},
+		},
+		{
+			Name:     "dockerhub",
+			Matches:  []string{"^docker.io"},
+			Excludes: []string{"^docker.io/library/busybox"},
+			Replace:  "harbor.example.com/dockerhub-proxy",
+			// upstream checks are skipped unless the rewriter checks upstream
+			CheckUpstream:   true,
+			ImagePullSecret: "harbor-pull-secret",
+		},
+		{
+			Name:    "quay",
+			Matches: []string{"^quay.io"},
+			Replace: "harbor.example.com/quay-proxy",
+			Mode:    config.ModeAudit,
+		},
+	}, nil)
+	require.NoError(t, err)
+	return &OfflineRewriter{
+		Proxier:   &PodContainerProxier{Transformers: transformers},
+		Namespace: Namespace{Name: "default"},
+	}
+}
+
+func TestOfflineRewriter_RewriteImage(t *testing.T) {
+	type testcase struct {
+		name      string
+		image     string
+		rewritten string
+		decisions []RuleDecision
+	}
+	tests := []testcase{
+		{
+			name:      "rewritten",
+			image:     "nginx:1.27",
+			rewritten: "harbor.example.com/dockerhub-proxy/library/nginx:1.27",
+			decisions: []RuleDecision{
+				{Rule: "team-a", Reason: `doesn't apply to the namespace "default"`},
+				{Rule: "dockerhub", Reason: `rewrote to "harbor.example.com/dockerhub-proxy/library/nginx:1.27"`},
+			},
+		},
+		{
+			name:      "excluded",
+			image:     "busybox:1.37",
+			rewritten: "busybox:1.37",
+			decisions: []RuleDecision{
+				{Rule: "team-a", Reason: `doesn't apply to the namespace "default"`},
+				{Rule: "dockerhub", Reason: `"docker.io/library/busybox:1.37" is excluded by "^docker.io/library/busybox"`},
+				{Rule: "quay", Reason: `"docker.io/library/busybox:1.37" matches none of ["^quay.io"]`},
+			},
+		},
+		{
+			name:      "audit",
+			image:     "quay.io/prometheus/prometheus:v3.0.0",
+			rewritten: "quay.io/prometheus/prometheus:v3.0.0",
+			decisions: []RuleDecision{
+				{Rule: "team-a", Reason: `doesn't apply to the namespace "default"`},
+				{Rule: "dockerhub", Reason: `"quay.io/prometheus/prometheus:v3.0.0" matches none of ["^docker.io"]`},
+				{Rule: "quay", Reason: `would rewrite to "harbor.example.com/quay-proxy/prometheus/prometheus:v3.0.0", the rule is in audit mode`},
+			},
+		},
+	}
+	rewriter := newOfflineRewriter(t)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rewrite, err := rewriter.RewriteImage(context.TODO(), tc.image)
+			require.NoError(t, err)
+			require.Equal(t, tc.image, rewrite.Image)
+			require.Equal(t, tc.rewritten, rewrite.Rewritten)
+			require.Equal(t, tc.decisions, rewrite.Decisions)
+		})
+	}
+}
+
+const offlineManifests = `apiVersion: v1
+kind: Pod
+metadata:
+  name: nginx
+  namespace: team-a
+spec:
+  initContainers:
+  - name: init
+    image: busybox:1.37
+  containers:
+  - name: nginx
+    image: nginx:1.27
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  image: nginx:1.27
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+  template:
+    metadata:
+      annotations:
+        harbor-container-webhook/disabled-containers: sidecar
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.27
+      - name: sidecar
+        image: nginx:1.27
+---
+`
+
+func TestOfflineRewriter_RewriteManifests(t *testing.T) {
+	rewriter := newOfflineRewriter(t)
+	out := &bytes.Buffer{}
+	rewrites, err := rewriter.RewriteManifests(context.TODO(), strings.NewReader(offlineManifests), out)
+	require.NoError(t, err)
+
+	require.Len(t, rewrites, 2, "only manifests with containers are rewritten")
+	require.Equal(t, "Pod", rewrites[0].Kind)
+	require.Equal(t, "team-a", rewrites[0].Namespace)
+	require.Equal(t, "harbor.example.com/team-a/library/busybox:1.37", rewrites[0].Containers[0].Rewritten)
+	require.Equal(t, "harbor.example.com/team-a/library/nginx:1.27", rewrites[0].Containers[1].Rewritten)
+	require.Equal(t, []RuleDecision{{Rule: "team-a", Reason: `rewrote to "harbor.example.com/team-a/library/nginx:1.27"`}}, rewrites[0].Containers[1].Decisions)
+	require.Equal(t, "Deployment", rewrites[1].Kind)
+	require.Equal(t, "default", rewrites[1].Namespace)
+	require.Equal(t, "harbor.example.com/dockerhub-proxy/library/nginx:1.27", rewrites[1].Containers[0].Rewritten)
+	require.Equal(t, "nginx:1.27", rewrites[1].Containers[1].Rewritten)
+	require.Equal(t, []RuleDecision{{Reason: "rewriting is disabled by the harbor-container-webhook/disabled-containers annotation"}}, rewrites[1].Containers[1].Decisions)
+
+	documents := strings.Split(out.String(), "---\n")
+	require.Len(t, documents, 3)
+	pod := map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal([]byte(documents[0]), &pod))
+	require.Equal(t, "harbor.example.com/team-a/library/nginx:1.27", pod["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})["image"])
+	require.Contains(t, documents[0], AnnotationOriginalImages)
+	require.Contains(t, documents[1], "image: nginx:1.27", "other manifests are kept as is")
+
+	deployment := map[string]interface{}{}
+	require.NoError(t, yaml.Unmarshal([]byte(documents[2]), &deployment))
+	spec := deployment["spec"].(map[string]interface{})
+	require.Equal(t, float64(2), spec["replicas"])
+	template := spec["template"].(map[string]interface{})
+	require.Equal(t, []interface{}{map[string]interface{}{"name": "harbor-pull-secret"}}, template["spec"].(map[string]interface{})["imagePullSecrets"])
+	containers := template["spec"].(map[string]interface{})["containers"].([]interface{})
+	require.Equal(t, "harbor.example.com/dockerhub-proxy/library/nginx:1.27", containers[0].(map[string]interface{})["image"])
+	require.Equal(t, "nginx:1.27", containers[1].(map[string]interface{})["image"])
+	require.NotContains(t, documents[2], "creationTimestamp", "only the mutated fields are changed")
+}
+
+func TestOfflineRewriter_RewriteManifestsList(t *testing.T) {
+	rewriter := newOfflineRewriter(t)
+	list := `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: a
+  spec:
+    containers:
+    - name: nginx
+      image: nginx:1.27
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: b
+  spec:
+    containers:
+    - name: nginx
+      image: nginx:1.27
+`
+	out := &bytes.Buffer{}
+	rewrites, err := rewriter.RewriteManifests(context.TODO(), strings.NewReader(list), out)
+	require.NoError(t, err)
+	require.Len(t, rewrites, 2)
+	require.Equal(t, 2, strings.Count(out.String(), "image: harbor.example.com/dockerhub-proxy/library/nginx:1.27"))
+}
+
+func TestOfflineRewriter_RewriteManifestsErrors(t *testing.T) {
+	rewriter := newOfflineRewriter(t)
+	manifests := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: templateless
+---
+kind: [
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  containers:
+  - name: nginx
+    image: nginx:1.27
+`
+	out := &bytes.Buffer{}
+	rewrites, err := rewriter.RewriteManifests(context.TODO(), strings.NewReader(manifests), out)
+	require.ErrorContains(t, err, "document 1: Deployment templateless has no pod template")
+	require.ErrorContains(t, err, "document 2: failed to parse manifest")
+	require.Len(t, rewrites, 1, "the documents after a failed document are rewritten")
+	require.Equal(t, "harbor.example.com/dockerhub-proxy/library/nginx:1.27", rewrites[0].Containers[0].Rewritten)
+
+	documents := strings.Split(out.String(), "---\n")
+	require.Len(t, documents, 3)
+	require.Contains(t, documents[0], "name: templateless", "failed documents are written as is")
+	require.Equal(t, "kind: [\n", documents[1])
+	require.Contains(t, documents[2], "image: harbor.example.com/dockerhub-proxy/library/nginx:1.27")
+}
@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// LabelManagedBy marks the image pull secrets copied into pod namespaces by the webhook.
+	LabelManagedBy = "app.kubernetes.io/managed-by"
+	// ManagedByWebhook is the LabelManagedBy value of the copied image pull secrets.
+	ManagedByWebhook = "harbor-container-webhook"
+	// AnnotationSourceSecret records the namespace and name of the secret an image pull secret was copied from.
+	AnnotationSourceSecret = "harbor-container-webhook/source-secret"
+)
+
+var pullSecretErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "hcw",
+	Subsystem: "pull_secrets",
+	Name:      "errors",
+	Help:      "image pull secrets of rules which failed to be copied into the namespace of a pod",
+}, []string{"secret"})
+
+func init() {
+	metrics.Registry.MustRegister(pullSecretErrors)
+}
+
+// ensurePullSecret copies the source image pull secret into the namespace, or updates the copy if the source changed.
+// A secret of the same name in the namespace which the webhook didn't create is left as is, and used instead.
+func ensurePullSecret(ctx context.Context, c client.Client, source types.NamespacedName, namespace string) error {
+	if source.Namespace == namespace {
+		return nil
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, source, secret); err != nil {
+		return fmt.Errorf("failed to get image pull secret %s: %w", source, err)
+	}
+	if secret.Type != corev1.SecretTypeDockerConfigJson {
+		return fmt.Errorf("image pull secret %s must be of type %s", source, corev1.SecretTypeDockerConfigJson)
+	}
+
+	existing := &corev1.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: source.Name}, existing)
+	if apierrors.IsNotFound(err) {
+		err = c.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        source.Name,
+				Namespace:   namespace,
+				Labels:      map[string]string{LabelManagedBy: ManagedByWebhook},
+				Annotations: map[string]string{AnnotationSourceSecret: source.String()},
+			},
+			Type: secret.Type,
+			Data: secret.Data,
+		})
+		if apierrors.IsAlreadyExists(err) {
+			// created by a concurrent admission, it's updated by the next one if it's stale
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy image pull secret %s into namespace %s: %w", source, namespace, err)
+		}
+		logger.Info(fmt.Sprintf("copied image pull secret %s into namespace %s", source, namespace))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get image pull secret %s/%s: %w", namespace, source.Name, err)
+	}
+
+	if existing.Labels[LabelManagedBy] != ManagedByWebhook || existing.Annotations[AnnotationSourceSecret] != source.String() {
+		return nil
+	}
+	if existing.Type != secret.Type {
+		return fmt.Errorf("image pull secret %s/%s is of type %s, the type of secrets can't be changed", namespace, source.Name, existing.Type)
+	}
+	if bytes.Equal(existing.Data[corev1.DockerConfigJsonKey], secret.Data[corev1.DockerConfigJsonKey]) {
+		return nil
+	}
+	existing.Data = secret.Data
+	if err := c.Update(ctx, existing); err != nil {
+		return fmt.Errorf("failed to update image pull secret %s/%s: %w", namespace, source.Name, err)
+	}
+	logger.Info(fmt.Sprintf("updated image pull secret %s/%s from %s", namespace, source.Name, source))
+	return nil
+}
+
+// addImagePullSecret adds the secret to the image pull secrets of the pod spec, unless it's already there.
+func addImagePullSecret(spec *corev1.PodSpec, name string) bool {
+	for _, ref := range spec.ImagePullSecrets {
+		if ref.Name == name {
+			return false
+		}
+	}
+	spec.ImagePullSecrets = append(spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+	return true
+}
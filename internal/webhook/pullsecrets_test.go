@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestEnsurePullSecret(t *testing.T) {
+	type testcase struct {
+		name      string
+		existing  *corev1.Secret
+		namespace string
+		expected  string
+		err       bool
+	}
+	source := newDockerConfigSecret(t, DockerConfig{"harbor.example.com": {Username: "robot", Password: "password"}})
+	copied := func(password string, managed bool) *corev1.Secret {
+		secret := newDockerConfigSecret(t, DockerConfig{"harbor.example.com": {Username: "robot", Password: password}})
+		secret.Namespace = "team-a"
+		if managed {
+			secret.Labels = map[string]string{LabelManagedBy: ManagedByWebhook}
+			secret.Annotations = map[string]string{AnnotationSourceSecret: "webhook/harbor-pull-secret"}
+		}
+		return secret
+	}
+	opaque := copied("stale", true)
+	opaque.Type = corev1.SecretTypeOpaque
+	tests := []testcase{
+		{
+			name:      "copied into the namespace",
+			namespace: "team-a",
+			expected:  "password",
+		},
+		{
+			name:      "the webhook namespace already has the secret",
+			namespace: "webhook",
+			expected:  "password",
+		},
+		{
+			name:      "stale copy is updated",
+			existing:  copied("stale", true),
+			namespace: "team-a",
+			expected:  "password",
+		},
+		{
+			name:      "secrets the webhook didn't copy are kept",
+			existing:  copied("owned by the namespace", false),
+			namespace: "team-a",
+			expected:  "owned by the namespace",
+		},
+		{
+			name:      "copy of the wrong type",
+			existing:  opaque,
+			namespace: "team-a",
+			err:       true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			require.NoError(t, clientgoscheme.AddToScheme(scheme))
+			builder := fake.NewClientBuilder().WithScheme(scheme).WithObjects(source.DeepCopy())
+			if tc.existing != nil {
+				builder = builder.WithObjects(tc.existing)
+			}
+			kubeClient := builder.Build()
+
+			err := ensurePullSecret(context.TODO(), kubeClient, client.ObjectKeyFromObject(source), tc.namespace)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			secret := &corev1.Secret{}
+			require.NoError(t, kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: tc.namespace, Name: source.Name}, secret))
+			keyring := parseSecretKeyring(client.ObjectKeyFromObject(secret), secret)
+			require.NoError(t, keyring.err)
+			auth, found := keyring.keyring.lookup("harbor.example.com/proxy/library/nginx:1.27")
+			require.True(t, found)
+			require.Equal(t, tc.expected, auth.Password)
+		})
+	}
+
+	t.Run("missing source secret", func(t *testing.T) {
+		scheme := runtime.NewScheme()
+		require.NoError(t, clientgoscheme.AddToScheme(scheme))
+		kubeClient := fake.NewClientBuilder().WithScheme(scheme).Build()
+		err := ensurePullSecret(context.TODO(), kubeClient, types.NamespacedName{Namespace: "webhook", Name: "missing"}, "team-a")
+		require.Error(t, err)
+		require.Error(t, kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "team-a", Name: "missing"}, &corev1.Secret{}))
+	})
+}
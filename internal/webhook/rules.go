@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var rulesDisabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "hcw",
+	Subsystem: "rules",
+	Name:      "disabled",
+	Help:      "1 if the rule is disabled because its replacement failed verification, 0 if it's enabled",
+}, []string{"name"})
+
+func init() {
+	metrics.Registry.MustRegister(rulesDisabled)
+}
+
+// ConfigRuleSource is the source name of the rules from the configuration file, which are evaluated first.
+const ConfigRuleSource = "config"
+
+// RuleStore merges proxy rules from multiple sources, such as the configuration file and ProxyRule resources, and
+// replaces the transformers of the proxier whenever a source changes. The rules of the configuration file are
+// evaluated first, followed by the other sources ordered by name.
+type RuleStore struct {
+	Proxier *PodContainerProxier
+	Client  client.Client
+	Options []TransformerOption
+
+	mu      sync.Mutex
+	sources map[string][]config.ProxyRule
+	// disabled are the names of the rules which are excluded from the transformers.
+	disabled map[string]bool
+}
+
+// ValidateRule checks that the rule can be compiled into a transformer.
+func ValidateRule(rule config.ProxyRule) error {
+	_, err := newRuleTransformer(rule)
+	return err
+}
+
+// Set replaces the rules of the source, or removes the source if there are no rules. If the merged rules fail to
+// compile, or a rule has the same name as another rule, the error is returned and the previous rules are kept.
+func (s *RuleStore) Set(source string, rules []config.ProxyRule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkNames(source, rules); err != nil {
+		return err
+	}
+	sources := make(map[string][]config.ProxyRule, len(s.sources)+1)
+	for name, sourceRules := range s.sources {
+		sources[name] = sourceRules
+	}
+	if len(rules) == 0 {
+		delete(sources, source)
+	} else {
+		sources[source] = rules
+	}
+
+	if err := s.apply(sources, s.disabled); err != nil {
+		return err
+	}
+	s.sources = sources
+	return nil
+}
+
+// checkNames ensures the names of the rules are unique across every source, as rules are disabled, reported in
+// metrics and recorded in annotations by name.
+func (s *RuleStore) checkNames(source string, rules []config.ProxyRule) error {
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	for other, otherRules := range s.sources {
+		if other == source {
+			continue
+		}
+		for _, rule := range otherRules {
+			if names[rule.Name] {
+				return fmt.Errorf("rule name %q is already used by a rule of %s", rule.Name, other)
+			}
+		}
+	}
+	return nil
+}
+
+// SetDisabled replaces the names of the rules which are disabled, e.g. because their replacement isn't a Harbor
+// project. Disabled rules are kept in their source, but not evaluated until they're enabled again.
+func (s *RuleStore) SetDisabled(disabled map[string]bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.apply(s.sources, disabled); err != nil {
+		return err
+	}
+	for name := range s.disabled {
+		if !disabled[name] {
+			logger.Info(fmt.Sprintf("enabled rule %q", name))
+			rulesDisabled.WithLabelValues(name).Set(0)
+		}
+	}
+	for name := range disabled {
+		rulesDisabled.WithLabelValues(name).Set(1)
+	}
+	s.disabled = disabled
+	return nil
+}
+
+// apply replaces the transformers of the proxier with the enabled rules of the sources.
+func (s *RuleStore) apply(sources map[string][]config.ProxyRule, disabled map[string]bool) error {
+	rules := []config.ProxyRule{}
+	for _, rule := range mergeRuleSources(sources) {
+		if !disabled[rule.Name] {
+			rules = append(rules, rule)
+		}
+	}
+	transformers, err := MakeTransformers(rules, s.Client, s.Options...)
+	if err != nil {
+		return err
+	}
+	s.Proxier.SetTransformers(transformers)
+	return nil
+}
+
+// Rules returns the merged rules of every source in evaluation order, including the disabled rules.
+func (s *RuleStore) Rules() []config.ProxyRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return mergeRuleSources(s.sources)
+}
+
+func mergeRuleSources(sources map[string][]config.ProxyRule) []config.ProxyRule {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		if name != ConfigRuleSource {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	rules := append([]config.ProxyRule(nil), sources[ConfigRuleSource]...)
+	for _, name := range names {
+		rules = append(rules, sources[name]...)
+	}
+	return rules
+}
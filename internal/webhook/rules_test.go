@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleStore_Set(t *testing.T) {
+	proxier := &PodContainerProxier{}
+	store := &RuleStore{Proxier: proxier}
+
+	require.NoError(t, store.Set("proxyrule/b", []config.ProxyRule{
+		{Name: "b", Matches: []string{"^docker.io"}, Replace: "harbor.example.com/b"},
+	}))
+	require.NoError(t, store.Set("proxyrule/a", []config.ProxyRule{
+		{Name: "a", Matches: []string{"^docker.io"}, Replace: "harbor.example.com/a"},
+	}))
+	require.NoError(t, store.Set(ConfigRuleSource, []config.ProxyRule{
+		{Name: "config", Matches: []string{"^quay.io"}, Replace: "harbor.example.com/quay"},
+	}))
+
+	names := make([]string, 0)
+	for _, rule := range store.Rules() {
+		names = append(names, rule.Name)
+	}
+	require.Equal(t, []string{"config", "a", "b"}, names, "config rules come first, then sources by name")
+
+	rewritten, err := proxier.rewriteImage(context.TODO(), Namespace{}, "nginx", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "harbor.example.com/a/library/nginx:latest", rewritten.image)
+
+	err = store.Set("proxyrule/c", []config.ProxyRule{
+		{Name: "c", Matches: []string{"^docker.io/(library"}, Replace: "harbor.example.com/c"},
+	})
+	require.Error(t, err)
+	require.Len(t, store.Rules(), 3, "invalid rules should not replace the previous rules")
+
+	err = store.Set("proxyrule/config", []config.ProxyRule{
+		{Name: "config", Matches: []string{"^docker.io"}, Replace: "harbor.example.com/other"},
+	})
+	require.ErrorContains(t, err, `rule name "config" is already used by a rule of config`)
+	require.Len(t, store.Rules(), 3, "rules can't reuse the name of a rule of another source")
+
+	require.NoError(t, store.Set("proxyrule/a", nil))
+	rewritten, err = proxier.rewriteImage(context.TODO(), Namespace{}, "nginx", rewriteOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "harbor.example.com/b/library/nginx:latest", rewritten.image)
+}
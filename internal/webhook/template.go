@@ -0,0 +1,122 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// templateVariables are the variables available to every replace template, computed from the normalized image
+// reference. A named capture group of the same name in the matching regex takes precedence.
+var templateVariables = map[string]bool{
+	"registry":   true,
+	"repository": true,
+	"tag":        true,
+	"digest":     true,
+}
+
+// isReplaceTemplate returns if the replace string of a rule is a template for the whole rewritten image reference,
+// rather than a registry replacement.
+func isReplaceTemplate(replace string) bool {
+	return strings.Contains(replace, "$")
+}
+
+// validateReplaceTemplate ensures every variable referenced by the template is a builtin variable, or a capture
+// group present in every match regex, as any of them may be the one that matched.
+func validateReplaceTemplate(template string, matches []*regexp.Regexp) error {
+	var errs []string
+	os.Expand(template, func(name string) string {
+		if name == "$" || templateVariables[name] {
+			return ""
+		}
+		for _, matcher := range matches {
+			if index, err := strconv.Atoi(name); err == nil {
+				if index > matcher.NumSubexp() {
+					errs = append(errs, fmt.Sprintf("capture group $%s is not in match regex %q", name, matcher.String()))
+				}
+			} else if matcher.SubexpIndex(name) < 0 {
+				errs = append(errs, fmt.Sprintf("capture group ${%s} is not in match regex %q", name, matcher.String()))
+			}
+		}
+		return ""
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid replace template %q: %s", template, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// errTemplateExpansion is returned when a replace template doesn't produce a valid image reference for an image, in
+// which case the rule doesn't rewrite the image.
+var errTemplateExpansion = errors.New("replace template produced an invalid image reference")
+
+// expandReplaceTemplate computes the rewritten image reference from the template, using the capture groups of the
+// regex which matched the normalized image reference, and the builtin variables of the image reference. Numbered
+// groups are referenced as $1 or ${1}, named groups as ${name}, and $$ is a literal $. If the image has no digest,
+// ${digest} and the @ before it expand to nothing, and likewise for ${tag}. The tag and digest of the image are kept
+// if the expanded reference doesn't have its own.
+func expandReplaceTemplate(template string, matcher *regexp.Regexp, imageRef, normalizedRef string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", err
+	}
+	named = reference.TagNameOnly(named)
+	variables := map[string]string{
+		"registry":   reference.Domain(named),
+		"repository": reference.Path(named),
+	}
+	tagged, hasTag := named.(reference.Tagged)
+	if hasTag {
+		variables["tag"] = tagged.Tag()
+	} else {
+		template = strings.NewReplacer(":${tag}", "", ":$tag", "").Replace(template)
+	}
+	digested, hasDigest := named.(reference.Digested)
+	if hasDigest {
+		variables["digest"] = digested.Digest().String()
+	} else {
+		template = strings.NewReplacer("@${digest}", "", "@$digest", "").Replace(template)
+	}
+
+	groups := matcher.FindStringSubmatch(normalizedRef)
+	for i, name := range matcher.SubexpNames() {
+		if i > 0 && name != "" && i < len(groups) {
+			variables[name] = groups[i]
+		}
+	}
+
+	expanded := os.Expand(template, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		if index, err := strconv.Atoi(name); err == nil {
+			if index < len(groups) {
+				return groups[index]
+			}
+			return ""
+		}
+		return variables[name]
+	})
+
+	rewritten, err := reference.ParseNormalizedNamed(expanded)
+	if err != nil {
+		return "", fmt.Errorf("%w: replace template %q expanded to %q: %s", errTemplateExpansion, template, expanded, err.Error())
+	}
+	if _, ok := rewritten.(reference.Tagged); !ok && hasTag {
+		if _, ok := rewritten.(reference.Digested); !ok {
+			expanded += ":" + tagged.Tag()
+		}
+	}
+	if _, ok := rewritten.(reference.Digested); !ok && hasDigest {
+		expanded += "@" + digested.Digest().String()
+	}
+	if rewritten, err = reference.ParseNormalizedNamed(expanded); err != nil {
+		return "", fmt.Errorf("%w: replace template %q expanded to %q: %s", errTemplateExpansion, template, expanded, err.Error())
+	}
+	return rewritten.String(), nil
+}
@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleTransformer_RewriteImageTemplate(t *testing.T) {
+	type testcase struct {
+		name     string
+		matches  []string
+		replace  string
+		image    string
+		expected string
+	}
+	tests := []testcase{
+		{
+			name:     "numbered capture groups are substituted",
+			matches:  []string{`^ghcr.io/([^/]+)/(.+)$`},
+			replace:  "harbor.example.com/ghcr-$1/$2",
+			image:    "ghcr.io/indeedeng/harbor-container-webhook:main",
+			expected: "harbor.example.com/ghcr-indeedeng/harbor-container-webhook:main",
+		},
+		{
+			name:     "named capture groups are substituted",
+			matches:  []string{`^ghcr.io/(?P<org>[^/]+)/(?P<image>[^:@]+)`},
+			replace:  "harbor.example.com/ghcr-${org}/${image}:${tag}",
+			image:    "ghcr.io/indeedeng/harbor-container-webhook:main",
+			expected: "harbor.example.com/ghcr-indeedeng/harbor-container-webhook:main",
+		},
+		{
+			name:     "builtin variables are computed from the normalized reference",
+			matches:  []string{`^docker.io`},
+			replace:  "harbor.example.com/${registry}-proxy/${repository}:${tag}",
+			image:    "nginx",
+			expected: "harbor.example.com/docker.io-proxy/library/nginx:latest",
+		},
+		{
+			name:     "the digest builtin variable is substituted",
+			matches:  []string{`^docker.io`},
+			replace:  "harbor.example.com/dockerhub-proxy/${repository}@${digest}",
+			image:    "busybox@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+			expected: "harbor.example.com/dockerhub-proxy/library/busybox@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+		},
+		{
+			name:     "a named capture group takes precedence over a builtin variable",
+			matches:  []string{`^(?P<registry>[^.]+)\.io/`},
+			replace:  "harbor.example.com/${registry}/${repository}:${tag}",
+			image:    "quay.io/prometheus/node-exporter:v1.9.0",
+			expected: "harbor.example.com/quay/prometheus/node-exporter:v1.9.0",
+		},
+		{
+			name:     "the capture groups of the regex which matched are used",
+			matches:  []string{`^quay.io/(?P<org>[^/]+)/`, `^ghcr.io/(?P<org>[^/]+)/`},
+			replace:  "harbor.example.com/${org}/${repository}:${tag}",
+			image:    "ghcr.io/indeedeng/app:v1",
+			expected: "harbor.example.com/indeedeng/indeedeng/app:v1",
+		},
+		{
+			name:     "the tag is kept if the template doesn't reference it",
+			matches:  []string{`^ghcr.io/(?P<org>[^/]+)/`},
+			replace:  "harbor.example.com/ghcr-${org}/${repository}",
+			image:    "ghcr.io/indeedeng/app:v1",
+			expected: "harbor.example.com/ghcr-indeedeng/indeedeng/app:v1",
+		},
+		{
+			name:     "the digest is kept if the template doesn't reference it",
+			matches:  []string{`^docker.io`},
+			replace:  "harbor.example.com/dockerhub-proxy/${repository}:${tag}",
+			image:    "nginx:1.27@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+			expected: "harbor.example.com/dockerhub-proxy/library/nginx:1.27@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+		},
+		{
+			name:     "the tag variable is dropped for images with only a digest",
+			matches:  []string{`^docker.io`},
+			replace:  "harbor.example.com/dockerhub-proxy/${repository}:${tag}",
+			image:    "busybox@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+			expected: "harbor.example.com/dockerhub-proxy/library/busybox@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			transformer, err := newRuleTransformer(config.ProxyRule{
+				Name:    "template",
+				Matches: tc.matches,
+				Replace: tc.replace,
+			})
+			require.NoError(t, err)
+			rewritten, err := transformer.RewriteImage(tc.image)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, rewritten)
+		})
+	}
+}
+
+func TestRuleTransformer_RewriteImageTemplateInvalidReference(t *testing.T) {
+	transformer, err := newRuleTransformer(config.ProxyRule{
+		Name:    "template",
+		Matches: []string{`^docker.io/(?P<org>[^/]+)/`},
+		Replace: "harbor.example.com/dockerhub-proxy/${org}-/${repository}",
+	})
+	require.NoError(t, err)
+	rewritten, err := transformer.RewriteImage("busybox:1.37")
+	require.NoError(t, err, "an invalid rewritten reference means the rule doesn't apply to the image")
+	require.Equal(t, "busybox:1.37", rewritten)
+	reason, excluded := noMatchReason(transformer, "busybox:1.37")
+	require.Contains(t, reason, "produced an invalid image reference")
+	require.False(t, excluded)
+}
+
+func TestValidateReplaceTemplate(t *testing.T) {
+	type testcase struct {
+		name        string
+		matches     []string
+		template    string
+		expectedErr string
+	}
+	tests := []testcase{
+		{
+			name:     "builtin variables are always valid",
+			matches:  []string{`^docker.io`},
+			template: "harbor.example.com/${registry}/${repository}:${tag}@${digest}",
+		},
+		{
+			name:     "escaped dollar signs are valid",
+			matches:  []string{`^docker.io`},
+			template: "harbor.example.com/$$/${repository}",
+		},
+		{
+			name:        "numbered groups must exist",
+			matches:     []string{`^ghcr.io/([^/]+)/`},
+			template:    "harbor.example.com/$2",
+			expectedErr: `capture group $2 is not in match regex "^ghcr.io/([^/]+)/"`,
+		},
+		{
+			name:        "named groups must exist",
+			matches:     []string{`^ghcr.io/(?P<org>[^/]+)/`},
+			template:    "harbor.example.com/${team}/${repository}",
+			expectedErr: `capture group ${team} is not in match regex "^ghcr.io/(?P<org>[^/]+)/"`,
+		},
+		{
+			name:        "groups must exist in every match regex",
+			matches:     []string{`^ghcr.io/(?P<org>[^/]+)/`, `^quay.io`},
+			template:    "harbor.example.com/${org}/${repository}",
+			expectedErr: `capture group ${org} is not in match regex "^quay.io"`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			matches := make([]*regexp.Regexp, 0, len(tc.matches))
+			for _, match := range tc.matches {
+				matches = append(matches, regexp.MustCompile(match))
+			}
+			err := validateReplaceTemplate(tc.template, matches)
+			if tc.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
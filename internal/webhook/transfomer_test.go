@@ -1,8 +1,21 @@
 package webhook
 
 import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
 	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
 
 	"github.com/stretchr/testify/require"
@@ -76,3 +89,302 @@ func TestRuleTransformer_RewriteImage(t *testing.T) {
 		})
 	}
 }
+
+func TestRuleTransformer_AppliesTo(t *testing.T) {
+	type testcase struct {
+		name      string
+		rule      config.ProxyRule
+		namespace Namespace
+		expected  bool
+	}
+	tests := []testcase{
+		{
+			name:      "a rule without a namespace scope applies to every namespace",
+			rule:      config.ProxyRule{},
+			namespace: Namespace{Name: "team-a"},
+			expected:  true,
+		},
+		{
+			name:      "a rule scoped by name applies to the listed namespaces",
+			rule:      config.ProxyRule{Namespaces: []string{"team-a", "team-b"}},
+			namespace: Namespace{Name: "team-b"},
+			expected:  true,
+		},
+		{
+			name:      "a rule scoped by name does not apply to other namespaces",
+			rule:      config.ProxyRule{Namespaces: []string{"team-a"}},
+			namespace: Namespace{Name: "team-c"},
+			expected:  false,
+		},
+		{
+			name: "a rule scoped by label selector applies to namespaces with matching labels",
+			rule: config.ProxyRule{NamespaceSelector: &config.LabelSelector{
+				MatchLabels: map[string]string{"team": "a"},
+			}},
+			namespace: Namespace{Name: "team-a-dev", Labels: map[string]string{"team": "a"}},
+			expected:  true,
+		},
+		{
+			name: "a rule scoped by label selector expressions does not apply to namespaces without matching labels",
+			rule: config.ProxyRule{NamespaceSelector: &config.LabelSelector{
+				MatchExpressions: []config.LabelSelectorRequirement{{Key: "team", Operator: "In", Values: []string{"a", "b"}}},
+			}},
+			namespace: Namespace{Name: "team-c", Labels: map[string]string{"team": "c"}},
+			expected:  false,
+		},
+		{
+			name: "a rule scoped by name and label selector applies to namespaces matching either",
+			rule: config.ProxyRule{
+				Namespaces:        []string{"team-a"},
+				NamespaceSelector: &config.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+			},
+			namespace: Namespace{Name: "team-a"},
+			expected:  true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.rule.Name = "scoped"
+			transformer, err := newRuleTransformer(tc.rule)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, transformer.AppliesTo(tc.namespace))
+		})
+	}
+}
+
+func TestRuleTransformer_InvalidNamespaceSelector(t *testing.T) {
+	_, err := newRuleTransformer(config.ProxyRule{
+		Name: "invalid selector",
+		NamespaceSelector: &config.LabelSelector{
+			MatchExpressions: []config.LabelSelectorRequirement{{Key: "team", Operator: "Matches"}},
+		},
+	})
+	require.Error(t, err)
+}
+
+func TestRuleTransformer_RewritePath(t *testing.T) {
+	type testcase struct {
+		name     string
+		rule     config.ProxyRule
+		image    string
+		expected string
+	}
+	tests := []testcase{
+		{
+			name: "the library prefix is stripped from an image with a tag",
+			rule: config.ProxyRule{
+				Matches:     []string{"^docker.io"},
+				Replace:     "harbor.example.com/dockerhub-flat",
+				RewritePath: &config.PathRewrite{StripPrefix: "library/"},
+			},
+			image:    "nginx:1.27",
+			expected: "harbor.example.com/dockerhub-flat/nginx:1.27",
+		},
+		{
+			name: "the library prefix is stripped from an image with a digest",
+			rule: config.ProxyRule{
+				Matches:     []string{"^docker.io"},
+				Replace:     "harbor.example.com/dockerhub-flat",
+				RewritePath: &config.PathRewrite{StripPrefix: "library/"},
+			},
+			image:    "docker.io/library/busybox@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+			expected: "harbor.example.com/dockerhub-flat/busybox@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+		},
+		{
+			name: "an image without the stripped prefix is only rewritten by registry",
+			rule: config.ProxyRule{
+				Matches:     []string{"^docker.io"},
+				Replace:     "harbor.example.com/dockerhub-flat",
+				RewritePath: &config.PathRewrite{StripPrefix: "library/"},
+			},
+			image:    "bitnami/redis:7.4",
+			expected: "harbor.example.com/dockerhub-flat/bitnami/redis:7.4",
+		},
+		{
+			name: "the path is substituted by regex and a prefix added to an image with a tag and digest",
+			rule: config.ProxyRule{
+				Matches: []string{"^quay.io"},
+				Replace: "harbor.example.com",
+				RewritePath: &config.PathRewrite{
+					Regex:       "/",
+					Replacement: "-",
+					AddPrefix:   "quay/",
+				},
+			},
+			image:    "quay.io/prometheus/node-exporter:v1.9.0@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+			expected: "harbor.example.com/quay/prometheus-node-exporter:v1.9.0@sha256:7cc4b5aefd1d0cadf8d97d4350462ba51c694ebca145b08d7d41b41acc8db5aa",
+		},
+		{
+			name: "the path regex may reference capture groups",
+			rule: config.ProxyRule{
+				Matches: []string{"^quay.io"},
+				Replace: "harbor.example.com/quay",
+				RewritePath: &config.PathRewrite{
+					Regex:       "^(?P<org>[^/]+)/(?P<image>.+)$",
+					Replacement: "${org}-${image}",
+				},
+			},
+			image:    "quay.io/prometheus/node-exporter:v1.9.0",
+			expected: "harbor.example.com/quay/prometheus-node-exporter:v1.9.0",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.rule.Name = "rewrite path"
+			transformer, err := newRuleTransformer(tc.rule)
+			require.NoError(t, err)
+			rewritten, err := transformer.RewriteImage(tc.image)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, rewritten)
+		})
+	}
+}
+
+func TestRuleTransformer_RewritePathInvalid(t *testing.T) {
+	_, err := newRuleTransformer(config.ProxyRule{
+		Name:        "invalid regex",
+		Matches:     []string{"^quay.io"},
+		Replace:     "harbor.example.com/quay",
+		RewritePath: &config.PathRewrite{Regex: "(unclosed"},
+	})
+	require.ErrorContains(t, err, "failed to compile rewritePath regex")
+
+	_, err = newRuleTransformer(config.ProxyRule{
+		Name:        "template",
+		Matches:     []string{"^quay.io"},
+		Replace:     "harbor.example.com/quay/${repository}:${tag}",
+		RewritePath: &config.PathRewrite{StripPrefix: "library/"},
+	})
+	require.ErrorContains(t, err, "can't be combined")
+}
+
+func TestRuleTransformer_Mode(t *testing.T) {
+	for mode, audit := range map[string]bool{"": false, config.ModeEnforce: false, config.ModeAudit: true} {
+		transformer, err := newRuleTransformer(config.ProxyRule{Name: "mode", Mode: mode})
+		require.NoError(t, err)
+		require.Equal(t, audit, transformer.Audit(), mode)
+	}
+	_, err := newRuleTransformer(config.ProxyRule{Name: "mode", Mode: "dry-run"})
+	require.ErrorContains(t, err, "invalid mode")
+}
+
+func TestRuleTransformer_Fallbacks(t *testing.T) {
+	transformer, err := newRuleTransformer(config.ProxyRule{
+		Name:     "fallbacks",
+		Matches:  []string{"^docker.io/(?P<path>.*)$"},
+		Excludes: []string{"^docker.io/(library/)?ubuntu:.*$"},
+		Replace:  "harbor.eu.example.com/dockerhub-proxy",
+		Fallbacks: []string{
+			"harbor.example.com/dockerhub-proxy",
+			"harbor.example.com/flat/${path}",
+			config.FallbackOrigin,
+		},
+	})
+	require.NoError(t, err)
+
+	fallbacks, err := transformer.Fallbacks("nginx:1.27")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"harbor.example.com/dockerhub-proxy/library/nginx:1.27",
+		"harbor.example.com/flat/library/nginx:1.27",
+		"nginx:1.27",
+	}, fallbacks)
+
+	fallbacks, err = transformer.Fallbacks("ubuntu:24.04")
+	require.NoError(t, err)
+	require.Empty(t, fallbacks, "excluded images have no fallbacks")
+
+	fallbacks, err = transformer.Fallbacks("quay.io/prometheus/prometheus:v3.0.0")
+	require.NoError(t, err)
+	require.Empty(t, fallbacks, "unmatched images have no fallbacks")
+}
+
+func TestRuleTransformer_FallbacksInvalid(t *testing.T) {
+	_, err := newRuleTransformer(config.ProxyRule{
+		Name:      "origin first",
+		Matches:   []string{"^docker.io"},
+		Replace:   "harbor.eu.example.com/dockerhub-proxy",
+		Fallbacks: []string{config.FallbackOrigin, "harbor.example.com/dockerhub-proxy"},
+	})
+	require.ErrorContains(t, err, "must be the last fallback")
+
+	_, err = newRuleTransformer(config.ProxyRule{
+		Name:      "unknown variable",
+		Matches:   []string{"^docker.io"},
+		Replace:   "harbor.eu.example.com/dockerhub-proxy",
+		Fallbacks: []string{"harbor.example.com/${unknown}"},
+	})
+	require.ErrorContains(t, err, "invalid fallback")
+
+	_, err = newRuleTransformer(config.ProxyRule{
+		Name:        "template with rewritePath",
+		Matches:     []string{"^docker.io"},
+		Replace:     "harbor.eu.example.com/dockerhub-proxy",
+		Fallbacks:   []string{"harbor.example.com/${repository}:${tag}"},
+		RewritePath: &config.PathRewrite{StripPrefix: "library/"},
+	})
+	require.ErrorContains(t, err, "can't be combined")
+}
+
+func TestRuleTransformer_Registries(t *testing.T) {
+	transformer, err := newRuleTransformer(config.ProxyRule{
+		Name:    "registries",
+		Matches: []string{"^docker.io/(?P<path>.*)$"},
+		Replace: "harbor-eu.example.com/dockerhub-proxy",
+		Fallbacks: []string{
+			"harbor.example.com:8443/flat/${path}",
+			"${registry}/${repository}:${tag}",
+			config.FallbackOrigin,
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"harbor-eu.example.com", "harbor.example.com:8443"}, transformer.Registries())
+}
+
+func TestRuleTransformer_CheckUpstreamPlatforms(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	index := v1.ImageIndex(empty.Index)
+	for _, platform := range []v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+	} {
+		image, err := random.Image(256, 1)
+		require.NoError(t, err)
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{Add: image, Descriptor: v1.Descriptor{Platform: &platform}})
+	}
+	ref, err := name.ParseReference(host + "/proxy/library/nginx:1.27")
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(ref, index))
+
+	type testcase struct {
+		platforms []string
+		found     bool
+	}
+	tests := []testcase{
+		{platforms: []string{"linux/amd64"}, found: true},
+		{platforms: []string{"linux/arm"}, found: true},
+		{platforms: []string{"linux/arm/v7"}, found: true},
+		{platforms: []string{"linux/amd64", "linux/arm/v7"}, found: true},
+		{platforms: []string{"linux/arm/v6"}},
+		{platforms: []string{"linux/amd64/v2"}},
+		{platforms: []string{"linux/arm64"}},
+	}
+	for _, tc := range tests {
+		transformers, err := MakeTransformers([]config.ProxyRule{
+			{
+				Name:          "docker.io proxy cache",
+				Matches:       []string{"^docker.io"},
+				Replace:       host + "/proxy",
+				CheckUpstream: true,
+				Platforms:     tc.platforms,
+			},
+		}, nil)
+		require.NoError(t, err)
+		image, err := transformers[0].CheckUpstream(context.TODO(), ref.String())
+		require.NoError(t, err)
+		require.Equal(t, tc.found, image.Found, tc.platforms)
+	}
+}
@@ -2,16 +2,19 @@ package webhook
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/containerd/containerd/images"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 
 	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
 
@@ -19,7 +22,9 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 
-	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
@@ -64,28 +69,106 @@ func init() {
 
 var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
 
+// Namespace is the namespace of an admission request and its labels, used to scope rules to namespaces.
+type Namespace struct {
+	Name   string
+	Labels map[string]string
+}
+
 // ContainerTransformer rewrites docker image references for harbor proxy cache projects.
 type ContainerTransformer interface {
 	// Name returns the name of the transformer rule
 	Name() string
 
+	// AppliesTo returns if the rule is in scope for pods in the namespace.
+	AppliesTo(namespace Namespace) bool
+
+	// Audit returns if the rule is in audit mode, where rewrites are only recorded and not applied.
+	Audit() bool
+
+	// ImagePullSecret returns the image pull secret added to pods whose images the rule rewrites, or an empty name.
+	ImagePullSecret() types.NamespacedName
+
 	// RewriteImage takes a docker image reference and returns the same image reference rewritten for a harbor
 	// proxy cache project endpoint, if one is available, else returns the original image reference.
 	RewriteImage(imageRef string) (string, error)
 
+	// Fallbacks returns the image reference rewritten for each fallback of the rule in order, to use when the
+	// registry of the previous one is unhealthy. The original image reference is returned for the origin fallback.
+	Fallbacks(imageRef string) ([]string, error)
+
+	// SkipUnhealthy returns if the rule doesn't rewrite images to registries which are unhealthy.
+	SkipUnhealthy() bool
+
+	// Registries returns the registries the rule rewrites images to, which can be known without an image.
+	Registries() []string
+
 	// CheckUpstream ensures that the docker image reference exists in the upstream registry
-	// and returns if the image exists, or an error if the registry can't be contacted.
-	CheckUpstream(ctx context.Context, imageRef string) (bool, error)
+	// and returns if the image exists and the digest to pin it to, or an error if the registry can't be contacted.
+	CheckUpstream(ctx context.Context, imageRef string) (UpstreamImage, error)
+}
+
+// UpstreamImage is the result of checking a rewritten image in the upstream registry.
+type UpstreamImage struct {
+	// Found is set if the image exists for every required platform.
+	Found bool
+	// Digest is the digest of the image manifest or manifest list, if the image should be pinned to it.
+	Digest string
+	// Checked is set if the manifest was fetched from the registry or the cache, and not set for rules which neither
+	// check upstream nor pin digests.
+	Checked bool
+}
+
+// TransformerOption configures optional behavior shared by the transformers created by MakeTransformers.
+type TransformerOption func(*ruleTransformer)
+
+// WithUpstreamCache shares the cache of upstream manifest checks between transformers.
+func WithUpstreamCache(cache *UpstreamCache) TransformerOption {
+	return func(t *ruleTransformer) {
+		t.cache = cache
+	}
+}
+
+// WithSecretKeychain shares the parsed auth secrets between transformers.
+func WithSecretKeychain(keychain *SecretKeychain) TransformerOption {
+	return func(t *ruleTransformer) {
+		t.keychain = keychain
+	}
 }
 
-func MakeTransformers(rules []config.ProxyRule, client client.Client) ([]ContainerTransformer, error) {
+// WithRegistryHealth reports the registries failing upstream checks to the shared health tracker.
+func WithRegistryHealth(health *RegistryHealth) TransformerOption {
+	return func(t *ruleTransformer) {
+		t.health = health
+	}
+}
+
+// WithCredentialProviders sets the credential provider plugins which rules with the exec auth provider can run.
+func WithCredentialProviders(providers []config.CredentialProvider) TransformerOption {
+	byName := make(map[string]config.CredentialProvider, len(providers))
+	for _, provider := range providers {
+		byName[provider.Name] = provider
+	}
+	return func(t *ruleTransformer) {
+		t.credentialProviders = byName
+	}
+}
+
+func MakeTransformers(rules []config.ProxyRule, client client.Client, opts ...TransformerOption) ([]ContainerTransformer, error) {
 	transformers := make([]ContainerTransformer, 0, len(rules))
 	for _, rule := range rules {
 		transformer, err := newRuleTransformer(rule)
-		transformer.client = client
 		if err != nil {
 			return nil, err
 		}
+		transformer.client = client
+		for _, opt := range opts {
+			opt(transformer)
+		}
+		if transformer.keychain == nil {
+			transformer.keychain = &SecretKeychain{Client: client}
+		}
+		transformer.authenticator = newUpstreamAuthenticator(rule, transformer.keychain, transformer.credentialProviders)
 		transformers = append(transformers, transformer)
 	}
 	return transformers, nil
@@ -95,10 +178,25 @@ type ruleTransformer struct {
 	rule       config.ProxyRule
 	metricName string
 
-	client client.Client
+	client              client.Client
+	cache               *UpstreamCache
+	keychain            *SecretKeychain
+	credentialProviders map[string]config.CredentialProvider
+	authenticator       upstreamAuthenticator
+	health              *RegistryHealth
 
 	matches  []*regexp.Regexp
 	excludes []*regexp.Regexp
+
+	// template is set if the replace string is a template for the whole rewritten image reference
+	template bool
+	// fallbacks are the compiled fallback replacements of the rule
+	fallbacks []replacement
+	// pathRegex is the compiled regex of the rule's path rewrite, if set
+	pathRegex *regexp.Regexp
+
+	namespaces        map[string]bool
+	namespaceSelector labels.Selector
 }
 
 var _ ContainerTransformer = (*ruleTransformer)(nil)
@@ -106,10 +204,15 @@ var _ ContainerTransformer = (*ruleTransformer)(nil)
 func newRuleTransformer(rule config.ProxyRule) (*ruleTransformer, error) {
 	transformer := &ruleTransformer{
 		rule:       rule,
-		metricName: invalidMetricChars.ReplaceAllString(strings.ToLower(rule.Name), "_"),
+		metricName: metricName(rule.Name),
 		matches:    make([]*regexp.Regexp, 0, len(rule.Matches)),
 		excludes:   make([]*regexp.Regexp, 0, len(rule.Excludes)),
 	}
+	switch rule.Mode {
+	case "", config.ModeEnforce, config.ModeAudit:
+	default:
+		return nil, fmt.Errorf("invalid mode %q, must be %q or %q", rule.Mode, config.ModeEnforce, config.ModeAudit)
+	}
 	for _, matchRegex := range rule.Matches {
 		matcher, err := regexp.Compile(matchRegex)
 		if err != nil {
@@ -124,40 +227,223 @@ func newRuleTransformer(rule config.ProxyRule) (*ruleTransformer, error) {
 		}
 		transformer.excludes = append(transformer.excludes, excluder)
 	}
+	replace, err := newReplacement(rule.Replace, rule, transformer.matches)
+	if err != nil {
+		return nil, err
+	}
+	transformer.template = replace.template
+	for i, fallback := range rule.Fallbacks {
+		if fallback == config.FallbackOrigin {
+			if i != len(rule.Fallbacks)-1 {
+				return nil, fmt.Errorf("the %s fallback must be the last fallback", config.FallbackOrigin)
+			}
+			transformer.fallbacks = append(transformer.fallbacks, replacement{origin: true})
+			continue
+		}
+		compiled, err := newReplacement(fallback, rule, transformer.matches)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback: %w", err)
+		}
+		transformer.fallbacks = append(transformer.fallbacks, compiled)
+	}
+	if rule.RewritePath != nil {
+		if rule.RewritePath.Regex != "" {
+			pathRegex, err := regexp.Compile(rule.RewritePath.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compile rewritePath regex %q: %w", rule.RewritePath.Regex, err)
+			}
+			transformer.pathRegex = pathRegex
+		}
+	}
+	if err := validateUpstreamAuth(rule, transformer.Registries()); err != nil {
+		return nil, err
+	}
+	if len(rule.Namespaces) > 0 {
+		transformer.namespaces = make(map[string]bool, len(rule.Namespaces))
+		for _, namespace := range rule.Namespaces {
+			transformer.namespaces[namespace] = true
+		}
+	}
+	if rule.NamespaceSelector != nil {
+		selector, err := namespaceSelector(rule.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse namespace selector: %w", err)
+		}
+		transformer.namespaceSelector = selector
+	}
 
 	return transformer, nil
 }
 
+// replacement is a compiled replace string of a rule, either its Replace or one of its Fallbacks.
+type replacement struct {
+	replace string
+	// template is set if the replace string is a template for the whole rewritten image reference
+	template bool
+	// origin keeps the original image
+	origin bool
+}
+
+func newReplacement(replace string, rule config.ProxyRule, matches []*regexp.Regexp) (replacement, error) {
+	if !isReplaceTemplate(replace) {
+		return replacement{replace: replace}, nil
+	}
+	if err := validateReplaceTemplate(replace, matches); err != nil {
+		return replacement{}, err
+	}
+	if rule.RewritePath != nil {
+		return replacement{}, fmt.Errorf("rewritePath can't be combined with the replace template %q", replace)
+	}
+	return replacement{replace: replace, template: true}, nil
+}
+
+// metricName converts the rule name into a prometheus label value.
+func metricName(name string) string {
+	return invalidMetricChars.ReplaceAllString(strings.ToLower(name), "_")
+}
+
+func namespaceSelector(selector *config.LabelSelector) (labels.Selector, error) {
+	labelSelector := &metav1.LabelSelector{MatchLabels: selector.MatchLabels}
+	for _, expression := range selector.MatchExpressions {
+		labelSelector.MatchExpressions = append(labelSelector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      expression.Key,
+			Operator: metav1.LabelSelectorOperator(expression.Operator),
+			Values:   expression.Values,
+		})
+	}
+	return metav1.LabelSelectorAsSelector(labelSelector)
+}
+
 func (t *ruleTransformer) Name() string {
 	return t.rule.Name
 }
 
-func (t *ruleTransformer) CheckUpstream(ctx context.Context, imageRef string) (bool, error) {
-	if !t.rule.CheckUpstream {
-		return true, nil
+func (t *ruleTransformer) Audit() bool {
+	return t.rule.Mode == config.ModeAudit
+}
+
+func (t *ruleTransformer) ImagePullSecret() types.NamespacedName {
+	if t.rule.ImagePullSecret == "" {
+		return types.NamespacedName{}
 	}
+	namespace := t.rule.ImagePullSecretNamespace
+	if namespace == "" {
+		namespace = t.rule.Namespace
+	}
+	return types.NamespacedName{Namespace: namespace, Name: t.rule.ImagePullSecret}
+}
 
-	options := make([]crane.Option, 0)
-	if t.rule.AuthSecretName != "" {
-		auth, err := t.auth(ctx, imageRef)
-		if err != nil {
-			return false, err
+func (t *ruleTransformer) SkipUnhealthy() bool {
+	return t.rule.SkipUnhealthy
+}
+
+func (t *ruleTransformer) Registries() []string {
+	registries := make([]string, 0, len(t.fallbacks)+1)
+	for _, r := range append([]replacement{{replace: t.rule.Replace, template: t.template}}, t.fallbacks...) {
+		if r.origin {
+			continue
+		}
+		registry, _, _ := strings.Cut(r.replace, "/")
+		if registry != "" && !strings.Contains(registry, "$") {
+			registries = append(registries, registry)
 		}
-		options = append(options, crane.WithAuth(auth))
 	}
+	return registries
+}
+
+func (t *ruleTransformer) AppliesTo(namespace Namespace) bool {
+	if t.namespaces == nil && t.namespaceSelector == nil {
+		return true
+	}
+	if t.namespaces[namespace.Name] {
+		return true
+	}
+	return t.namespaceSelector != nil && t.namespaceSelector.Matches(labels.Set(namespace.Labels))
+}
+
+func (t *ruleTransformer) CheckUpstream(ctx context.Context, imageRef string) (UpstreamImage, error) {
+	if !t.rule.CheckUpstream && !t.rule.PinDigest {
+		return UpstreamImage{Found: true}, nil
+	}
+	image, err := t.cache.Check(ctx, upstreamCacheKey(t.rule, imageRef), func(ctx context.Context) (UpstreamImage, error) {
+		return t.fetchUpstream(ctx, imageRef)
+	})
+	if err != nil {
+		return UpstreamImage{}, err
+	}
+	image.Checked = true
+	if !t.rule.CheckUpstream && image.Digest != "" {
+		// the manifest was only fetched for its digest, so the platforms aren't required
+		image.Found = true
+	}
+	if !t.rule.PinDigest {
+		image.Digest = ""
+	}
+	return image, nil
+}
+
+// registryUnavailable returns if the error of a registry request means the registry is down, rather than rejecting the
+// request, e.g. because the image doesn't exist.
+func registryUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var transportErr *transport.Error
+	if !errors.As(err, &transportErr) {
+		return true
+	}
+	return transportErr.StatusCode >= http.StatusInternalServerError || transportErr.StatusCode == http.StatusTooManyRequests
+}
+
+// manifestNotFound returns if the error of a manifest request means the registry doesn't have the image.
+func manifestNotFound(err error) bool {
+	var transportErr *transport.Error
+	if !errors.As(err, &transportErr) {
+		return false
+	}
+	if transportErr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	for _, diagnostic := range transportErr.Errors {
+		if diagnostic.Code == transport.ManifestUnknownErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchUpstream fetches the manifest of the image reference and checks it's available for the rule's platforms.
+func (t *ruleTransformer) fetchUpstream(ctx context.Context, imageRef string) (UpstreamImage, error) {
+	auth, err := t.authenticator.Authenticator(ctx, imageRef)
+	if err != nil {
+		upstreamErrors.WithLabelValues(t.metricName).Inc()
+		return UpstreamImage{}, err
+	}
+	options := []crane.Option{crane.WithAuth(auth)}
 	// we don't pass in the platform to crane to retrieve the full manifest list for multi-arch
 	options = append(options, crane.WithContext(ctx))
 	manifestBytes, err := crane.Manifest(imageRef, options...)
+	if registry, registryErr := RegistryFromImageRef(imageRef); registryErr == nil {
+		if registryUnavailable(err) {
+			t.health.ReportFailure(registry)
+		} else {
+			t.health.ReportSuccess(registry)
+		}
+	}
+	if manifestNotFound(err) {
+		return UpstreamImage{}, nil
+	}
 	if err != nil {
 		upstreamErrors.WithLabelValues(t.metricName).Inc()
-		return false, err
+		return UpstreamImage{}, err
 	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifestBytes))
 
 	// try and parse the manifest to decode the MediaType to determine if it's a manifest or manifest list
 	manifest := slimManifest{}
 	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
 		upstreamErrors.WithLabelValues(t.metricName).Inc()
-		return false, fmt.Errorf("failed to parse manifest %s payload=%s: %w", imageRef, string(manifestBytes), err)
+		return UpstreamImage{}, fmt.Errorf("failed to parse manifest %s payload=%s: %w", imageRef, string(manifestBytes), err)
 	}
 
 	switch manifest.MediaType {
@@ -165,13 +451,12 @@ func (t *ruleTransformer) CheckUpstream(ctx context.Context, imageRef string) (b
 		manifestList := slimManifestList{}
 		if err := json.Unmarshal(manifestBytes, &manifestList); err != nil {
 			upstreamErrors.WithLabelValues(t.metricName).Inc()
-			return false, fmt.Errorf("failed to parse manifest list %s, payload=%s: %w", imageRef, string(manifestBytes), err)
+			return UpstreamImage{}, fmt.Errorf("failed to parse manifest list %s, payload=%s: %w", imageRef, string(manifestBytes), err)
 		}
 		matches := 0
 		for _, rulePlatform := range t.rule.Platforms {
 			for _, subManifest := range manifestList.Manifests {
-				subPlatform := subManifest.Platform.OS + "/" + subManifest.Platform.Architecture
-				if subPlatform == rulePlatform {
+				if subManifest.Platform.matches(rulePlatform) {
 					matches++
 					break
 				}
@@ -179,50 +464,20 @@ func (t *ruleTransformer) CheckUpstream(ctx context.Context, imageRef string) (b
 		}
 		if matches == len(t.rule.Platforms) {
 			upstream.WithLabelValues(t.metricName).Inc()
-			return true, nil
+			return UpstreamImage{Found: true, Digest: digest}, nil
 		}
 
-		return false, nil
+		return UpstreamImage{Digest: digest}, nil
 	case images.MediaTypeDockerSchema1Manifest, images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
 		upstream.WithLabelValues(t.metricName).Inc()
-		return true, nil
+		return UpstreamImage{Found: true, Digest: digest}, nil
 	default:
 		logger.Info(fmt.Sprintf("unknown manifest media type: %s, rule=%s,imageRef=%s", manifest.MediaType, t.rule.Name, imageRef))
 		upstream.WithLabelValues(t.metricName).Inc()
-		return true, nil
+		return UpstreamImage{Found: true, Digest: digest}, nil
 	}
 }
 
-func (t *ruleTransformer) auth(ctx context.Context, imageRef string) (authn.Authenticator, error) {
-	var secret corev1.Secret
-	logger.Info("token key: ", "key", client.ObjectKey{Namespace: t.rule.Namespace, Name: t.rule.AuthSecretName})
-	if err := t.client.Get(ctx, client.ObjectKey{Namespace: t.rule.Namespace, Name: t.rule.AuthSecretName}, &secret); err != nil {
-		return nil, fmt.Errorf("failed to get secret %q for upstream manifests: %w", t.rule.AuthSecretName, err)
-	}
-
-	if dockerConfigJSONBytes, dockerConfigJSONExists := secret.Data[corev1.DockerConfigJsonKey]; (secret.Type == corev1.SecretTypeDockerConfigJson) && dockerConfigJSONExists && (len(dockerConfigJSONBytes) > 0) {
-		dockerConfigJSON := DockerConfigJSON{}
-		if err := json.Unmarshal(dockerConfigJSONBytes, &dockerConfigJSON); err != nil {
-			return nil, err
-		}
-		for key, method := range dockerConfigJSON.Auths {
-			keyRegex := regexp.MustCompile(key)
-			if keyRegex.Find([]byte(imageRef)) != nil {
-				if method.Auth != "" {
-					user, pass, err := decodeDockerConfigFieldAuth(method.Auth)
-					if err != nil {
-						return nil, fmt.Errorf("failed to parse auth docker config auth field in secret %q", t.rule.AuthSecretName)
-					}
-					return &authn.Basic{Username: user, Password: pass}, nil
-				}
-				return &authn.Basic{Username: method.Username, Password: method.Password}, nil
-			}
-		}
-	}
-
-	return nil, fmt.Errorf("failed to parse auth secret %q, no docker config found", t.rule.AuthSecretName)
-}
-
 func (t *ruleTransformer) RewriteImage(imageRef string) (string, error) {
 	start := time.Now()
 	rewritten, updatedRef, err := t.doRewriteImage(imageRef)
@@ -247,21 +502,79 @@ func (t *ruleTransformer) doRewriteImage(imageRef string) (rewritten bool, updat
 		return false, "", err
 	}
 
-	if t.findMatch(normalizedRef) && !t.anyExclusion(normalizedRef) {
-		updatedRef, err = ReplaceRegistryInImageRef(imageRef, t.rule.Replace)
+	if matcher := t.findMatch(normalizedRef); matcher != nil && !t.anyExclusion(normalizedRef) {
+		updatedRef, err = t.replace(replacement{replace: t.rule.Replace, template: t.template}, matcher, imageRef, normalizedRef)
+		if errors.Is(err, errTemplateExpansion) {
+			logger.Info(fmt.Sprintf("rule %q not rewriting %q: %s", t.rule.Name, imageRef, err.Error()))
+			return false, imageRef, nil
+		}
 		return true, updatedRef, err
 	}
 
 	return false, imageRef, nil
 }
 
-func (t *ruleTransformer) findMatch(imageRef string) bool {
+func (t *ruleTransformer) Fallbacks(imageRef string) ([]string, error) {
+	if len(t.fallbacks) == 0 {
+		return nil, nil
+	}
+	registry, err := RegistryFromImageRef(imageRef)
+	if err != nil {
+		return nil, err
+	}
+	normalizedRef, err := ReplaceRegistryInImageRef(imageRef, registry)
+	if err != nil {
+		return nil, err
+	}
+	matcher := t.findMatch(normalizedRef)
+	if matcher == nil || t.anyExclusion(normalizedRef) {
+		return nil, nil
+	}
+	fallbacks := make([]string, 0, len(t.fallbacks))
+	for _, fallback := range t.fallbacks {
+		updatedRef, err := t.replace(fallback, matcher, imageRef, normalizedRef)
+		if errors.Is(err, errTemplateExpansion) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fallbacks = append(fallbacks, updatedRef)
+	}
+	return fallbacks, nil
+}
+
+// replace rewrites an image matched by the matcher with the replacement.
+func (t *ruleTransformer) replace(r replacement, matcher *regexp.Regexp, imageRef, normalizedRef string) (string, error) {
+	switch {
+	case r.origin:
+		return imageRef, nil
+	case r.template:
+		return expandReplaceTemplate(r.replace, matcher, imageRef, normalizedRef)
+	case t.rule.RewritePath != nil:
+		return ReplaceRegistryAndPathInImageRef(imageRef, r.replace, t.rewritePath)
+	default:
+		return ReplaceRegistryInImageRef(imageRef, r.replace)
+	}
+}
+
+// rewritePath applies the rule's path rewrite to the repository path of an image.
+func (t *ruleTransformer) rewritePath(path string) string {
+	path = strings.TrimPrefix(path, t.rule.RewritePath.StripPrefix)
+	if t.pathRegex != nil {
+		path = t.pathRegex.ReplaceAllString(path, t.rule.RewritePath.Replacement)
+	}
+	return t.rule.RewritePath.AddPrefix + path
+}
+
+// findMatch returns the first match regex which matches the image reference, or nil if none match.
+func (t *ruleTransformer) findMatch(imageRef string) *regexp.Regexp {
 	for _, rule := range t.matches {
 		if rule.MatchString(imageRef) {
-			return true
+			return rule
 		}
 	}
-	return false
+	return nil
 }
 
 func (t *ruleTransformer) anyExclusion(imageRef string) bool {
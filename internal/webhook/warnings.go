@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+)
+
+// admissionWarnings collects the warnings returned to the client of an admission request, such as kubectl, up to the
+// configured verbosity. A nil collector discards every warning.
+type admissionWarnings struct {
+	// level is the verbosity of the warnings, config.WarningsDegraded if unset.
+	level    string
+	messages []string
+}
+
+func newAdmissionWarnings(level string) *admissionWarnings {
+	return &admissionWarnings{level: level}
+}
+
+// enabled returns if warnings of the verbosity are collected. Verbose warnings are about images which aren't
+// rewritten by design, as opposed to rewrites skipped or degraded by a failure.
+func (w *admissionWarnings) enabled(verbose bool) bool {
+	if w == nil || w.level == config.WarningsNone {
+		return false
+	}
+	return !verbose || w.level == config.WarningsAll
+}
+
+// add collects the warning if its verbosity is enabled, on a single line. The API server truncates long warnings if
+// a response has too many.
+func (w *admissionWarnings) add(verbose bool, format string, args ...interface{}) {
+	if !w.enabled(verbose) {
+		return
+	}
+	message := strings.ReplaceAll(fmt.Sprintf(format, args...), "\n", " ")
+	for _, existing := range w.messages {
+		if existing == message {
+			return
+		}
+	}
+	w.messages = append(w.messages, message)
+}
+
+// list returns the collected warnings, for admission.Response.WithWarnings.
+func (w *admissionWarnings) list() []string {
+	if w == nil {
+		return nil
+	}
+	return w.messages
+}
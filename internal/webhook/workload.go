@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// WorkloadContainerProxier mutates the pod templates of workload controllers with the same rules as the
+// PodContainerProxier, so that the stored workload matches the pods it creates.
+type WorkloadContainerProxier struct {
+	Decoder admission.Decoder
+	Pods    *PodContainerProxier
+	// Workloads is the set of enabled workload resources, e.g. "deployments".
+	Workloads map[string]bool
+}
+
+// Handle mutates the pod template of deployments, statefulsets, daemonsets, jobs and cronjobs. Updates are only
+// mutated if they change the pod template, so that a rule change doesn't roll out workloads on unrelated updates, and
+// never for jobs, whose pod template is immutable.
+func (w *WorkloadContainerProxier) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if !w.Workloads[req.Resource.Resource] {
+		return admission.Allowed("workload not enabled")
+	}
+	if req.Operation == admissionv1.Update && req.Resource.Resource == "jobs" {
+		return admission.Allowed("the pod template of jobs is immutable")
+	}
+
+	obj, template, err := newWorkload(req.Resource.Resource)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if err := w.Decoder.Decode(req, obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	podTemplate := template(obj)
+	if req.Operation == admissionv1.Update {
+		old, _, _ := newWorkload(req.Resource.Resource)
+		if err := w.Decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if equality.Semantic.DeepEqual(template(old), podTemplate) {
+			return admission.Allowed("pod template unchanged")
+		}
+	}
+
+	request := podRequest{
+		namespace: w.Pods.lookupNamespace(ctx, req.Namespace),
+		dryRun:    req.DryRun != nil && *req.DryRun,
+		// like for pods, image pull secrets are only added when the workload is created
+		injectPullSecrets: req.Operation == admissionv1.Create,
+		warnings:          newAdmissionWarnings(w.Pods.Warnings),
+	}
+	workload, err := meta.Accessor(obj)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if !request.dryRun {
+		request.events = newPodEvents(w.Pods.Events, req.Kind, workload, req.Namespace)
+	}
+	request.audit = newAdmissionAudit(w.Pods.Audit, req, workload)
+	updated, err := w.Pods.updatePodSpec(ctx, request, &podTemplate.ObjectMeta, &podTemplate.Spec)
+	if err != nil {
+		request.events.record(corev1.EventTypeWarning, EventReasonRewriteFailed, "failed to rewrite the images of the pod template: %s", err.Error())
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if !updated {
+		return admission.Allowed("no updates").WithWarnings(request.warnings.list()...)
+	}
+
+	marshaled, err := json.Marshal(obj)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled).WithWarnings(request.warnings.list()...)
+}
+
+// newWorkload returns an empty object for the workload resource and an accessor for its pod template.
+func newWorkload(resource string) (runtime.Object, func(runtime.Object) *corev1.PodTemplateSpec, error) {
+	switch resource {
+	case "deployments":
+		return &appsv1.Deployment{}, func(o runtime.Object) *corev1.PodTemplateSpec {
+			return &o.(*appsv1.Deployment).Spec.Template
+		}, nil
+	case "statefulsets":
+		return &appsv1.StatefulSet{}, func(o runtime.Object) *corev1.PodTemplateSpec {
+			return &o.(*appsv1.StatefulSet).Spec.Template
+		}, nil
+	case "daemonsets":
+		return &appsv1.DaemonSet{}, func(o runtime.Object) *corev1.PodTemplateSpec {
+			return &o.(*appsv1.DaemonSet).Spec.Template
+		}, nil
+	case "jobs":
+		return &batchv1.Job{}, func(o runtime.Object) *corev1.PodTemplateSpec {
+			return &o.(*batchv1.Job).Spec.Template
+		}, nil
+	case "cronjobs":
+		return &batchv1.CronJob{}, func(o runtime.Object) *corev1.PodTemplateSpec {
+			return &o.(*batchv1.CronJob).Spec.JobTemplate.Spec.Template
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported workload resource %q", resource)
+	}
+}
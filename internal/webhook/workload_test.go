@@ -0,0 +1,190 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+
+	"github.com/stretchr/testify/require"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestWorkloadContainerProxier_Handle(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:    "docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/dockerhub-proxy",
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	decoder := admission.NewDecoder(scheme)
+	proxier := WorkloadContainerProxier{
+		Decoder:   decoder,
+		Pods:      &PodContainerProxier{Decoder: decoder, Transformers: transformers},
+		Workloads: map[string]bool{"deployments": true, "cronjobs": true},
+	}
+
+	podSpec := corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "init", Image: "quay.io/example/init:v1"}},
+		Containers:     []corev1.Container{{Name: "app", Image: "nginx:1.27"}},
+	}
+
+	type testcase struct {
+		name          string
+		resource      string
+		object        runtime.Object
+		expectedPath  string
+		expectPatches bool
+	}
+	tests := []testcase{
+		{
+			name:     "a deployment pod template should be rewritten",
+			resource: "deployments",
+			object: &appsv1.Deployment{
+				TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+				Spec:     appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}},
+			},
+			expectedPath:  "/spec/template/spec/containers/0/image",
+			expectPatches: true,
+		},
+		{
+			name:     "a cronjob pod template should be rewritten",
+			resource: "cronjobs",
+			object: &batchv1.CronJob{
+				TypeMeta: metav1.TypeMeta{APIVersion: "batch/v1", Kind: "CronJob"},
+				Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{Spec: podSpec},
+				}}},
+			},
+			expectedPath:  "/spec/jobTemplate/spec/template/spec/containers/0/image",
+			expectPatches: true,
+		},
+		{
+			name:     "a statefulset is not rewritten unless enabled",
+			resource: "statefulsets",
+			object: &appsv1.StatefulSet{
+				TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+				Spec:     appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: podSpec}},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := json.Marshal(tc.object)
+			require.NoError(t, err)
+			resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Resource: tc.resource},
+				Object:    runtime.RawExtension{Raw: raw},
+			}})
+			require.True(t, resp.Allowed)
+			if !tc.expectPatches {
+				require.Empty(t, resp.Patches)
+				return
+			}
+			patches := patchesByPath(resp)
+			require.Len(t, patches, 2, "the image is rewritten and the original image recorded in the template annotations")
+			require.Equal(t, "harbor.example.com/dockerhub-proxy/library/nginx:1.27", patches[tc.expectedPath])
+		})
+	}
+}
+
+func TestWorkloadContainerProxier_HandleUpdate(t *testing.T) {
+	transformers, err := MakeTransformers([]config.ProxyRule{
+		{
+			Name:    "docker.io proxy cache",
+			Matches: []string{"^docker.io"},
+			Replace: "harbor.example.com/dockerhub-proxy",
+		},
+	}, nil)
+	require.NoError(t, err)
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	decoder := admission.NewDecoder(scheme)
+	proxier := WorkloadContainerProxier{
+		Decoder:   decoder,
+		Pods:      &PodContainerProxier{Decoder: decoder, Transformers: transformers},
+		Workloads: map[string]bool{"deployments": true, "jobs": true},
+	}
+
+	template := func(image string) corev1.PodTemplateSpec {
+		return corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}}}
+	}
+	deployment := func(image string, labels map[string]string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Labels: labels},
+			Spec:       appsv1.DeploymentSpec{Template: template(image)},
+		}
+	}
+	job := func(labels map[string]string) *batchv1.Job {
+		return &batchv1.Job{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+			ObjectMeta: metav1.ObjectMeta{Name: "migrate", Labels: labels},
+			Spec:       batchv1.JobSpec{Template: template("nginx:1.27")},
+		}
+	}
+
+	type testcase struct {
+		name          string
+		resource      string
+		old           runtime.Object
+		object        runtime.Object
+		expectPatches bool
+	}
+	tests := []testcase{
+		{
+			name:     "a job is not mutated on update, as its pod template is immutable",
+			resource: "jobs",
+			old:      job(nil),
+			object:   job(map[string]string{"team": "platform"}),
+		},
+		{
+			name:     "a deployment whose pod template is unchanged is not mutated",
+			resource: "deployments",
+			old:      deployment("nginx:1.27", nil),
+			object:   deployment("nginx:1.27", map[string]string{"team": "platform"}),
+		},
+		{
+			name:          "a deployment whose pod template changed is mutated",
+			resource:      "deployments",
+			old:           deployment("nginx:1.26", nil),
+			object:        deployment("nginx:1.27", nil),
+			expectPatches: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			old, err := json.Marshal(tc.old)
+			require.NoError(t, err)
+			raw, err := json.Marshal(tc.object)
+			require.NoError(t, err)
+			resp := proxier.Handle(context.TODO(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Update,
+				Resource:  metav1.GroupVersionResource{Resource: tc.resource},
+				Object:    runtime.RawExtension{Raw: raw},
+				OldObject: runtime.RawExtension{Raw: old},
+			}})
+			require.True(t, resp.Allowed)
+			if !tc.expectPatches {
+				require.Empty(t, resp.Patches)
+				return
+			}
+			require.Equal(t, "harbor.example.com/dockerhub-proxy/library/nginx:1.27", patchesByPath(resp)["/spec/template/spec/containers/0/image"])
+		})
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/indeedeng-alpha/harbor-container-webhook/api/v1alpha1"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/audit"
 	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/controller"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/harbor"
 	"github.com/indeedeng-alpha/harbor-container-webhook/internal/webhook"
 
 	admissionv1 "k8s.io/api/admission/v1"
@@ -34,10 +40,20 @@ func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
 	_ = admissionv1.AddToScheme(scheme)
 	_ = admissionv1beta1.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:], os.Stdout, os.Stderr))
+		case "rewrite":
+			os.Exit(rewrite(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		}
+	}
+
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 	opts := zap.Options{}
 	opts.BindFlags(flag.CommandLine)
@@ -52,16 +68,17 @@ func main() {
 	flag.BoolVar(&kubeClientlazyRemap, "kube-client-lazy-remap", false, "Deprecated. Has no effect.")
 	flag.Parse()
 
-	conf, err := config.LoadConfiguration(configPath)
+	configData, err := os.ReadFile(configPath)
 	if err != nil {
 		setupLog.Error(err, "unable to read config from "+configPath)
 		os.Exit(1)
 	}
-	if len(conf.Rules) == 0 {
-		setupLog.Error(err, "no proxy rules configured from "+configPath)
+	conf, err := config.ParseConfiguration(configData)
+	if err != nil {
+		setupLog.Error(err, "unable to read config from "+configPath)
 		os.Exit(1)
 	}
-	setupLog.Info("webhook namespace: " + conf.Rules[0].Namespace)
+	setupLog.Info("webhook namespace: " + conf.Namespace)
 
 	restConfig := ctrl.GetConfigOrDie()
 	restConfig.QPS = float32(kubeClientQPS)
@@ -85,12 +102,6 @@ func main() {
 		os.Exit(1)
 	}
 
-	transformers, err := webhook.MakeTransformers(conf.Rules, mgr.GetClient())
-	if err != nil {
-		setupLog.Error(err, "unable to start harbor-container-webhook")
-		os.Exit(1)
-	}
-
 	if err := mgr.AddHealthzCheck("health-ping", healthz.Ping); err != nil {
 		setupLog.Error(err, "Unable add a liveness check to harbor-container-webhook")
 		os.Exit(1)
@@ -100,21 +111,146 @@ func main() {
 		os.Exit(1)
 	}
 
+	auditLog, err := audit.NewLogger(conf.AuditLog)
+	if err != nil {
+		setupLog.Error(err, "unable to start harbor-container-webhook")
+		os.Exit(1)
+	}
+
+	health := webhook.NewRegistryHealth(conf.RegistryHealth)
 	mutate := webhook.PodContainerProxier{
-		Client:       mgr.GetClient(),
-		Decoder:      admission.NewDecoder(scheme),
-		Transformers: transformers,
-		Verbose:      conf.Verbose,
+		Client:   mgr.GetClient(),
+		Decoder:  admission.NewDecoder(scheme),
+		Health:   health,
+		Verbose:  conf.Verbose,
+		Warnings: conf.AdmissionWarnings,
+		Events:   webhook.NewEventRecorder(conf.Events, mgr.GetEventRecorderFor("harbor-container-webhook")),
+		Audit:    auditLog,
 
 		KubeClientQPS:   float32(kubeClientQPS),
 		KubeClientBurst: kubeClientBurst,
 	}
 	setupLog.Info(fmt.Sprintf("kube client configured for %f.2 QPS, %d Burst", float32(kubeClientQPS), kubeClientBurst))
 
+	if !conf.RegistryHealth.Probe.Disabled {
+		if err := mgr.Add(health); err != nil {
+			setupLog.Error(err, "unable to probe the registries")
+			os.Exit(1)
+		}
+	}
+
+	keychain := &webhook.SecretKeychain{Client: mgr.GetClient(), Cache: mgr.GetCache()}
+	if err := mgr.Add(keychain); err != nil {
+		setupLog.Error(err, "unable to watch auth secrets")
+		os.Exit(1)
+	}
+
+	rules := &webhook.RuleStore{
+		Proxier: &mutate,
+		Client:  mgr.GetClient(),
+		Options: []webhook.TransformerOption{
+			webhook.WithUpstreamCache(webhook.NewUpstreamCache(conf.UpstreamCache)),
+			webhook.WithSecretKeychain(keychain),
+			webhook.WithCredentialProviders(conf.CredentialProviders),
+			webhook.WithRegistryHealth(health),
+		},
+	}
+	if err := rules.Set(webhook.ConfigRuleSource, conf.Rules); err != nil {
+		setupLog.Error(err, "unable to start harbor-container-webhook")
+		os.Exit(1)
+	}
+
 	mgr.GetWebhookServer().Register("/webhook-v1-pod", &ctrlwebhook.Admission{Handler: &mutate})
 
+	var reconciler *controller.ProxyRuleReconciler
+	watcher := &config.Watcher{
+		Path:   configPath,
+		Loaded: configData,
+		OnChange: func(reloaded *config.Configuration) error {
+			if err := rules.Set(webhook.ConfigRuleSource, reloaded.Rules); err != nil {
+				return err
+			}
+			setupLog.Info(fmt.Sprintf("reloaded %d proxy rules from %s", len(reloaded.Rules), configPath))
+			if reconciler != nil {
+				if err := reconciler.SetDefaultMode(context.TODO(), reloaded.Mode); err != nil {
+					setupLog.Error(err, "unable to apply the reloaded mode to the ProxyRules")
+				}
+			}
+			if changed := config.UnreloadedChanges(conf, reloaded); len(changed) > 0 {
+				setupLog.Info(fmt.Sprintf("the changes to %s in %s are only applied on restart", strings.Join(changed, ", "), configPath))
+			}
+			return nil
+		},
+	}
+	if err := mgr.Add(watcher); err != nil {
+		setupLog.Error(err, "unable to watch the config of harbor-container-webhook")
+		os.Exit(1)
+	}
+
+	if conf.HarborDiscovery.URL != "" {
+		discovery, err := harbor.NewDiscovery(conf.HarborDiscovery, conf.Namespace, mgr.GetClient(), rules)
+		if err != nil {
+			setupLog.Error(err, "unable to discover the harbor proxy cache projects")
+			os.Exit(1)
+		}
+		setupLog.Info("discovering the proxy cache projects of " + conf.HarborDiscovery.URL)
+		if err := mgr.Add(discovery); err != nil {
+			setupLog.Error(err, "unable to discover the harbor proxy cache projects")
+			os.Exit(1)
+		}
+	}
+
+	if conf.ProjectVerification.Enabled {
+		verifier := harbor.NewVerifier(conf.ProjectVerification, conf.Namespace, mgr.GetClient(), rules)
+		if err := mgr.Add(verifier); err != nil {
+			setupLog.Error(err, "unable to verify the harbor projects of the rules")
+			os.Exit(1)
+		}
+		if conf.ProjectVerification.FailReadiness {
+			if err := mgr.AddReadyzCheck("harbor-projects", verifier.Check); err != nil {
+				setupLog.Error(err, "Unable add a readiness check to harbor-container-webhook")
+				os.Exit(1)
+			}
+		}
+	}
+
+	if conf.EnableProxyRules {
+		reconciler = &controller.ProxyRuleReconciler{
+			Client:      mgr.GetClient(),
+			Rules:       rules,
+			Namespace:   conf.Namespace,
+			DefaultMode: conf.Mode,
+		}
+		if err := reconciler.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to start the ProxyRule controller")
+			os.Exit(1)
+		}
+		if err := mgr.AddReadyzCheck("proxyrules", reconciler.Check); err != nil {
+			setupLog.Error(err, "Unable add a readiness check to harbor-container-webhook")
+			os.Exit(1)
+		}
+	}
+
+	if len(conf.Workloads) > 0 {
+		workloads := make(map[string]bool, len(conf.Workloads))
+		for _, workload := range conf.Workloads {
+			workloads[workload] = true
+		}
+		setupLog.Info(fmt.Sprintf("mutating workload pod templates for %v", conf.Workloads))
+		mgr.GetWebhookServer().Register("/webhook-v1-workload", &ctrlwebhook.Admission{Handler: &webhook.WorkloadContainerProxier{
+			Decoder:   admission.NewDecoder(scheme),
+			Pods:      &mutate,
+			Workloads: workloads,
+		}})
+	}
+
 	setupLog.Info("starting harbor-container-webhook")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctrl.SetupSignalHandler())
+	// the webhook server has drained the admissions once the manager returns, so no record is written after this
+	if closeErr := auditLog.Close(); closeErr != nil {
+		setupLog.Error(closeErr, "failed to close the audit log")
+	}
+	if err != nil {
 		setupLog.Error(err, "problem running harbor-container-webhook")
 		os.Exit(1)
 	}
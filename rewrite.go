@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/go-logr/logr"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/webhook"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// rewrite implements the rewrite subcommand, which evaluates the rules of a configuration file against image
+// references, or the manifests on stdin, without a cluster, and returns the exit code. The rewritten manifests are
+// written to stdout, and the decision of each rule to stderr.
+func rewrite(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("rewrite", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: harbor-container-webhook rewrite --config <file> [flags] [image...] < manifests.yaml")
+		flags.PrintDefaults()
+	}
+	configPath := flags.String("config", "", "path to the config for the harbor-container-webhook")
+	namespace := flags.String("namespace", "default", "namespace of the images, and of the manifests which don't set one")
+	namespaceLabels := flags.String("namespace-labels", "", "labels of the namespace for rules with a namespaceSelector, e.g. team=a,env=prod")
+	checkUpstream := flags.Bool("check-upstream", false, "check the rewritten images exist in the upstream registry, for rules with checkUpstream")
+	verbose := flags.Bool("verbose", false, "log the evaluation of the rules to stderr")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" {
+		flags.Usage()
+		return 2
+	}
+	if *verbose {
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true), zap.WriteTo(stderr)))
+	} else {
+		ctrl.SetLogger(logr.Discard())
+	}
+
+	conf, err := config.LoadConfiguration(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s is invalid:\n%s\n", *configPath, err.Error())
+		return 1
+	}
+	selector, err := labels.ConvertSelectorToLabelsMap(*namespaceLabels)
+	if err != nil {
+		fmt.Fprintf(stderr, "invalid --namespace-labels: %s\n", err.Error())
+		return 2
+	}
+	transformers, err := webhook.MakeTransformers(conf.Rules, nil, webhook.WithCredentialProviders(conf.CredentialProviders))
+	if err != nil {
+		fmt.Fprintf(stderr, "%s is invalid:\n%s\n", *configPath, err.Error())
+		return 1
+	}
+	rewriter := &webhook.OfflineRewriter{
+		Proxier:       &webhook.PodContainerProxier{Transformers: transformers},
+		Namespace:     webhook.Namespace{Name: *namespace, Labels: selector},
+		CheckUpstream: *checkUpstream,
+	}
+
+	ctx := context.Background()
+	if flags.NArg() > 0 {
+		failed := false
+		for _, imageRef := range flags.Args() {
+			result, err := rewriter.RewriteImage(ctx, imageRef)
+			if err != nil {
+				fmt.Fprintf(stderr, "failed to rewrite %s: %s\n", imageRef, err.Error())
+				failed = true
+				continue
+			}
+			fmt.Fprintf(stdout, "%s -> %s\n", result.Image, result.Rewritten)
+			printDecisions(stdout, result.Decisions)
+		}
+		if failed {
+			return 1
+		}
+		return 0
+	}
+
+	rewrites, err := rewriter.RewriteManifests(ctx, stdin, stdout)
+	for _, manifest := range rewrites {
+		fmt.Fprintf(stderr, "%s %s/%s:\n", manifest.Kind, manifest.Namespace, manifest.Name)
+		for _, container := range manifest.Containers {
+			fmt.Fprintf(stderr, "  container %q: %s -> %s\n", container.Container, container.Image, container.Rewritten)
+			printDecisions(stderr, container.Decisions)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+// printDecisions prints the decision of each evaluated rule, indented under its image.
+func printDecisions(w io.Writer, decisions []webhook.RuleDecision) {
+	if len(decisions) == 0 {
+		fmt.Fprintln(w, "    no rules")
+	}
+	for _, decision := range decisions {
+		if decision.Rule == "" {
+			fmt.Fprintf(w, "    %s\n", decision.Reason)
+			continue
+		}
+		fmt.Fprintf(w, "    rule %q: %s\n", decision.Rule, decision.Reason)
+	}
+}
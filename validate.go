@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/config"
+	"github.com/indeedeng-alpha/harbor-container-webhook/internal/webhook"
+)
+
+// validate implements the validate subcommand, which checks a configuration file without starting the webhook, and
+// returns the exit code.
+func validate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "", "path to the config for the harbor-container-webhook")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" {
+		fmt.Fprintln(stderr, "usage: harbor-container-webhook validate --config <file>")
+		return 2
+	}
+
+	conf, err := config.LoadConfiguration(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s is invalid:\n%s\n", *configPath, err.Error())
+		return 1
+	}
+	// the rules compile, so check what only the webhook knows, such as replace templates and auth providers
+	var errs config.ValidationErrors
+	for i, rule := range conf.Rules {
+		if err := webhook.ValidateRule(rule); err != nil {
+			errs = append(errs, conf.FieldError(fmt.Sprintf("rules[%d]", i), "%s", err.Error()))
+		}
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(stderr, "%s is invalid:\n%s\n", *configPath, errs.Error())
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s is valid, %d rules\n", *configPath, len(conf.Rules))
+	return 0
+}